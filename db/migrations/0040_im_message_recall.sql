@@ -0,0 +1,3 @@
+alter table chat_messages
+  add column if not exists recalled_at timestamptz null,
+  add column if not exists recalled_by uuid null;
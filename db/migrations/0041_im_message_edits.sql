@@ -0,0 +1,23 @@
+alter table chat_threads
+  add column if not exists last_change_seq bigint not null default 0;
+
+alter table chat_messages
+  add column if not exists edited_at timestamptz null,
+  add column if not exists edit_count int not null default 0,
+  add column if not exists change_seq bigint not null default 0;
+
+create index if not exists chat_messages_thread_change_seq_idx
+  on chat_messages (thread_id, change_seq)
+  where change_seq > 0;
+
+create table if not exists chat_message_edits (
+  id uuid primary key default gen_random_uuid(),
+  message_id uuid not null references chat_messages(id) on delete cascade,
+  thread_id uuid not null references chat_threads(id) on delete cascade,
+  editor_id uuid not null,
+  prev_content jsonb not null,
+  edited_at timestamptz not null default now()
+);
+
+create index if not exists chat_message_edits_message_id_idx
+  on chat_message_edits (message_id, edited_at);
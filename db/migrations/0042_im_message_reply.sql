@@ -0,0 +1,4 @@
+-- No foreign key: retention deletes quoted messages independently, and a
+-- dangling reference renders as unavailable.
+alter table chat_messages
+  add column if not exists reply_to_msg_id uuid null;
@@ -0,0 +1,11 @@
+create table if not exists chat_message_reactions (
+  message_id uuid not null references chat_messages(id) on delete cascade,
+  thread_id uuid not null references chat_threads(id) on delete cascade,
+  user_id uuid not null,
+  emoji text not null,
+  created_at timestamptz not null default now(),
+  primary key (message_id, user_id, emoji)
+);
+
+create index if not exists chat_message_reactions_message_idx
+  on chat_message_reactions (message_id, emoji);
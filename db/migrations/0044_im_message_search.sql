@@ -0,0 +1,41 @@
+-- Full-text search over text messages. The 'simple' parser does not segment
+-- CJK, so im_search_tokens rewrites each CJK run as its unigrams plus bigrams;
+-- other text passes through lowercased. Queries go through the same function,
+-- so a multi-character CJK query matches by its bigrams.
+create or replace function im_search_tokens(input text)
+returns text
+language plpgsql
+immutable
+strict
+parallel safe
+as $$
+declare
+  s text := lower(left(input, 4000));
+  result text := '';
+  ch text;
+  prev text := null;
+begin
+  for i in 1..char_length(s) loop
+    ch := substr(s, i, 1);
+    if ch ~ '[\u3040-\u30ff\u3400-\u4dbf\u4e00-\u9fff\uac00-\ud7af\uf900-\ufaff]' then
+      result := result || ' ' || ch;
+      if prev is not null then
+        result := result || ' ' || prev || ch;
+      end if;
+      prev := ch;
+    else
+      if prev is not null then
+        result := result || ' ';
+        prev := null;
+      end if;
+      result := result || ch;
+    end if;
+  end loop;
+  return result;
+end;
+$$;
+
+create index if not exists chat_messages_text_search_idx
+  on chat_messages
+  using gin (to_tsvector('simple', im_search_tokens(content->>'text')))
+  where type = 'text';
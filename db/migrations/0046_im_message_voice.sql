@@ -0,0 +1 @@
+alter type chat_message_type add value if not exists 'voice';
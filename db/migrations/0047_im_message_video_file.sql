@@ -0,0 +1,2 @@
+alter type chat_message_type add value if not exists 'video';
+alter type chat_message_type add value if not exists 'file';
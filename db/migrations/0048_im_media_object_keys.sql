@@ -0,0 +1,23 @@
+-- IM media is private: content keeps object keys only and im-api signs
+-- download URLs per request. Backfill object_key from legacy public URLs,
+-- then drop the stored URLs (also on thumbnail variants). Rows whose URL does
+-- not contain an IM object key are left as they are.
+update chat_messages
+set content = content || jsonb_build_object(
+  'object_key', substring(content->>'url' from '/((?:im|im-voice|im-video|im-file)/[^?#]+)'))
+where type in ('image', 'voice', 'video', 'file')
+  and coalesce(content->>'object_key', '') = ''
+  and content->>'url' ~ '/(im|im-voice|im-video|im-file)/';
+
+update chat_messages
+set content = content - 'url'
+where type in ('image', 'voice', 'video', 'file')
+  and content ? 'url'
+  and coalesce(content->>'object_key', '') <> '';
+
+update chat_messages
+set content = jsonb_set(content, '{variants}', (
+  select coalesce(jsonb_object_agg(name, variant - 'url'), '{}'::jsonb)
+  from jsonb_each(content->'variants') as v(name, variant)))
+where type = 'image'
+  and jsonb_typeof(content->'variants') = 'object';
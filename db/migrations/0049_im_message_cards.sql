@@ -0,0 +1,5 @@
+-- Card messages reference an experience, order or trip card in the main
+-- database; content holds {ref_id, snapshot, snapshot_at}.
+alter type chat_message_type add value if not exists 'experience_card';
+alter type chat_message_type add value if not exists 'order_card';
+alter type chat_message_type add value if not exists 'trip_card';
@@ -0,0 +1,27 @@
+-- Thread lifecycle: who moved a thread to its current status and why, plus a
+-- scheduled close (order completion closes the thread after a grace period).
+alter table chat_threads
+  add column if not exists status_reason text null,
+  add column if not exists status_actor_type text null,
+  add column if not exists status_actor_id text null,
+  add column if not exists status_changed_at timestamptz null,
+  add column if not exists close_at timestamptz null,
+  add column if not exists close_reason text null;
+
+create index if not exists chat_threads_close_at_idx
+  on chat_threads (close_at)
+  where close_at is not null;
+
+create table if not exists chat_thread_status_events (
+  id uuid primary key default gen_random_uuid(),
+  thread_id uuid not null references chat_threads(id) on delete cascade,
+  from_status text not null,
+  to_status text not null,
+  reason text null,
+  actor_type text not null,
+  actor_id text not null,
+  created_at timestamptz not null default now()
+);
+
+create index if not exists chat_thread_status_events_thread_idx
+  on chat_thread_status_events (thread_id, created_at);
@@ -0,0 +1,54 @@
+-- Support threads: one per user with our CS team, served by a pool of agents.
+-- 0026 narrowed chat_threads.type to match/order; support comes back here.
+alter table chat_threads
+  add column if not exists support_user_id uuid null,
+  add column if not exists assigned_agent_id uuid null,
+  add column if not exists assigned_at timestamptz null;
+
+alter table chat_threads
+  drop constraint if exists chat_threads_type_check,
+  drop constraint if exists chat_threads_match_order_check;
+
+alter table chat_threads
+  add constraint chat_threads_type_check check (type in ('match', 'order', 'support')),
+  add constraint chat_threads_match_order_check check (
+    (type = 'match' and match_session_id is not null and order_id is null) or
+    (type = 'order' and order_id is not null and match_session_id is null) or
+    (type = 'support' and support_user_id is not null and order_id is null and match_session_id is null)
+  );
+
+create unique index if not exists chat_threads_support_user_idx
+  on chat_threads (support_user_id)
+  where type = 'support';
+
+create index if not exists chat_threads_support_queue_idx
+  on chat_threads (assigned_agent_id, last_message_at)
+  where type = 'support';
+
+alter table chat_thread_members
+  drop constraint if exists chat_thread_members_role_check;
+
+alter table chat_thread_members
+  add constraint chat_thread_members_role_check check (role in ('traveler', 'host', 'customer', 'support_agent'));
+
+create table if not exists im_support_agents (
+  user_id uuid primary key,
+  display_name text not null default '',
+  active boolean not null default true,
+  max_active_threads int not null default 20,
+  created_at timestamptz not null default now(),
+  updated_at timestamptz not null default now()
+);
+
+create table if not exists chat_support_assignments (
+  id uuid primary key default gen_random_uuid(),
+  thread_id uuid not null references chat_threads(id) on delete cascade,
+  agent_id uuid null,
+  previous_agent_id uuid null,
+  actor_type text not null,
+  actor_id text not null,
+  created_at timestamptz not null default now()
+);
+
+create index if not exists chat_support_assignments_thread_idx
+  on chat_support_assignments (thread_id, created_at);
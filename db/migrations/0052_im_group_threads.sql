@@ -0,0 +1,31 @@
+-- Group threads: any number of members with owner/admin/member roles. New
+-- members see history from visible_from_seq (0 = everything still retained).
+alter table chat_threads
+  add column if not exists title text null,
+  add column if not exists history_visibility text not null default 'full',
+  add column if not exists created_by uuid null;
+
+alter table chat_threads
+  drop constraint if exists chat_threads_history_visibility_check,
+  drop constraint if exists chat_threads_type_check,
+  drop constraint if exists chat_threads_match_order_check;
+
+alter table chat_threads
+  add constraint chat_threads_history_visibility_check check (history_visibility in ('full', 'from_join')),
+  add constraint chat_threads_type_check check (type in ('match', 'order', 'support', 'group')),
+  add constraint chat_threads_match_order_check check (
+    (type = 'match' and match_session_id is not null and order_id is null) or
+    (type = 'order' and order_id is not null and match_session_id is null) or
+    (type = 'support' and support_user_id is not null and order_id is null and match_session_id is null) or
+    (type = 'group' and order_id is null and match_session_id is null and support_user_id is null)
+  );
+
+alter table chat_thread_members
+  add column if not exists visible_from_seq bigint not null default 0;
+
+alter table chat_thread_members
+  drop constraint if exists chat_thread_members_role_check;
+
+alter table chat_thread_members
+  add constraint chat_thread_members_role_check
+  check (role in ('traveler', 'host', 'customer', 'support_agent', 'owner', 'admin', 'member'));
@@ -0,0 +1,13 @@
+-- Per-member thread settings: mute, pin, archive and notification level.
+alter table chat_thread_members
+  add column if not exists muted_until timestamptz null,
+  add column if not exists pinned_at timestamptz null,
+  add column if not exists archived_at timestamptz null,
+  add column if not exists notify_level text not null default 'all';
+
+alter table chat_thread_members
+  drop constraint if exists chat_thread_members_notify_level_check;
+
+alter table chat_thread_members
+  add constraint chat_thread_members_notify_level_check
+  check (notify_level in ('all', 'mentions', 'none'));
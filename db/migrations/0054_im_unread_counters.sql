@@ -0,0 +1,120 @@
+-- Per-user unread totals by thread type, so the app badge doesn't need to
+-- scan every membership. A member's unread count is
+-- greatest(chat_threads.last_seq - last_read_seq, 0), the same number
+-- GET /v1/threads reports; triggers apply the change in that number to the
+-- counter in the same transaction as the write that caused it.
+create table if not exists chat_unread_counters (
+  user_id uuid not null,
+  thread_type text not null,
+  unread_count bigint not null default 0,
+  updated_at timestamptz not null default now(),
+  primary key (user_id, thread_type)
+);
+
+-- New messages (and any other last_seq bump) add to every member behind.
+-- Rows are taken in user_id order so concurrent sends don't deadlock.
+create or replace function im_unread_on_thread_seq()
+returns trigger
+language plpgsql
+as $$
+begin
+  insert into chat_unread_counters as c (user_id, thread_type, unread_count)
+  select m.user_id, new.type,
+         greatest(new.last_seq - m.last_read_seq, 0) - greatest(old.last_seq - m.last_read_seq, 0)
+  from chat_thread_members m
+  where m.thread_id = new.id and m.last_read_seq < new.last_seq
+  order by m.user_id
+  on conflict (user_id, thread_type) do update
+    set unread_count = c.unread_count + excluded.unread_count,
+        updated_at = now();
+  return null;
+end;
+$$;
+
+-- Joining, reading and leaving move one member's contribution.
+create or replace function im_unread_on_member()
+returns trigger
+language plpgsql
+as $$
+declare
+  v_thread_id uuid;
+  v_user_id uuid;
+  v_type text;
+  v_last_seq bigint;
+  v_delta bigint := 0;
+begin
+  if tg_op = 'DELETE' then
+    v_thread_id := old.thread_id;
+    v_user_id := old.user_id;
+  else
+    v_thread_id := new.thread_id;
+    v_user_id := new.user_id;
+  end if;
+  select type, last_seq into v_type, v_last_seq from chat_threads where id = v_thread_id;
+  if not found then
+    return null;
+  end if;
+  if tg_op in ('INSERT', 'UPDATE') then
+    v_delta := v_delta + greatest(v_last_seq - new.last_read_seq, 0);
+  end if;
+  if tg_op in ('UPDATE', 'DELETE') then
+    v_delta := v_delta - greatest(v_last_seq - old.last_read_seq, 0);
+  end if;
+  if v_delta <> 0 then
+    insert into chat_unread_counters as c (user_id, thread_type, unread_count)
+    values (v_user_id, v_type, v_delta)
+    on conflict (user_id, thread_type) do update
+      set unread_count = c.unread_count + excluded.unread_count,
+          updated_at = now();
+  end if;
+  return null;
+end;
+$$;
+
+-- Deleting a thread removes its members' unread before the cascade runs
+-- (the member trigger then finds no thread and does nothing).
+create or replace function im_unread_on_thread_delete()
+returns trigger
+language plpgsql
+as $$
+begin
+  update chat_unread_counters c
+  set unread_count = c.unread_count - greatest(old.last_seq - m.last_read_seq, 0),
+      updated_at = now()
+  from chat_thread_members m
+  where m.thread_id = old.id
+    and c.user_id = m.user_id
+    and c.thread_type = old.type
+    and m.last_read_seq < old.last_seq;
+  return old;
+end;
+$$;
+
+drop trigger if exists chat_threads_unread_seq on chat_threads;
+create trigger chat_threads_unread_seq
+  after update of last_seq on chat_threads
+  for each row
+  when (new.last_seq > old.last_seq)
+  execute function im_unread_on_thread_seq();
+
+drop trigger if exists chat_threads_unread_delete on chat_threads;
+create trigger chat_threads_unread_delete
+  before delete on chat_threads
+  for each row
+  execute function im_unread_on_thread_delete();
+
+drop trigger if exists chat_thread_members_unread on chat_thread_members;
+create trigger chat_thread_members_unread
+  after insert or delete or update of last_read_seq on chat_thread_members
+  for each row
+  execute function im_unread_on_member();
+
+-- Backfill (idempotent: recomputes from scratch).
+insert into chat_unread_counters as c (user_id, thread_type, unread_count)
+select m.user_id, t.type, sum(greatest(t.last_seq - m.last_read_seq, 0))
+from chat_thread_members m
+join chat_threads t on t.id = m.thread_id
+group by m.user_id, t.type
+on conflict (user_id, thread_type) do update
+  set unread_count = excluded.unread_count,
+      updated_at = now();
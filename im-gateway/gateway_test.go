@@ -0,0 +1,326 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"terravoy/im/im-gateway/internal/redisx"
+	"terravoy/im/imkit/ratelimit"
+)
+
+func TestProtocolFlow(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice", "bob")
+	mr := miniredis.RunT(t)
+	gw := startGateway(t, testConfig(api, "gw1"), mr)
+
+	alice := dialGateway(t, gw, nil)
+	alice.send(map[string]any{"type": "sub", "thread_id": "t1"})
+	alice.expectError("UNAUTHORIZED")
+	alice.send(map[string]any{"type": "auth", "token": "bogus"})
+	alice.expectError("UNAUTHORIZED")
+	alice.send(map[string]any{"type": "auth", "token": testToken(t, "alice"), "trace_id": "trace-a"})
+	ok := alice.expect("auth_ok")
+	if ok.Payload["user_id"] != "alice" || ok.TraceID != "trace-a" {
+		t.Fatalf("unexpected auth_ok: %+v", ok)
+	}
+	alice.send(map[string]any{"type": "auth", "token": testToken(t, "alice")})
+	alice.expectError("ALREADY_AUTH")
+
+	api.addThread("t2", "carol")
+	alice.send(map[string]any{"type": "sub", "thread_id": "t2"})
+	alice.expectError("FORBIDDEN")
+	alice.subscribe("t1")
+
+	bob := connect(t, gw, "bob")
+	bob.subscribe("t1")
+
+	alice.sendText("t1", "c1", "hello")
+	ack := alice.expect("ack")
+	if ack.Payload["action"] != "msg" || ack.Payload["client_msg_id"] != "c1" || payloadInt(ack, "seq") != 1 {
+		t.Fatalf("unexpected msg ack: %+v", ack)
+	}
+	for _, c := range []*wsClient{alice, bob} {
+		m := c.expect("msg")
+		content, _ := m.Payload["content"].(map[string]any)
+		if m.Payload["sender_id"] != "alice" || payloadInt(m, "seq") != 1 || content["text"] != "hello" {
+			t.Fatalf("unexpected msg: %+v", m)
+		}
+	}
+
+	bob.send(map[string]any{"type": "read", "thread_id": "t1", "last_read_seq": 1})
+	if ack := bob.expect("ack"); ack.Payload["action"] != "read" {
+		t.Fatalf("unexpected read ack: %+v", ack)
+	}
+	if got := api.lastRead("t1", "bob"); got != 1 {
+		t.Fatalf("last_read_seq = %d, want 1", got)
+	}
+	bob.send(map[string]any{"type": "read", "thread_id": "t1"})
+	bob.expectError("INVALID_REQUEST")
+
+	bob.send(map[string]any{"type": "ping"})
+	if ack := bob.expect("ack"); ack.Payload["action"] != "ping" {
+		t.Fatalf("unexpected ping ack: %+v", ack)
+	}
+	if got, err := mr.Get(redisx.KeyPresence("bob")); err != nil || got != "gw1" {
+		t.Fatalf("presence = %q, %v", got, err)
+	}
+
+	bob.send(map[string]any{"type": "bogus"})
+	bob.expectError("UNKNOWN_TYPE")
+	if err := bob.conn.WriteMessage(1, []byte("{not json")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	bob.expectError("INVALID_JSON")
+}
+
+func TestReplyCarriesQuote(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice", "bob")
+	mr := miniredis.RunT(t)
+	gw1 := startGateway(t, testConfig(api, "gw1"), mr)
+	gw2 := startGateway(t, testConfig(api, "gw2"), mr)
+	alice := connect(t, gw1, "alice")
+	bob := connect(t, gw2, "bob")
+	bob.subscribe("t1")
+
+	alice.send(map[string]any{
+		"type":            "msg",
+		"thread_id":       "t1",
+		"client_msg_id":   "r1",
+		"msg_type":        "text",
+		"content":         map[string]any{"text": "agreed"},
+		"reply_to_msg_id": "msg_c0",
+	})
+	alice.expect("ack")
+	m := bob.expect("msg")
+	quote, _ := m.Payload["reply_to"].(map[string]any)
+	if quote["msg_id"] != "msg_c0" || quote["snippet"] != "quoted" {
+		t.Fatalf("unexpected reply_to: %+v", m)
+	}
+}
+
+func TestFanoutCarriesSignedMediaContent(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice", "bob")
+	mr := miniredis.RunT(t)
+	gw1 := startGateway(t, testConfig(api, "gw1"), mr)
+	gw2 := startGateway(t, testConfig(api, "gw2"), mr)
+	alice := connect(t, gw1, "alice")
+	bob := connect(t, gw2, "bob")
+	bob.subscribe("t1")
+
+	alice.send(map[string]any{
+		"type":          "msg",
+		"thread_id":     "t1",
+		"client_msg_id": "img1",
+		"msg_type":      "image",
+		"content":       map[string]any{"object_key": "im/dev/2026/01/a.jpg", "url": "https://public.example/im/dev/2026/01/a.jpg"},
+	})
+	alice.expect("ack")
+	m := bob.expect("msg")
+	content, _ := m.Payload["content"].(map[string]any)
+	if content["url"] != "https://signed.example/im/dev/2026/01/a.jpg?signature=x" {
+		t.Fatalf("fanout should carry im-api content: %+v", m.Payload)
+	}
+}
+
+func TestLocationValidatedAtGateway(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice")
+	gw := startGateway(t, testConfig(api, "gw1"), nil)
+	alice := connect(t, gw, "alice")
+	location := func(id string, content map[string]any) {
+		alice.send(map[string]any{"type": "msg", "thread_id": "t1", "client_msg_id": id, "msg_type": "location", "content": content})
+	}
+	location("bad", map[string]any{"lat": 91, "lng": 121.47})
+	alice.expectError("INVALID_LOCATION_CONTENT")
+	location("missing", map[string]any{"name": "People's Square"})
+	alice.expectError("INVALID_LOCATION_CONTENT")
+	location("ok", map[string]any{"lat": 31.2304, "lng": 121.4737, "name": "人民广场"})
+	if ack := alice.expect("ack"); ack.Payload["client_msg_id"] != "ok" {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+}
+
+func TestAuthFromHeaderToken(t *testing.T) {
+	api := newFakeAPI(t)
+	gw := startGateway(t, testConfig(api, "gw1"), nil)
+	header := http.Header{"Authorization": []string{"Bearer " + testToken(t, "alice")}}
+	c := dialGateway(t, gw, header)
+	c.send(map[string]any{"type": "auth"})
+	if ok := c.expect("auth_ok"); ok.Payload["user_id"] != "alice" {
+		t.Fatalf("unexpected auth_ok: %+v", ok)
+	}
+}
+
+func TestMultiGatewayFanout(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice", "bob")
+	mr := miniredis.RunT(t)
+	gw1 := startGateway(t, testConfig(api, "gw1"), mr)
+	gw2 := startGateway(t, testConfig(api, "gw2"), mr)
+
+	alice := connect(t, gw1, "alice")
+	alice.subscribe("t1")
+	bob := connect(t, gw2, "bob")
+	bob.subscribe("t1")
+
+	alice.sendText("t1", "c1", "across gateways")
+	alice.expect("ack")
+	if m := alice.expect("msg"); m.Payload["_origin_gw"] != "gw1" {
+		t.Fatalf("unexpected local msg: %+v", m)
+	}
+	if m := bob.expect("msg"); m.Payload["_origin_gw"] != "gw1" || payloadInt(m, "seq") != 1 {
+		t.Fatalf("unexpected fanout msg: %+v", m)
+	}
+
+	// The Redis echo of alice's own message must be filtered on gw1, so the
+	// next frame she sees is the ping ack rather than a duplicate msg.
+	bob.send(map[string]any{"type": "ping"})
+	bob.expect("ack")
+	alice.send(map[string]any{"type": "ping"})
+	if ack := alice.expect("ack"); ack.Payload["action"] != "ping" {
+		t.Fatalf("unexpected frame after fanout: %+v", ack)
+	}
+}
+
+func TestMembersChangedUpdatesSubscriptions(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("g1", "alice")
+	mr := miniredis.RunT(t)
+	gw := startGateway(t, testConfig(api, "gw1"), mr)
+	carol := connect(t, gw, "carol")
+
+	mr.Publish("im:fanout:g1", `{"type":"members_changed","payload":{"kind":"join","added":[{"user_id":"carol","role":"member"}],"removed":[]}}`)
+	if f := carol.expect("members_changed"); f.Payload["kind"] != "join" {
+		t.Fatalf("unexpected frame: %+v", f)
+	}
+	mr.Publish("im:fanout:g1", `{"type":"msg","payload":{"thread_id":"g1","seq":2}}`)
+	if m := carol.expect("msg"); payloadInt(m, "seq") != 2 {
+		t.Fatalf("unexpected msg: %+v", m)
+	}
+
+	mr.Publish("im:fanout:g1", `{"type":"members_changed","payload":{"kind":"remove","added":[],"removed":["carol"]}}`)
+	carol.expect("members_changed")
+	waitFor(t, "carol unsubscribed", func() bool {
+		gw.hub.mu.RLock()
+		defer gw.hub.mu.RUnlock()
+		return len(gw.hub.threadSubs["g1"]) == 0
+	})
+	mr.Publish("im:fanout:g1", `{"type":"msg","payload":{"thread_id":"g1","seq":3}}`)
+	carol.send(map[string]any{"type": "ping"})
+	if ack := carol.expect("ack"); ack.Payload["action"] != "ping" {
+		t.Fatalf("removed member still subscribed: %+v", ack)
+	}
+}
+
+func TestPipelineKeepsConnectionResponsive(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice")
+	api.addThread("t2", "alice")
+	gw := startGateway(t, testConfig(api, "gw1"), nil)
+	alice := connect(t, gw, "alice")
+	release := api.hold("t1")
+	defer release()
+
+	alice.sendText("t1", "slow", "blocked")
+	alice.send(map[string]any{"type": "ping"})
+	if ack := alice.expect("ack"); ack.Payload["action"] != "ping" {
+		t.Fatalf("ping blocked behind slow send: %+v", ack)
+	}
+	alice.sendText("t2", "fast", "other thread")
+	if ack := alice.expect("ack"); ack.Payload["client_msg_id"] != "fast" {
+		t.Fatalf("other thread blocked behind slow send: %+v", ack)
+	}
+	release()
+	if ack := alice.expect("ack"); ack.Payload["client_msg_id"] != "slow" {
+		t.Fatalf("unexpected ack: %+v", ack)
+	}
+}
+
+func TestPipelineOrdersFramesPerThread(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice")
+	gw := startGateway(t, testConfig(api, "gw1"), nil)
+	alice := connect(t, gw, "alice")
+	release := api.hold("t1")
+	for _, id := range []string{"a", "b", "c"} {
+		alice.sendText("t1", id, id)
+	}
+	release()
+	for i, id := range []string{"a", "b", "c"} {
+		ack := alice.expect("ack")
+		if ack.Payload["client_msg_id"] != id || payloadInt(ack, "seq") != int64(i+1) {
+			t.Fatalf("ack %d out of order: %+v", i, ack)
+		}
+	}
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice")
+	cfg := testConfig(api, "gw1")
+	cfg.ConnMaxInflight = 2
+	gw := startGateway(t, cfg, nil)
+	alice := connect(t, gw, "alice")
+	release := api.hold("t1")
+	defer release()
+
+	alice.sendText("t1", "a", "a")
+	alice.sendText("t1", "b", "b")
+	alice.sendText("t1", "c", "c")
+	f := alice.expectError("BACKPRESSURE")
+	if f.Payload["client_msg_id"] != "c" || payloadInt(f, "limit") != 2 {
+		t.Fatalf("unexpected backpressure frame: %+v", f)
+	}
+	release()
+	alice.expect("ack")
+	alice.expect("ack")
+}
+
+func TestRateLimited(t *testing.T) {
+	api := newFakeAPI(t)
+	api.addThread("t1", "alice")
+	cfg := testConfig(api, "gw1")
+	cfg.RateUserMax = 1
+	gw := startGateway(t, cfg, miniredis.RunT(t))
+	alice := connect(t, gw, "alice")
+	alice.sendText("t1", "a", "a")
+	alice.expect("ack")
+	alice.sendText("t1", "b", "b")
+	alice.expectError("RATE_LIMITED")
+}
+
+func TestRateLimitRedisOutage(t *testing.T) {
+	cases := []struct {
+		mode  string
+		codes []string
+	}{
+		{ratelimit.FailOpen, []string{"", ""}},
+		{ratelimit.FailClosed, []string{"RATE_LIMIT_UNAVAILABLE"}},
+		{ratelimit.FailLocal, []string{"", "RATE_LIMITED"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.mode, func(t *testing.T) {
+			api := newFakeAPI(t)
+			api.addThread("t1", "alice")
+			cfg := testConfig(api, "gw1")
+			cfg.RateUserMax = 1
+			cfg.RateFailMode = tc.mode
+			mr := miniredis.RunT(t)
+			gw := startGateway(t, cfg, mr)
+			alice := connect(t, gw, "alice")
+			mr.Close()
+			for i, code := range tc.codes {
+				alice.sendText("t1", string(rune('a'+i)), "x")
+				if code == "" {
+					alice.expect("ack")
+					continue
+				}
+				alice.expectError(code)
+			}
+		})
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+	"terravoy/im/imkit/ratelimit"
+)
+
+// The harness runs real gateway handlers against a fake im-api (httptest) and
+// miniredis, so protocol flows can be exercised without the full stack.
+
+const testSecret = "test_secret"
+
+const frameTimeout = 2 * time.Second
+
+func testToken(t *testing.T, userID string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": userID}).SignedString([]byte(testSecret))
+	if err != nil {
+		t.Fatalf("sign token: %v", err)
+	}
+	return token
+}
+
+// fakeAPI implements the im-api endpoints the gateway calls.
+type fakeAPI struct {
+	srv     *httptest.Server
+	mu      sync.Mutex
+	members map[string]map[string]bool
+	seqs    map[string]int64
+	reads   map[string]int64
+	gates   map[string]chan struct{}
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	t.Helper()
+	api := &fakeAPI{
+		members: map[string]map[string]bool{},
+		seqs:    map[string]int64{},
+		reads:   map[string]int64{},
+		gates:   map[string]chan struct{}{},
+	}
+	api.srv = httptest.NewServer(http.HandlerFunc(api.serve))
+	t.Cleanup(api.srv.Close)
+	return api
+}
+
+func (a *fakeAPI) addThread(threadID string, userIDs ...string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.members[threadID] = map[string]bool{}
+	for _, id := range userIDs {
+		a.members[threadID][id] = true
+	}
+}
+
+// hold blocks message creation on threadID until the returned func is called.
+func (a *fakeAPI) hold(threadID string) func() {
+	gate := make(chan struct{})
+	a.mu.Lock()
+	a.gates[threadID] = gate
+	a.mu.Unlock()
+	var once sync.Once
+	return func() { once.Do(func() { close(gate) }) }
+}
+
+func (a *fakeAPI) lastRead(threadID, userID string) int64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reads[threadID+":"+userID]
+}
+
+func (a *fakeAPI) isMember(threadID, userID string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.members[threadID][userID]
+}
+
+func (a *fakeAPI) serve(w http.ResponseWriter, r *http.Request) {
+	userID, err := verifyToken(extractBearer(r.Header.Get("Authorization")), testSecret)
+	if err != nil {
+		writeFake(w, http.StatusUnauthorized, nil, "AUTH_INVALID")
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/v1/messages":
+		var body struct {
+			ThreadID    string `json:"thread_id"`
+			ClientMsgID string `json:"client_msg_id"`
+			Type        string `json:"type"`
+			ReplyToID   string `json:"reply_to_msg_id"`
+			Content     struct {
+				ObjectKey string `json:"object_key"`
+			} `json:"content"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if !a.isMember(body.ThreadID, userID) {
+			writeFake(w, http.StatusForbidden, nil, "FORBIDDEN")
+			return
+		}
+		a.mu.Lock()
+		gate := a.gates[body.ThreadID]
+		a.mu.Unlock()
+		if gate != nil {
+			<-gate
+		}
+		a.mu.Lock()
+		a.seqs[body.ThreadID]++
+		seq := a.seqs[body.ThreadID]
+		a.mu.Unlock()
+		resp := map[string]any{
+			"msg_id":     "msg_" + body.ClientMsgID,
+			"seq":        seq,
+			"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+		}
+		if body.ReplyToID != "" {
+			resp["reply_to"] = map[string]any{"msg_id": body.ReplyToID, "snippet": "quoted"}
+		}
+		if body.Type == "image" {
+			// im-api stores the key only and signs a URL on the way out
+			resp["content"] = map[string]any{
+				"object_key": body.Content.ObjectKey,
+				"url":        "https://signed.example/" + body.Content.ObjectKey + "?signature=x",
+			}
+		}
+		writeFake(w, http.StatusOK, resp, "")
+	case len(parts) == 4 && parts[1] == "threads" && parts[3] == "permission":
+		if !a.isMember(parts[2], userID) {
+			writeFake(w, http.StatusForbidden, nil, "FORBIDDEN")
+			return
+		}
+		writeFake(w, http.StatusOK, map[string]any{"allowed": true}, "")
+	case len(parts) == 4 && parts[1] == "threads" && parts[3] == "read":
+		var body struct {
+			LastReadSeq int64 `json:"last_read_seq"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		if !a.isMember(parts[2], userID) {
+			writeFake(w, http.StatusForbidden, nil, "FORBIDDEN")
+			return
+		}
+		a.mu.Lock()
+		a.reads[parts[2]+":"+userID] = body.LastReadSeq
+		a.mu.Unlock()
+		writeFake(w, http.StatusOK, map[string]any{"last_read_seq": body.LastReadSeq}, "")
+	default:
+		writeFake(w, http.StatusNotFound, nil, "NOT_FOUND")
+	}
+}
+
+func writeFake(w http.ResponseWriter, status int, data any, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"success": code == "",
+		"data":    data,
+		"code":    code,
+		"message": strings.ToLower(code),
+	})
+}
+
+func testConfig(api *fakeAPI, gatewayID string) Config {
+	return Config{
+		APIBaseURL:         api.srv.URL,
+		AuthJWTSecret:      testSecret,
+		PresenceTTL:        time.Minute,
+		PresenceRefresh:    time.Hour,
+		GatewayID:          gatewayID,
+		RateUserMax:        100,
+		RateUserWindowMs:   10000,
+		RateThreadMax:      100,
+		RateThreadWindowMs: 10000,
+		SendPolicy:         sendPolicy{Mode: policyDropOldest, QueueSize: 16, BlockTimeout: time.Second},
+		SendPolicyByType:   map[string]sendPolicy{},
+		ConnMaxInflight:    8,
+		RateFailMode:       ratelimit.FailLocal,
+	}
+}
+
+type testGateway struct {
+	cfg Config
+	hub *Hub
+	srv *httptest.Server
+}
+
+// startGateway serves a gateway on an httptest server. When mr is set, its
+// fanout subscriber is running before startGateway returns.
+func startGateway(t *testing.T, cfg Config, mr *miniredis.Miniredis) *testGateway {
+	t.Helper()
+	var rdb *redis.Client
+	hub := newHub()
+	if mr != nil {
+		rdb = redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+		t.Cleanup(func() { _ = rdb.Close() })
+		ctx, cancel := context.WithCancel(context.Background())
+		t.Cleanup(cancel)
+		before := mr.PubSubNumPat()
+		go startFanoutSubscriber(ctx, hub, rdb, cfg.GatewayID)
+		waitFor(t, "fanout subscription", func() bool { return mr.PubSubNumPat() > before })
+	}
+	handler := newHandler(cfg, hub, rdb, ratelimit.New(rdb, cfg.RateFailMode), &http.Client{Timeout: 5 * time.Second})
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return &testGateway{cfg: cfg, hub: hub, srv: srv}
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(frameTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+type frame struct {
+	Type    string         `json:"type"`
+	TraceID string         `json:"trace_id"`
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Payload map[string]any `json:"payload"`
+}
+
+type wsClient struct {
+	t    *testing.T
+	conn *websocket.Conn
+}
+
+func dialGateway(t *testing.T, gw *testGateway, header http.Header) *wsClient {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(gw.srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return &wsClient{t: t, conn: conn}
+}
+
+// connect dials and authenticates userID.
+func connect(t *testing.T, gw *testGateway, userID string) *wsClient {
+	t.Helper()
+	c := dialGateway(t, gw, nil)
+	c.send(map[string]any{"type": "auth", "token": testToken(t, userID)})
+	c.expect("auth_ok")
+	return c
+}
+
+func (c *wsClient) send(v any) {
+	c.t.Helper()
+	if err := c.conn.WriteJSON(v); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+func (c *wsClient) next() frame {
+	c.t.Helper()
+	_ = c.conn.SetReadDeadline(time.Now().Add(frameTimeout))
+	var f frame
+	if err := c.conn.ReadJSON(&f); err != nil {
+		c.t.Fatalf("read: %v", err)
+	}
+	return f
+}
+
+// expect reads the next frame and fails unless it has type typ.
+func (c *wsClient) expect(typ string) frame {
+	c.t.Helper()
+	f := c.next()
+	if f.Type != typ {
+		c.t.Fatalf("expected %q frame, got %+v", typ, f)
+	}
+	return f
+}
+
+func (c *wsClient) expectError(code string) frame {
+	c.t.Helper()
+	f := c.expect("error")
+	if f.Code != code {
+		c.t.Fatalf("expected error %q, got %+v", code, f)
+	}
+	return f
+}
+
+func (c *wsClient) subscribe(threadID string) {
+	c.t.Helper()
+	c.send(map[string]any{"type": "sub", "thread_id": threadID})
+	ack := c.expect("ack")
+	if ack.Payload["action"] != "sub" {
+		c.t.Fatalf("expected sub ack, got %+v", ack)
+	}
+}
+
+func (c *wsClient) sendText(threadID, clientMsgID, text string) {
+	c.t.Helper()
+	c.send(map[string]any{
+		"type":          "msg",
+		"thread_id":     threadID,
+		"client_msg_id": clientMsgID,
+		"msg_type":      "text",
+		"content":       map[string]any{"text": text},
+	})
+}
+
+// payloadInt reads a JSON number from a decoded payload.
+func payloadInt(f frame, key string) int64 {
+	v, _ := f.Payload[key].(float64)
+	return int64(v)
+}
@@ -21,6 +21,8 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"terravoy/im/im-gateway/internal/redisx"
+	"terravoy/im/imkit/msgcontent"
+	"terravoy/im/imkit/ratelimit"
 )
 
 type Config struct {
@@ -35,6 +37,10 @@ type Config struct {
 	RateUserWindowMs  int
 	RateThreadMax     int
 	RateThreadWindowMs int
+	SendPolicy        sendPolicy
+	SendPolicyByType  map[string]sendPolicy
+	ConnMaxInflight   int
+	RateFailMode      string
 }
 
 type ctxKey string
@@ -51,20 +57,57 @@ var (
 		Name: "ws_connections",
 		Help: "Active websocket connections",
 	})
-	wsInbound = prometheus.NewCounter(prometheus.CounterOpts{
+	wsInbound = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "msg_in_total",
-		Help: "Inbound websocket messages",
-	})
+		Help: "Inbound websocket messages by frame type",
+	}, []string{"type"})
 	wsOutbound = prometheus.NewCounter(prometheus.CounterOpts{
 		Name: "msg_out_total",
 		Help: "Outbound websocket messages",
 	})
-	wsErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	wsErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Name: "errors_total",
-		Help: "Websocket handler errors",
+		Help: "Websocket handler errors by error code",
+	}, []string{"code"})
+	gatewayConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "im_gateway_connections",
+		Help: "Active websocket connections per gateway and connection type",
+	}, []string{"gateway_id", "conn_type"})
+	wsSubscriptions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "ws_subscriptions",
+		Help: "Active thread subscriptions across all connections",
+	})
+	upstreamLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "im_api_upstream_latency_ms",
+		Help:    "Latency of gateway calls to im-api in ms",
+		Buckets: []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 8000},
+	}, []string{"endpoint", "status"})
+	fanoutPublishLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fanout_publish_latency_ms",
+		Help:    "Redis fanout publish latency in ms",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
 	})
+	fanoutReceiveLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "fanout_receive_latency_ms",
+		Help:    "Time from fanout publish to receipt on a peer gateway in ms",
+		Buckets: []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000},
+	})
+	fanoutDeliveryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "fanout_delivery_latency_ms",
+		Help:    "Time from message created_at to hand-off to local subscribers in ms",
+		Buckets: []float64{5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000},
+	}, []string{"path"})
 )
 
+// knownFrameTypes bounds the label values of msg_in_total.
+var knownFrameTypes = map[string]bool{
+	"auth": true,
+	"sub":  true,
+	"msg":  true,
+	"read": true,
+	"ping": true,
+}
+
 type inboundMsg struct {
 	Type        string          `json:"type"`
 	Token       string          `json:"token"`
@@ -72,6 +115,7 @@ type inboundMsg struct {
 	MsgType     string          `json:"msg_type"`
 	Content     json.RawMessage `json:"content"`
 	ClientMsgID string          `json:"client_msg_id"`
+	ReplyToID   string          `json:"reply_to_msg_id"`
 	LastReadSeq int64           `json:"last_read_seq"`
 	TraceID     string          `json:"trace_id"`
 }
@@ -90,8 +134,15 @@ type Conn struct {
 	token     string
 	headerToken string
 	traceID   string
-	send      chan []byte
+	send      *sendQueue
 	subs      map[string]bool
+	connType  string
+	policy    sendPolicy
+	done      chan struct{}
+	closeOnce sync.Once
+	gapMu      sync.Mutex
+	gapDropped int
+	gapThreads map[string]bool
 }
 
 type Hub struct {
@@ -128,6 +179,7 @@ func (h *Hub) removeConn(c *Conn) {
 		}
 	}
 	for threadID := range c.subs {
+		wsSubscriptions.Dec()
 		if set, ok := h.threadSubs[threadID]; ok {
 			delete(set, c)
 			if len(set) == 0 {
@@ -150,9 +202,21 @@ func (h *Hub) attachUser(c *Conn, userID string) {
 func (h *Hub) subscribe(c *Conn, threadID string) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+	h.subscribeLocked(c, threadID)
+}
+
+func (h *Hub) subscribeLocked(c *Conn, threadID string) {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
 	if c.subs == nil {
 		c.subs = map[string]bool{}
 	}
+	if !c.subs[threadID] {
+		wsSubscriptions.Inc()
+	}
 	c.subs[threadID] = true
 	if _, ok := h.threadSubs[threadID]; !ok {
 		h.threadSubs[threadID] = map[*Conn]bool{}
@@ -160,14 +224,46 @@ func (h *Hub) subscribe(c *Conn, threadID string) {
 	h.threadSubs[threadID][c] = true
 }
 
+// subscribeUser subscribes every local connection of userID, used when the
+// user is added to a thread so they receive it without re-sending "sub".
+func (h *Hub) subscribeUser(userID, threadID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.userConns[userID] {
+		h.subscribeLocked(c, threadID)
+	}
+}
+
+// unsubscribeUser drops the thread from every local connection of userID
+// once the user has left or been removed.
+func (h *Hub) unsubscribeUser(userID, threadID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.userConns[userID] {
+		if !c.subs[threadID] {
+			continue
+		}
+		delete(c.subs, threadID)
+		wsSubscriptions.Dec()
+		if set, ok := h.threadSubs[threadID]; ok {
+			delete(set, c)
+			if len(set) == 0 {
+				delete(h.threadSubs, threadID)
+			}
+		}
+	}
+}
+
 func (h *Hub) broadcast(threadID string, payload []byte) {
+	// Snapshot subscribers so a blocking send policy never holds the hub lock.
 	h.mu.RLock()
-	defer h.mu.RUnlock()
+	targets := make([]*Conn, 0, len(h.threadSubs[threadID]))
 	for c := range h.threadSubs[threadID] {
-		select {
-		case c.send <- payload:
-		default:
-		}
+		targets = append(targets, c)
+	}
+	h.mu.RUnlock()
+	for _, c := range targets {
+		c.enqueue(outFrame{data: payload, threadID: threadID})
 	}
 }
 
@@ -176,25 +272,25 @@ func main() {
 	setupLogger()
 
 	prometheus.MustRegister(wsConnections, wsInbound, wsOutbound, wsErrors)
+	prometheus.MustRegister(sendQueueDepth, sendQueueDrops)
+	prometheus.MustRegister(gatewayConnections, wsSubscriptions, upstreamLatency)
+	prometheus.MustRegister(fanoutPublishLatency, fanoutReceiveLatency, fanoutDeliveryLatency)
+	prometheus.MustRegister(wsInflight)
+	prometheus.MustRegister(ratelimit.Collectors()...)
 
 	redisClient := newRedisClient(cfg.RedisURL)
+	limiter := ratelimit.New(redisClient, cfg.RateFailMode)
 	hub := newHub()
 	httpClient := &http.Client{Timeout: 8 * time.Second}
 
 	// Start Redis Pub/Sub fanout subscriber for cross-gateway message delivery
 	if redisClient != nil {
-		go startFanoutSubscriber(hub, redisClient, cfg.GatewayID)
+		go startFanoutSubscriber(context.Background(), hub, redisClient, cfg.GatewayID)
 	}
 
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.Handler())
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		handleWS(w, r, cfg, hub, redisClient, httpClient)
-	})
-
 	server := &http.Server{
 		Addr:    cfg.Addr,
-		Handler: traceMiddleware(mux),
+		Handler: newHandler(cfg, hub, redisClient, limiter, httpClient),
 	}
 	log.Info().Str("addr", cfg.Addr).Msg("im-gateway listening")
 	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -202,11 +298,22 @@ func main() {
 	}
 }
 
+func newHandler(cfg Config, hub *Hub, rdb *redis.Client, limiter *ratelimit.Limiter, httpClient *http.Client) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		handleWS(w, r, cfg, hub, rdb, limiter, httpClient)
+	})
+	return traceMiddleware(mux)
+}
+
 // startFanoutSubscriber subscribes to Redis Pub/Sub channels for cross-gateway message fanout
-func startFanoutSubscriber(hub *Hub, rdb *redis.Client, selfGatewayID string) {
+func startFanoutSubscriber(ctx context.Context, hub *Hub, rdb *redis.Client, selfGatewayID string) {
 	for {
-		pubsub := rdb.PSubscribe(context.Background(), redisx.FanoutPattern())
+		pubsub := rdb.PSubscribe(ctx, redisx.FanoutPattern())
 		ch := pubsub.Channel()
+		// Closing pubsub on cancellation ends the range below.
+		stopOnCancel := context.AfterFunc(ctx, func() { _ = pubsub.Close() })
 		log.Info().Str("gateway_id", selfGatewayID).Msg("fanout subscriber started")
 		for msg := range ch {
 			// Extract threadID from channel name: "im:fanout:{threadID}"
@@ -216,8 +323,11 @@ func startFanoutSubscriber(hub *Hub, rdb *redis.Client, selfGatewayID string) {
 			}
 			// Parse payload to check origin gateway
 			var wrapper struct {
+				Type    string `json:"type"`
 				Payload struct {
-					OriginGW string `json:"_origin_gw"`
+					OriginGW    string `json:"_origin_gw"`
+					PublishedAt int64  `json:"_published_at_ms"`
+					CreatedAt   string `json:"created_at"`
 				} `json:"payload"`
 			}
 			if err := json.Unmarshal([]byte(msg.Payload), &wrapper); err == nil {
@@ -225,17 +335,55 @@ func startFanoutSubscriber(hub *Hub, rdb *redis.Client, selfGatewayID string) {
 					// Skip messages originating from this gateway instance
 					continue
 				}
+				if wrapper.Payload.PublishedAt > 0 {
+					fanoutReceiveLatency.Observe(float64(time.Now().UnixMilli() - wrapper.Payload.PublishedAt))
+				}
+				observeDeliveryLatency("remote", wrapper.Payload.CreatedAt)
+			}
+			if wrapper.Type == "members_changed" {
+				deliverMembersChanged(hub, threadID, []byte(msg.Payload))
+				continue
 			}
 			hub.broadcast(threadID, []byte(msg.Payload))
 		}
 		// Channel closed, reconnect after delay
+		stopOnCancel()
 		_ = pubsub.Close()
+		if ctx.Err() != nil {
+			return
+		}
 		log.Warn().Msg("fanout subscriber disconnected, reconnecting...")
 		time.Sleep(time.Second)
 	}
 }
 
+// deliverMembersChanged keeps local subscriptions in step with thread
+// membership: added users are subscribed before the frame goes out so they
+// see it (and the join notice after it), removed users only after.
+func deliverMembersChanged(hub *Hub, threadID string, payload []byte) {
+	var frame struct {
+		Payload struct {
+			Added []struct {
+				UserID string `json:"user_id"`
+			} `json:"added"`
+			Removed []string `json:"removed"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(payload, &frame); err != nil {
+		hub.broadcast(threadID, payload)
+		return
+	}
+	for _, m := range frame.Payload.Added {
+		hub.subscribeUser(m.UserID, threadID)
+	}
+	hub.broadcast(threadID, payload)
+	for _, userID := range frame.Payload.Removed {
+		hub.unsubscribeUser(userID, threadID)
+	}
+}
+
 func loadConfig() Config {
+	sendPolicy, sendPolicyByType := loadSendPolicies()
 	return Config{
 		Addr:            env("IM_WS_ADDR", ":8081"),
 		APIBaseURL:      strings.TrimRight(env("IM_API_BASE_URL", "http://localhost:8090"), "/"),
@@ -248,6 +396,10 @@ func loadConfig() Config {
 		RateUserWindowMs:  envInt("IM_RATE_USER_WINDOW_MS", 10000),
 		RateThreadMax:     envInt("IM_RATE_THREAD_MAX", 30),
 		RateThreadWindowMs: envInt("IM_RATE_THREAD_WINDOW_MS", 10000),
+		SendPolicy:         sendPolicy,
+		SendPolicyByType:   sendPolicyByType,
+		ConnMaxInflight:    envInt("IM_CONN_MAX_INFLIGHT", 8),
+		RateFailMode:       ratelimit.NormalizeFailMode(env("IM_RATE_FAIL_MODE", ratelimit.FailLocal)),
 	}
 }
 
@@ -283,27 +435,35 @@ func traceMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-func handleWS(w http.ResponseWriter, r *http.Request, cfg Config, hub *Hub, rdb *redis.Client, httpClient *http.Client) {
+func handleWS(w http.ResponseWriter, r *http.Request, cfg Config, hub *Hub, rdb *redis.Client, limiter *ratelimit.Limiter, httpClient *http.Client) {
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		wsErrors.Inc()
+		wsErrors.WithLabelValues("UPGRADE_FAILED").Inc()
 		return
 	}
 	trace := ctxValue(r.Context(), ctxTraceID)
+	connType, policy := resolveConnType(r, cfg)
 	c := &Conn{
 		ws:      conn,
 		traceID: trace,
 		headerToken: extractBearer(r.Header.Get("Authorization")),
-		send:    make(chan []byte, 16),
+		send:    newSendQueue(policy.QueueSize),
 		subs:    map[string]bool{},
+		connType: connType,
+		policy:   policy,
+		done:     make(chan struct{}),
 	}
 	hub.addConn(c)
 	wsConnections.Inc()
+	gatewayConnections.WithLabelValues(cfg.GatewayID, c.connType).Inc()
 	log.Info().Str("trace_id", trace).Msg("ws connected")
 	go writeLoop(c)
-	readLoop(c, cfg, hub, rdb, httpClient)
+	readLoop(c, cfg, hub, rdb, limiter, httpClient)
+	// Shut down before removal so in-flight lane jobs cannot re-subscribe c.
+	c.shutdown()
 	hub.removeConn(c)
 	wsConnections.Dec()
+	gatewayConnections.WithLabelValues(cfg.GatewayID, c.connType).Dec()
 	if c.userID != "" {
 		clearPresence(context.Background(), rdb, c.userID)
 	}
@@ -311,7 +471,7 @@ func handleWS(w http.ResponseWriter, r *http.Request, cfg Config, hub *Hub, rdb
 	log.Info().Str("trace_id", trace).Msg("ws closed")
 }
 
-func readLoop(c *Conn, cfg Config, hub *Hub, rdb *redis.Client, httpClient *http.Client) {
+func readLoop(c *Conn, cfg Config, hub *Hub, rdb *redis.Client, limiter *ratelimit.Limiter, httpClient *http.Client) {
 	stop := make(chan struct{})
 	go func() {
 		ticker := time.NewTicker(cfg.PresenceRefresh)
@@ -328,24 +488,35 @@ func readLoop(c *Conn, cfg Config, hub *Hub, rdb *redis.Client, httpClient *http
 		}
 	}()
 	defer close(stop)
+	pipe := newPipeline(cfg.ConnMaxInflight)
 	for {
 		_, data, err := c.ws.ReadMessage()
 		if err != nil {
 			return
 		}
-		wsInbound.Inc()
 		var msg inboundMsg
 		if err := json.Unmarshal(data, &msg); err != nil {
-			sendError(c, "INVALID_JSON", "invalid json")
+			wsInbound.WithLabelValues("invalid").Inc()
+			sendError(c, c.traceID, "INVALID_JSON", "invalid json")
 			continue
 		}
+		frameType := msg.Type
+		if !knownFrameTypes[frameType] {
+			frameType = "unknown"
+		}
+		wsInbound.WithLabelValues(frameType).Inc()
 		if msg.TraceID != "" {
 			c.traceID = msg.TraceID
 		}
+		// Frames that call im-api run on the thread's lane; everything read
+		// from c here is captured so lane jobs never touch mutable conn state.
+		trace := c.traceID
+		userID := c.userID
+		token := c.token
 		switch msg.Type {
 		case "auth":
-			if c.userID != "" {
-				sendError(c, "ALREADY_AUTH", "already authenticated")
+			if userID != "" {
+				sendError(c, trace, "ALREADY_AUTH", "already authenticated")
 				continue
 			}
 			token := extractBearer(msg.Token)
@@ -354,133 +525,181 @@ func readLoop(c *Conn, cfg Config, hub *Hub, rdb *redis.Client, httpClient *http
 			}
 			userID, err := verifyToken(token, cfg.AuthJWTSecret)
 			if err != nil {
-				sendError(c, "UNAUTHORIZED", "invalid token")
+				sendError(c, trace, "UNAUTHORIZED", "invalid token")
 				continue
 			}
 			c.token = token
 			hub.attachUser(c, userID)
 			refreshPresence(context.Background(), rdb, userID, cfg.GatewayID, cfg.PresenceTTL)
-			sendAuthOK(c, map[string]string{"user_id": userID})
+			sendAuthOK(c, trace, map[string]string{"user_id": userID})
 		case "sub":
-			if c.userID == "" {
-				sendError(c, "UNAUTHORIZED", "auth required")
+			if userID == "" {
+				sendError(c, trace, "UNAUTHORIZED", "auth required")
 				continue
 			}
 			if msg.ThreadID == "" {
-				sendError(c, "INVALID_REQUEST", "thread_id required")
-				continue
-			}
-			if !checkPermission(httpClient, cfg.APIBaseURL, c.token, msg.ThreadID) {
-				sendError(c, "FORBIDDEN", "not a member")
+				sendError(c, trace, "INVALID_REQUEST", "thread_id required")
 				continue
 			}
-			hub.subscribe(c, msg.ThreadID)
-			sendAck(c, map[string]any{"action": "sub", "thread_id": msg.ThreadID})
+			dispatchFrame(c, pipe, trace, msg, func() {
+				if !checkPermission(httpClient, cfg.APIBaseURL, token, msg.ThreadID) {
+					sendError(c, trace, "FORBIDDEN", "not a member")
+					return
+				}
+				hub.subscribe(c, msg.ThreadID)
+				sendAck(c, trace, map[string]any{"action": "sub", "thread_id": msg.ThreadID})
+			})
 		case "msg":
-			if c.userID == "" {
-				sendError(c, "UNAUTHORIZED", "auth required")
+			if userID == "" {
+				sendError(c, trace, "UNAUTHORIZED", "auth required")
 				continue
 			}
 			if msg.ThreadID == "" || msg.MsgType == "" {
-				sendError(c, "INVALID_REQUEST", "thread_id/msg_type required")
-				continue
-			}
-			if allowed, _, err := redisx.AllowRate(context.Background(), rdb, redisx.KeyRateUser(c.userID), cfg.RateUserWindowMs, cfg.RateUserMax); err == nil && !allowed {
-				sendError(c, "RATE_LIMITED", "user rate limited")
-				continue
-			}
-			if allowed, _, err := redisx.AllowRate(context.Background(), rdb, redisx.KeyRateThread(msg.ThreadID), cfg.RateThreadWindowMs, cfg.RateThreadMax); err == nil && !allowed {
-				sendError(c, "RATE_LIMITED", "thread rate limited")
+				sendError(c, trace, "INVALID_REQUEST", "thread_id/msg_type required")
 				continue
 			}
-			resp, err := createMessage(httpClient, cfg.APIBaseURL, c.token, msg.ThreadID, msg.ClientMsgID, msg.MsgType, msg.Content)
-			if err != nil {
-				sendError(c, "SEND_FAILED", err.Error())
-				continue
+			if msg.MsgType == msgcontent.TypeLocation {
+				if _, err := msgcontent.ParseLocation(msg.Content); err != nil {
+					sendError(c, trace, "INVALID_LOCATION_CONTENT", err.Error())
+					continue
+				}
 			}
-			sendAck(c, map[string]any{
-				"action":        "msg",
-				"thread_id":     msg.ThreadID,
-				"client_msg_id": msg.ClientMsgID,
-				"msg_id":        resp.MsgID,
-				"seq":           resp.Seq,
+			dispatchFrame(c, pipe, trace, msg, func() {
+				if !checkRate(c, trace, limiter, redisx.KeyRateUser(userID), cfg.RateUserWindowMs, cfg.RateUserMax, "user rate limited") {
+					return
+				}
+				if !checkRate(c, trace, limiter, redisx.KeyRateThread(msg.ThreadID), cfg.RateThreadWindowMs, cfg.RateThreadMax, "thread rate limited") {
+					return
+				}
+				resp, err := createMessage(httpClient, cfg.APIBaseURL, token, msg.ThreadID, msg.ClientMsgID, msg.MsgType, msg.Content, msg.ReplyToID)
+				if err != nil {
+					sendError(c, trace, "SEND_FAILED", err.Error())
+					return
+				}
+				sendAck(c, trace, map[string]any{
+					"action":        "msg",
+					"thread_id":     msg.ThreadID,
+					"client_msg_id": msg.ClientMsgID,
+					"msg_id":        resp.MsgID,
+					"seq":           resp.Seq,
+				})
+				out := map[string]any{
+					"thread_id":     msg.ThreadID,
+					"msg_id":        resp.MsgID,
+					"seq":           resp.Seq,
+					"created_at":    resp.CreatedAt,
+					"sender_id":     userID,
+					"msg_type":      msg.MsgType,
+					"content":       json.RawMessage(msg.Content),
+					"client_msg_id": msg.ClientMsgID,
+				}
+				if len(resp.ReplyTo) > 0 {
+					out["reply_to"] = resp.ReplyTo
+				}
+				if len(resp.Content) > 0 {
+					out["content"] = resp.Content
+				}
+				broadcast(hub, msg.ThreadID, trace, out, rdb, cfg.GatewayID)
 			})
-			out := map[string]any{
-				"thread_id":     msg.ThreadID,
-				"msg_id":        resp.MsgID,
-				"seq":           resp.Seq,
-				"created_at":    resp.CreatedAt,
-				"sender_id":     c.userID,
-				"msg_type":      msg.MsgType,
-				"content":       json.RawMessage(msg.Content),
-				"client_msg_id": msg.ClientMsgID,
-			}
-			broadcast(hub, msg.ThreadID, c.traceID, out, rdb, cfg.GatewayID)
 		case "read":
-			if c.userID == "" {
-				sendError(c, "UNAUTHORIZED", "auth required")
+			if userID == "" {
+				sendError(c, trace, "UNAUTHORIZED", "auth required")
 				continue
 			}
 			if msg.ThreadID == "" || msg.LastReadSeq <= 0 {
-				sendError(c, "INVALID_REQUEST", "thread_id/last_read_seq required")
+				sendError(c, trace, "INVALID_REQUEST", "thread_id/last_read_seq required")
 				continue
 			}
-			if err := updateRead(httpClient, cfg.APIBaseURL, c.token, msg.ThreadID, msg.LastReadSeq); err != nil {
-				sendError(c, "READ_FAILED", err.Error())
-				continue
-			}
-			sendAck(c, map[string]any{"action": "read", "thread_id": msg.ThreadID, "last_read_seq": msg.LastReadSeq})
+			dispatchFrame(c, pipe, trace, msg, func() {
+				if err := updateRead(httpClient, cfg.APIBaseURL, token, msg.ThreadID, msg.LastReadSeq); err != nil {
+					sendError(c, trace, "READ_FAILED", err.Error())
+					return
+				}
+				sendAck(c, trace, map[string]any{"action": "read", "thread_id": msg.ThreadID, "last_read_seq": msg.LastReadSeq})
+			})
 		case "ping":
-			if c.userID != "" {
-				refreshPresence(context.Background(), rdb, c.userID, cfg.GatewayID, cfg.PresenceTTL)
+			if userID != "" {
+				refreshPresence(context.Background(), rdb, userID, cfg.GatewayID, cfg.PresenceTTL)
 			}
-			sendAck(c, map[string]string{"action": "ping"})
+			sendAck(c, trace, map[string]string{"action": "ping"})
 		default:
-			sendError(c, "UNKNOWN_TYPE", "unsupported type")
+			sendError(c, trace, "UNKNOWN_TYPE", "unsupported type")
 		}
 	}
 }
 
+// checkRate applies a rate limit and reports the rejection to the client.
+func checkRate(c *Conn, trace string, limiter *ratelimit.Limiter, key string, windowMs, max int, limitedMsg string) bool {
+	allowed, _, err := limiter.Allow(context.Background(), key, windowMs, max)
+	if err != nil {
+		sendError(c, trace, "RATE_LIMIT_UNAVAILABLE", "rate limiter unavailable")
+		return false
+	}
+	if !allowed {
+		sendError(c, trace, "RATE_LIMITED", limitedMsg)
+		return false
+	}
+	return true
+}
+
 func writeLoop(c *Conn) {
-	for payload := range c.send {
-		_ = c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
-		if err := c.ws.WriteMessage(websocket.TextMessage, payload); err != nil {
+	// A failed write leaves the socket unusable; closing it ends readLoop too.
+	defer c.ws.Close()
+	for {
+		f, ok := c.send.pop()
+		if !ok {
+			select {
+			case <-c.send.ready:
+				continue
+			case <-c.done:
+				return
+			}
+		}
+		if gap := c.takeGap(); gap != nil {
+			if err := writeFrame(c, gap); err != nil {
+				return
+			}
+		}
+		if err := writeFrame(c, f.data); err != nil {
 			return
 		}
-		wsOutbound.Inc()
 	}
 }
 
-func sendAuthOK(c *Conn, payload interface{}) {
-	msg := outboundMsg{Type: "auth_ok", TraceID: c.traceID, Payload: payload}
+func writeFrame(c *Conn, payload []byte) error {
+	_ = c.ws.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if err := c.ws.WriteMessage(websocket.TextMessage, payload); err != nil {
+		return err
+	}
+	wsOutbound.Inc()
+	return nil
+}
+
+func sendAuthOK(c *Conn, trace string, payload interface{}) {
+	msg := outboundMsg{Type: "auth_ok", TraceID: trace, Payload: payload}
 	sendJSON(c, msg)
 }
 
-func sendAck(c *Conn, payload interface{}) {
-	msg := outboundMsg{Type: "ack", TraceID: c.traceID, Payload: payload}
+func sendAck(c *Conn, trace string, payload interface{}) {
+	msg := outboundMsg{Type: "ack", TraceID: trace, Payload: payload}
 	sendJSON(c, msg)
 }
 
-func sendError(c *Conn, code, message string) {
-	wsErrors.Inc()
-	msg := outboundMsg{Type: "error", TraceID: c.traceID, Code: code, Message: message}
+func sendError(c *Conn, trace, code, message string) {
+	wsErrors.WithLabelValues(code).Inc()
+	msg := outboundMsg{Type: "error", TraceID: trace, Code: code, Message: message}
 	sendJSON(c, msg)
 }
 
 func sendJSON(c *Conn, msg outboundMsg) {
 	data, _ := json.Marshal(msg)
-	select {
-	case c.send <- data:
-	default:
-		wsErrors.Inc()
-		_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "slow consumer"), time.Now().Add(2*time.Second))
-		_ = c.ws.Close()
-	}
+	c.enqueue(outFrame{data: data})
 }
 
 func broadcast(hub *Hub, threadID, trace string, payload map[string]any, rdb *redis.Client, originGatewayID string) {
 	// Add origin gateway marker for self-echo filtering
 	payload["_origin_gw"] = originGatewayID
+	payload["_published_at_ms"] = time.Now().UnixMilli()
 	msg := outboundMsg{
 		Type:    "msg",
 		TraceID: trace,
@@ -490,8 +709,11 @@ func broadcast(hub *Hub, threadID, trace string, payload map[string]any, rdb *re
 	// Publish to Redis for cross-gateway fanout
 	if rdb != nil {
 		channelKey := redisx.KeyFanout(threadID)
+		start := time.Now()
 		if err := rdb.Publish(context.Background(), channelKey, string(data)).Err(); err != nil {
 			log.Warn().Err(err).Str("thread_id", threadID).Msg("fanout publish failed, falling back to local broadcast")
+		} else {
+			fanoutPublishLatency.Observe(float64(time.Since(start).Milliseconds()))
 		}
 		// Always broadcast locally for same-instance subscribers
 		// Subscriber's self-origin filter prevents duplicate from Redis echo
@@ -500,6 +722,22 @@ func broadcast(hub *Hub, threadID, trace string, payload map[string]any, rdb *re
 		// No Redis, local broadcast only
 		hub.broadcast(threadID, data)
 	}
+	if createdAt, ok := payload["created_at"].(string); ok {
+		observeDeliveryLatency("local", createdAt)
+	}
+}
+
+// observeDeliveryLatency records end-to-end latency from the message's
+// created_at (as returned by im-api) to local hand-off.
+func observeDeliveryLatency(path, createdAt string) {
+	if createdAt == "" {
+		return
+	}
+	ts, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return
+	}
+	fanoutDeliveryLatency.WithLabelValues(path).Observe(float64(time.Since(ts).Milliseconds()))
 }
 
 func extractBearer(raw string) string {
@@ -575,9 +813,14 @@ type createMsgResp struct {
 	MsgID     string `json:"msg_id"`
 	Seq       int64  `json:"seq"`
 	CreatedAt string `json:"created_at"`
+	// ReplyTo is the quoted message rendered by im-api, passed through as-is.
+	ReplyTo json.RawMessage `json:"reply_to,omitempty"`
+	// Content is the stored content as im-api renders it (media with signed
+	// URLs); fanout prefers it over what the client sent.
+	Content json.RawMessage `json:"content,omitempty"`
 }
 
-func createMessage(client *http.Client, baseURL, token, threadID, clientMsgID, msgType string, content json.RawMessage) (*createMsgResp, error) {
+func createMessage(client *http.Client, baseURL, token, threadID, clientMsgID, msgType string, content json.RawMessage, replyToID string) (*createMsgResp, error) {
 	if clientMsgID == "" {
 		clientMsgID = randomID("client")
 	}
@@ -587,7 +830,10 @@ func createMessage(client *http.Client, baseURL, token, threadID, clientMsgID, m
 		"type":          msgType,
 		"content":       json.RawMessage(content),
 	}
-	raw, err := doAPI(client, baseURL, token, http.MethodPost, "/v1/messages", body)
+	if replyToID != "" {
+		body["reply_to_msg_id"] = replyToID
+	}
+	raw, err := doAPI(client, baseURL, token, "create_message", http.MethodPost, "/v1/messages", body)
 	if err != nil {
 		return nil, err
 	}
@@ -600,16 +846,17 @@ func createMessage(client *http.Client, baseURL, token, threadID, clientMsgID, m
 
 func updateRead(client *http.Client, baseURL, token, threadID string, seq int64) error {
 	body := map[string]any{"last_read_seq": seq}
-	_, err := doAPI(client, baseURL, token, http.MethodPost, fmt.Sprintf("/v1/threads/%s/read", threadID), body)
+	_, err := doAPI(client, baseURL, token, "update_read", http.MethodPost, fmt.Sprintf("/v1/threads/%s/read", threadID), body)
 	return err
 }
 
 func checkPermission(client *http.Client, baseURL, token, threadID string) bool {
-	_, err := doAPI(client, baseURL, token, http.MethodGet, fmt.Sprintf("/v1/threads/%s/permission", threadID), nil)
+	_, err := doAPI(client, baseURL, token, "check_permission", http.MethodGet, fmt.Sprintf("/v1/threads/%s/permission", threadID), nil)
 	return err == nil
 }
 
-func doAPI(client *http.Client, baseURL, token, method, path string, body interface{}) (json.RawMessage, error) {
+// doAPI calls im-api; endpoint is a fixed name used as the latency metric label.
+func doAPI(client *http.Client, baseURL, token, endpoint, method, path string, body interface{}) (json.RawMessage, error) {
 	var buf bytes.Buffer
 	if body != nil {
 		if err := json.NewEncoder(&buf).Encode(body); err != nil {
@@ -622,11 +869,14 @@ func doAPI(client *http.Client, baseURL, token, method, path string, body interf
 	}
 	req.Header.Set("Authorization", "Bearer "+token)
 	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
 	resp, err := client.Do(req)
 	if err != nil {
+		upstreamLatency.WithLabelValues(endpoint, "error").Observe(float64(time.Since(start).Milliseconds()))
 		return nil, err
 	}
 	defer resp.Body.Close()
+	upstreamLatency.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Observe(float64(time.Since(start).Milliseconds()))
 	var parsed apiResponse
 	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
 		return nil, err
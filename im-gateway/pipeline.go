@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var wsInflight = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ws_inflight_frames",
+	Help: "Inbound frames queued or being processed across all connections",
+})
+
+// pipeline runs a connection's im-api bound frames concurrently while keeping
+// them ordered per thread: each thread gets a lane that executes its jobs one
+// at a time, and a lane exits once it has drained. slots caps the number of
+// frames queued or running across all lanes.
+type pipeline struct {
+	slots chan struct{}
+	mu    sync.Mutex
+	lanes map[string]chan func()
+}
+
+func newPipeline(limit int) *pipeline {
+	if limit <= 0 {
+		limit = 1
+	}
+	return &pipeline{
+		slots: make(chan struct{}, limit),
+		lanes: map[string]chan func(){},
+	}
+}
+
+// submit queues job on the lane for key. It returns false without queueing
+// when the connection is already at its in-flight limit.
+func (p *pipeline) submit(key string, job func()) bool {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return false
+	}
+	wsInflight.Inc()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	lane, ok := p.lanes[key]
+	if !ok {
+		// Capacity matches slots, so this send can never block.
+		lane = make(chan func(), cap(p.slots))
+		p.lanes[key] = lane
+		go p.run(key, lane)
+	}
+	lane <- job
+	return true
+}
+
+func (p *pipeline) run(key string, lane chan func()) {
+	for {
+		job := <-lane
+		job()
+		<-p.slots
+		wsInflight.Dec()
+		p.mu.Lock()
+		if len(lane) == 0 {
+			delete(p.lanes, key)
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+	}
+}
+
+// dispatchFrame submits job on the frame's thread lane, or tells the client to
+// back off when the connection has too many frames in flight.
+func dispatchFrame(c *Conn, p *pipeline, trace string, msg inboundMsg, job func()) {
+	if p.submit(msg.ThreadID, job) {
+		return
+	}
+	wsErrors.WithLabelValues("BACKPRESSURE").Inc()
+	sendJSON(c, outboundMsg{
+		Type:    "error",
+		TraceID: trace,
+		Code:    "BACKPRESSURE",
+		Message: "too many in-flight requests",
+		Payload: map[string]any{
+			"action":        msg.Type,
+			"thread_id":     msg.ThreadID,
+			"client_msg_id": msg.ClientMsgID,
+			"limit":         cap(p.slots),
+		},
+	})
+}
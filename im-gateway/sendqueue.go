@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Slow-consumer policies, applied when a connection's send queue is full.
+const (
+	policyDropOldest = "drop_oldest"
+	policyBlock      = "block"
+	policyDisconnect = "disconnect"
+
+	defaultConnType = "default"
+)
+
+var (
+	sendQueueDepth = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ws_send_queue_depth",
+		Help:    "Send queue depth observed when a frame is enqueued",
+		Buckets: []float64{0, 1, 2, 4, 8, 16, 32, 64, 128, 256},
+	}, []string{"conn_type"})
+	sendQueueDrops = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_send_drops_total",
+		Help: "Outbound frames dropped because of a slow consumer",
+	}, []string{"conn_type", "reason"})
+)
+
+type sendPolicy struct {
+	Mode         string
+	QueueSize    int
+	BlockTimeout time.Duration
+}
+
+type outFrame struct {
+	data     []byte
+	threadID string
+}
+
+// sendQueue is a connection's bounded outbound queue. Every push, eviction
+// and pop happens under mu, so a frame never overtakes an earlier one of the
+// same thread; ready and space are wake-ups for the writer and for blocked
+// senders, and never hold frames themselves.
+type sendQueue struct {
+	mu     sync.Mutex
+	frames []outFrame
+	size   int
+	ready  chan struct{}
+	space  chan struct{}
+}
+
+func newSendQueue(size int) *sendQueue {
+	return &sendQueue{size: size, ready: make(chan struct{}, 1), space: make(chan struct{}, 1)}
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.frames)
+}
+
+// push appends f if the queue has room.
+func (q *sendQueue) push(f outFrame) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) >= q.size {
+		return false
+	}
+	q.frames = append(q.frames, f)
+	notify(q.ready)
+	if len(q.frames) < q.size {
+		notify(q.space)
+	}
+	return true
+}
+
+// pushEvicting appends f, making room on a full queue by removing the oldest
+// thread frame, which it returns. It fails only when every queued frame is a
+// direct reply.
+func (q *sendQueue) pushEvicting(f outFrame) (evicted *outFrame, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) >= q.size {
+		i := 0
+		for i < len(q.frames) && q.frames[i].threadID == "" {
+			i++
+		}
+		if i == len(q.frames) {
+			return nil, false
+		}
+		old := q.frames[i]
+		evicted = &old
+		q.frames = append(q.frames[:i], q.frames[i+1:]...)
+	}
+	q.frames = append(q.frames, f)
+	notify(q.ready)
+	return evicted, true
+}
+
+// pop removes the oldest frame.
+func (q *sendQueue) pop() (outFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.frames) == 0 {
+		return outFrame{}, false
+	}
+	f := q.frames[0]
+	q.frames[0] = outFrame{}
+	q.frames = q.frames[1:]
+	notify(q.space)
+	return f, true
+}
+
+func loadSendPolicies() (sendPolicy, map[string]sendPolicy) {
+	base := sendPolicy{
+		Mode:         normalizePolicyMode(env("IM_SLOW_CONSUMER_POLICY", policyDropOldest)),
+		QueueSize:    envInt("IM_SEND_QUEUE_SIZE", 16),
+		BlockTimeout: time.Duration(envInt("IM_SEND_BLOCK_TIMEOUT_MS", 2000)) * time.Millisecond,
+	}
+	if base.QueueSize <= 0 {
+		base.QueueSize = 16
+	}
+	byType := map[string]sendPolicy{}
+	for connType, mode := range parseKVList(env("IM_SLOW_CONSUMER_POLICY_BY_TYPE", "")) {
+		p := byType[connType]
+		if p.Mode == "" {
+			p = base
+		}
+		p.Mode = normalizePolicyMode(mode)
+		byType[connType] = p
+	}
+	for connType, raw := range parseKVList(env("IM_SEND_QUEUE_SIZE_BY_TYPE", "")) {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size <= 0 {
+			continue
+		}
+		p := byType[connType]
+		if p.Mode == "" {
+			p = base
+		}
+		p.QueueSize = size
+		byType[connType] = p
+	}
+	return base, byType
+}
+
+func normalizePolicyMode(mode string) string {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case policyBlock:
+		return policyBlock
+	case policyDisconnect:
+		return policyDisconnect
+	default:
+		return policyDropOldest
+	}
+}
+
+// parseKVList parses "a=1,b=2" into a map with lower-cased keys.
+func parseKVList(raw string) map[string]string {
+	out := map[string]string{}
+	for _, part := range strings.Split(raw, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		val := strings.TrimSpace(kv[1])
+		if key == "" || val == "" {
+			continue
+		}
+		out[key] = val
+	}
+	return out
+}
+
+// resolveConnType maps the client-declared connection type onto a configured
+// one so that metric label cardinality stays bounded.
+func resolveConnType(r *http.Request, cfg Config) (string, sendPolicy) {
+	declared := r.URL.Query().Get("client_type")
+	if declared == "" {
+		declared = r.Header.Get("X-Client-Type")
+	}
+	declared = strings.ToLower(strings.TrimSpace(declared))
+	if p, ok := cfg.SendPolicyByType[declared]; ok {
+		return declared, p
+	}
+	return defaultConnType, cfg.SendPolicy
+}
+
+// enqueue hands a frame to the connection's writer, applying the slow-consumer
+// policy when the queue is full. It reports whether the frame was queued.
+// Thread frames (threadID set) come from Hub.broadcast, which serves every
+// subscriber from one goroutine, so they never wait: under the block policy
+// they fall back to drop_oldest. Only direct replies (ack/error) block.
+func (c *Conn) enqueue(f outFrame) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+	sendQueueDepth.WithLabelValues(c.connType).Observe(float64(c.send.len()))
+	if c.send.push(f) {
+		return true
+	}
+	switch c.policy.Mode {
+	case policyDropOldest:
+		return c.enqueueDropOldest(f)
+	case policyBlock:
+		if f.threadID != "" {
+			return c.enqueueDropOldest(f)
+		}
+		timer := time.NewTimer(c.policy.BlockTimeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-c.send.space:
+				if c.send.push(f) {
+					return true
+				}
+			case <-c.done:
+				return false
+			case <-timer.C:
+				sendQueueDrops.WithLabelValues(c.connType, "block_timeout").Inc()
+				c.closeSlow()
+				return false
+			}
+		}
+	default:
+		sendQueueDrops.WithLabelValues(c.connType, "disconnect").Inc()
+		c.closeSlow()
+		return false
+	}
+}
+
+// enqueueDropOldest makes room by evicting the oldest queued thread frame;
+// ack/error frames are never dropped because the client could not tell
+// which request lost its reply. If only direct frames are queued, a new
+// thread frame is dropped instead (and reported in the gap notice), and a new
+// direct frame disconnects the client.
+func (c *Conn) enqueueDropOldest(f outFrame) bool {
+	evicted, ok := c.send.pushEvicting(f)
+	if evicted != nil {
+		c.recordGap(*evicted)
+		sendQueueDrops.WithLabelValues(c.connType, "drop_oldest").Inc()
+	}
+	if ok {
+		return true
+	}
+	if f.threadID != "" {
+		c.recordGap(f)
+		sendQueueDrops.WithLabelValues(c.connType, "drop_oldest").Inc()
+		return false
+	}
+	sendQueueDrops.WithLabelValues(c.connType, "disconnect").Inc()
+	c.closeSlow()
+	return false
+}
+
+func (c *Conn) recordGap(f outFrame) {
+	c.gapMu.Lock()
+	defer c.gapMu.Unlock()
+	c.gapDropped++
+	if f.threadID != "" {
+		if c.gapThreads == nil {
+			c.gapThreads = map[string]bool{}
+		}
+		c.gapThreads[f.threadID] = true
+	}
+}
+
+// takeGap returns a pending gap notice, if frames were dropped since the last
+// one, so the client knows which threads to re-sync via afterSeq.
+func (c *Conn) takeGap() []byte {
+	c.gapMu.Lock()
+	defer c.gapMu.Unlock()
+	if c.gapDropped == 0 {
+		return nil
+	}
+	threadIDs := make([]string, 0, len(c.gapThreads))
+	for id := range c.gapThreads {
+		threadIDs = append(threadIDs, id)
+	}
+	sort.Strings(threadIDs)
+	data, _ := json.Marshal(outboundMsg{
+		Type: "gap",
+		Payload: map[string]any{
+			"dropped":    c.gapDropped,
+			"thread_ids": threadIDs,
+		},
+	})
+	c.gapDropped = 0
+	c.gapThreads = nil
+	return data
+}
+
+func (c *Conn) closeSlow() {
+	_ = c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "slow consumer"), time.Now().Add(2*time.Second))
+	_ = c.ws.Close()
+}
+
+func (c *Conn) shutdown() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
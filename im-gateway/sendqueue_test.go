@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsPair returns the server and client ends of a websocket connection.
+func wsPair(t *testing.T) (*websocket.Conn, *websocket.Conn) {
+	t.Helper()
+	serverSide := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serverSide <- conn
+	}))
+	t.Cleanup(srv.Close)
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	server := <-serverSide
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return server, client
+}
+
+func newTestConn(t *testing.T, policy sendPolicy) (*Conn, *wsClient) {
+	t.Helper()
+	server, client := wsPair(t)
+	c := &Conn{
+		ws:       server,
+		send:     newSendQueue(policy.QueueSize),
+		subs:     map[string]bool{},
+		connType: defaultConnType,
+		policy:   policy,
+		done:     make(chan struct{}),
+	}
+	t.Cleanup(c.shutdown)
+	return c, &wsClient{t: t, conn: client}
+}
+
+func testFrame(threadID, body string) outFrame {
+	return outFrame{data: []byte(`{"type":"msg","payload":{"body":"` + body + `"}}`), threadID: threadID}
+}
+
+func expectSlowConsumerClose(t *testing.T, client *wsClient) {
+	t.Helper()
+	_ = client.conn.SetReadDeadline(time.Now().Add(frameTimeout))
+	_, _, err := client.conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Text != "slow consumer" {
+		t.Fatalf("expected slow consumer close, got %v", err)
+	}
+}
+
+func TestDropOldestEmitsGap(t *testing.T) {
+	c, client := newTestConn(t, sendPolicy{Mode: policyDropOldest, QueueSize: 2})
+	threads := []string{"t-b", "t-a", "t-b", "t-c", "t-d"}
+	for i, threadID := range threads {
+		if !c.enqueue(testFrame(threadID, string(rune('1'+i)))) {
+			t.Fatalf("enqueue %d rejected", i)
+		}
+	}
+	go writeLoop(c)
+
+	gap := client.expect("gap")
+	if payloadInt(gap, "dropped") != 3 {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+	ids, _ := gap.Payload["thread_ids"].([]any)
+	if len(ids) != 2 || ids[0] != "t-a" || ids[1] != "t-b" {
+		t.Fatalf("unexpected gap thread_ids: %v", ids)
+	}
+	for _, want := range []string{"4", "5"} {
+		if f := client.expect("msg"); f.Payload["body"] != want {
+			t.Fatalf("expected frame %s, got %+v", want, f)
+		}
+	}
+}
+
+func TestDisconnectPolicyClosesSocket(t *testing.T) {
+	c, client := newTestConn(t, sendPolicy{Mode: policyDisconnect, QueueSize: 1})
+	if !c.enqueue(testFrame("t1", "1")) {
+		t.Fatal("first enqueue rejected")
+	}
+	if c.enqueue(testFrame("t1", "2")) {
+		t.Fatal("enqueue on full queue accepted")
+	}
+	expectSlowConsumerClose(t, client)
+}
+
+// Only direct replies block; see TestBlockPolicyNeverBlocksFanout.
+func TestBlockPolicyWaitsThenDisconnects(t *testing.T) {
+	c, client := newTestConn(t, sendPolicy{Mode: policyBlock, QueueSize: 1, BlockTimeout: time.Second})
+	direct := outFrame{data: []byte(`{"type":"ack"}`)}
+	c.enqueue(direct)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.send.pop()
+	}()
+	if !c.enqueue(direct) {
+		t.Fatal("enqueue did not wait for space")
+	}
+
+	c.policy.BlockTimeout = 20 * time.Millisecond
+	if c.enqueue(direct) {
+		t.Fatal("enqueue succeeded without a reader")
+	}
+	expectSlowConsumerClose(t, client)
+}
+
+func TestEnqueueAfterShutdown(t *testing.T) {
+	c, _ := newTestConn(t, sendPolicy{Mode: policyBlock, QueueSize: 1, BlockTimeout: time.Minute})
+	c.enqueue(testFrame("t1", "1"))
+	c.shutdown()
+	if c.enqueue(testFrame("t1", "2")) {
+		t.Fatal("enqueue accepted after shutdown")
+	}
+}
+
+func TestDropOldestKeepsDirectFrames(t *testing.T) {
+	c, client := newTestConn(t, sendPolicy{Mode: policyDropOldest, QueueSize: 2})
+	ack := outFrame{data: []byte(`{"type":"ack","payload":{"action":"ping"}}`)}
+	c.enqueue(ack)
+	c.enqueue(testFrame("t1", "1"))
+	if !c.enqueue(testFrame("t2", "2")) {
+		t.Fatal("thread frame rejected while a thread frame could be evicted")
+	}
+	go writeLoop(c)
+
+	gap := client.expect("gap")
+	if ids, _ := gap.Payload["thread_ids"].([]any); len(ids) != 1 || ids[0] != "t1" {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+	client.expect("ack")
+	if f := client.expect("msg"); f.Payload["body"] != "2" {
+		t.Fatalf("unexpected frame: %+v", f)
+	}
+}
+
+func TestDropOldestQueueOfAcks(t *testing.T) {
+	c, _ := newTestConn(t, sendPolicy{Mode: policyDropOldest, QueueSize: 1})
+	c.enqueue(outFrame{data: []byte(`{"type":"ack"}`)})
+	if c.enqueue(testFrame("t1", "1")) {
+		t.Fatal("thread frame should be dropped rather than the ack")
+	}
+	if n := c.send.len(); n != 1 {
+		t.Fatalf("queue = %d frames, want the ack kept", n)
+	}
+}
+
+func TestBlockPolicyNeverBlocksFanout(t *testing.T) {
+	c, client := newTestConn(t, sendPolicy{Mode: policyBlock, QueueSize: 1, BlockTimeout: time.Minute})
+	c.enqueue(testFrame("t1", "1"))
+	start := time.Now()
+	if !c.enqueue(testFrame("t1", "2")) {
+		t.Fatal("fanout frame rejected")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("fanout frame waited for the block timeout")
+	}
+	go writeLoop(c)
+	if gap := client.expect("gap"); payloadInt(gap, "dropped") != 1 {
+		t.Fatalf("unexpected gap: %+v", gap)
+	}
+}
+
+// Run with -race: concurrent fanout and replies against a reader must never
+// reorder a thread's frames, whatever gets evicted.
+func TestConcurrentEnqueueKeepsThreadOrder(t *testing.T) {
+	c, _ := newTestConn(t, sendPolicy{Mode: policyDropOldest, QueueSize: 4})
+	const (
+		threads = 4
+		frames  = 2000
+	)
+	var producers sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		producers.Add(1)
+		go func(threadID string) {
+			defer producers.Done()
+			for n := 1; n <= frames; n++ {
+				c.enqueue(outFrame{data: []byte(strconv.Itoa(n)), threadID: threadID})
+			}
+		}("t" + strconv.Itoa(i))
+	}
+	stop := make(chan struct{})
+	go func() {
+		producers.Wait()
+		close(stop)
+	}()
+
+	last := map[string]int{}
+	received := 0
+	for {
+		f, ok := c.send.pop()
+		if !ok {
+			select {
+			case <-stop:
+				if c.send.len() == 0 {
+					if received == 0 {
+						t.Fatal("no frames delivered")
+					}
+					return
+				}
+			case <-c.send.ready:
+			}
+			continue
+		}
+		n, _ := strconv.Atoi(string(f.data))
+		if n <= last[f.threadID] {
+			t.Fatalf("thread %s: frame %d after %d", f.threadID, n, last[f.threadID])
+		}
+		last[f.threadID] = n
+		received++
+	}
+}
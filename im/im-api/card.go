@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Card message types reference an entity in the main database. The client
+// sends only {"ref_id": ...}; im-api checks that the sender may share it and
+// stores a snapshot, so the card renders the same for every member and
+// survives later changes to the entity.
+const (
+	msgTypeExperienceCard = "experience_card"
+	msgTypeOrderCard      = "order_card"
+	msgTypeTripCard       = "trip_card"
+
+	cardSummaryMaxRunes = 120
+)
+
+var (
+	errCardNotFound     = errors.New("card entity not found")
+	errCardForbidden    = errors.New("sender cannot share this entity")
+	errCardsUnavailable = errors.New("card lookup not configured")
+	errCardRefRequired  = errors.New("ref_id required")
+)
+
+func isCardType(msgType string) bool {
+	switch msgType {
+	case msgTypeExperienceCard, msgTypeOrderCard, msgTypeTripCard:
+		return true
+	default:
+		return false
+	}
+}
+
+// cardContent is the stored content of a card message.
+type cardContent struct {
+	RefID      string          `json:"ref_id"`
+	Snapshot   json.RawMessage `json:"snapshot"`
+	SnapshotAt time.Time       `json:"snapshot_at"`
+}
+
+type experienceSnapshot struct {
+	ID              string  `json:"id"`
+	Title           string  `json:"title"`
+	Summary         string  `json:"summary"`
+	City            string  `json:"city"`
+	CoverImageURL   string  `json:"cover_image_url"`
+	PricePerGuest   int     `json:"price_per_guest"`
+	Currency        string  `json:"currency"`
+	DurationMinutes int     `json:"duration_minutes"`
+	Rating          float64 `json:"rating"`
+	ReviewCount     int     `json:"review_count"`
+	HostUserID      string  `json:"host_user_id"`
+	HostName        string  `json:"host_name"`
+}
+
+type orderSnapshot struct {
+	ID              string    `json:"id"`
+	OrderNo         string    `json:"order_no"`
+	ExperienceID    string    `json:"experience_id"`
+	ExperienceTitle string    `json:"experience_title"`
+	ExperienceCover string    `json:"experience_cover"`
+	City            string    `json:"city"`
+	StartTime       time.Time `json:"start_time"`
+	PeopleCount     int       `json:"people_count"`
+	Status          string    `json:"status"`
+	PaymentStatus   string    `json:"payment_status"`
+	TotalAmount     string    `json:"total_amount"`
+	Currency        string    `json:"currency"`
+	TravelerID      string    `json:"traveler_id"`
+	HostID          string    `json:"host_id"`
+}
+
+type tripSnapshot struct {
+	ID                 string `json:"id"`
+	ProfileID          string `json:"profile_id"`
+	DestinationCity    string `json:"destination_city"`
+	DestinationCountry string `json:"destination_country,omitempty"`
+	StartDate          string `json:"start_date"`
+	EndDate            string `json:"end_date"`
+}
+
+// resolveCardContent validates a card reference, checks that senderID may
+// share the entity and returns the content to store. mainDB is nil when
+// IM_MAIN_DB_DSN is not configured.
+func resolveCardContent(ctx context.Context, mainDB *pgxpool.Pool, msgType, senderID string, raw json.RawMessage) (json.RawMessage, error) {
+	var ref struct {
+		RefID json.RawMessage `json:"ref_id"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &ref) != nil || len(ref.RefID) == 0 {
+		return nil, errCardRefRequired
+	}
+	// accept numeric ids (orders) as well as strings
+	refID := strings.Trim(strings.TrimSpace(string(ref.RefID)), `"`)
+	if refID == "" || refID == "null" {
+		return nil, errCardRefRequired
+	}
+	if mainDB == nil {
+		return nil, errCardsUnavailable
+	}
+	var (
+		snapshot any
+		err      error
+	)
+	switch msgType {
+	case msgTypeExperienceCard:
+		snapshot, err = loadExperienceSnapshot(ctx, mainDB, refID)
+	case msgTypeOrderCard:
+		snapshot, err = loadOrderSnapshot(ctx, mainDB, refID, senderID)
+	case msgTypeTripCard:
+		snapshot, err = loadTripSnapshot(ctx, mainDB, refID, senderID)
+	default:
+		return nil, errors.New("not a card type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cardContent{RefID: refID, Snapshot: encoded, SnapshotAt: time.Now().UTC()})
+}
+
+// loadExperienceSnapshot: any published experience can be shared.
+func loadExperienceSnapshot(ctx context.Context, mainDB *pgxpool.Pool, refID string) (*experienceSnapshot, error) {
+	if !isUUID(refID) {
+		return nil, errCardNotFound
+	}
+	var (
+		s      experienceSnapshot
+		status string
+	)
+	err := mainDB.QueryRow(ctx, `
+		select id::text, title, summary, city, cover_image_url, price_per_guest, currency,
+		       duration_minutes, rating, review_count, host_user_id, host_name, status
+		from experiences
+		where id = $1`,
+		refID,
+	).Scan(&s.ID, &s.Title, &s.Summary, &s.City, &s.CoverImageURL, &s.PricePerGuest, &s.Currency,
+		&s.DurationMinutes, &s.Rating, &s.ReviewCount, &s.HostUserID, &s.HostName, &status)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != "published" {
+		return nil, errCardForbidden
+	}
+	s.Summary = truncateRunes(s.Summary, cardSummaryMaxRunes)
+	return &s, nil
+}
+
+// loadOrderSnapshot: only the order's traveler or host can share it.
+func loadOrderSnapshot(ctx context.Context, mainDB *pgxpool.Pool, refID, senderID string) (*orderSnapshot, error) {
+	id, err := strconv.ParseInt(refID, 10, 64)
+	if err != nil || id <= 0 {
+		return nil, errCardNotFound
+	}
+	var s orderSnapshot
+	err = mainDB.QueryRow(ctx, `
+		select id::text, order_no, experience_id, coalesce(experience_title, ''), coalesce(experience_cover, ''),
+		       coalesce(city, ''), start_time, people_count, status::text, payment_status::text,
+		       total_amount::text, currency, traveler_id::text, host_id::text
+		from orders
+		where id = $1`,
+		id,
+	).Scan(&s.ID, &s.OrderNo, &s.ExperienceID, &s.ExperienceTitle, &s.ExperienceCover,
+		&s.City, &s.StartTime, &s.PeopleCount, &s.Status, &s.PaymentStatus,
+		&s.TotalAmount, &s.Currency, &s.TravelerID, &s.HostID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if senderID != s.TravelerID && senderID != s.HostID {
+		return nil, errCardForbidden
+	}
+	return &s, nil
+}
+
+// loadTripSnapshot: trip cards are personal; only their owner shares them.
+func loadTripSnapshot(ctx context.Context, mainDB *pgxpool.Pool, refID, senderID string) (*tripSnapshot, error) {
+	if !isUUID(refID) {
+		return nil, errCardNotFound
+	}
+	var (
+		s                  tripSnapshot
+		country            *string
+		startDate, endDate time.Time
+	)
+	err := mainDB.QueryRow(ctx, `
+		select id::text, profile_id::text, destination_city, destination_country, start_date, end_date
+		from trip_cards
+		where id = $1`,
+		refID,
+	).Scan(&s.ID, &s.ProfileID, &s.DestinationCity, &country, &startDate, &endDate)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errCardNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.ProfileID != senderID {
+		return nil, errCardForbidden
+	}
+	if country != nil {
+		s.DestinationCountry = *country
+	}
+	s.StartDate = startDate.Format(time.DateOnly)
+	s.EndDate = endDate.Format(time.DateOnly)
+	return &s, nil
+}
+
+// cardPreview renders the push / thread-list preview of a card message.
+func cardPreview(msgType string, content json.RawMessage) string {
+	var card cardContent
+	_ = json.Unmarshal(content, &card)
+	switch msgType {
+	case msgTypeExperienceCard:
+		var s experienceSnapshot
+		if json.Unmarshal(card.Snapshot, &s) == nil && s.Title != "" {
+			return "[体验] " + s.Title
+		}
+		return "[体验]"
+	case msgTypeOrderCard:
+		var s orderSnapshot
+		if json.Unmarshal(card.Snapshot, &s) == nil {
+			switch {
+			case s.ExperienceTitle != "":
+				return "[订单] " + s.ExperienceTitle
+			case s.OrderNo != "":
+				return "[订单] " + s.OrderNo
+			}
+		}
+		return "[订单]"
+	case msgTypeTripCard:
+		var s tripSnapshot
+		if json.Unmarshal(card.Snapshot, &s) == nil && s.DestinationCity != "" {
+			return fmt.Sprintf("[行程] %s %s~%s", s.DestinationCity, s.StartDate, s.EndDate)
+		}
+		return "[行程]"
+	}
+	return ""
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n]) + "…"
+}
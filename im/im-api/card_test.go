@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCardPreview(t *testing.T) {
+	card := func(snapshot any) json.RawMessage {
+		s, _ := json.Marshal(snapshot)
+		raw, _ := json.Marshal(cardContent{RefID: "x", Snapshot: s, SnapshotAt: time.Now()})
+		return raw
+	}
+	cases := []struct {
+		msgType string
+		content json.RawMessage
+		want    string
+	}{
+		{msgTypeExperienceCard, card(experienceSnapshot{Title: "外滩夜游"}), "[体验] 外滩夜游"},
+		{msgTypeOrderCard, card(orderSnapshot{OrderNo: "TV001", ExperienceTitle: "外滩夜游"}), "[订单] 外滩夜游"},
+		{msgTypeOrderCard, card(orderSnapshot{OrderNo: "TV001"}), "[订单] TV001"},
+		{msgTypeTripCard, card(tripSnapshot{DestinationCity: "上海", StartDate: "2026-05-01", EndDate: "2026-05-04"}), "[行程] 上海 2026-05-01~2026-05-04"},
+		{msgTypeTripCard, json.RawMessage(`{}`), "[行程]"},
+	}
+	for _, tc := range cases {
+		if got := buildPushPreview(tc.msgType, tc.content); got != tc.want {
+			t.Errorf("buildPushPreview(%s) = %q, want %q", tc.msgType, got, tc.want)
+		}
+	}
+}
+
+func TestResolveCardContentValidation(t *testing.T) {
+	ctx := context.Background()
+	for _, raw := range []string{``, `{}`, `{"ref_id":""}`, `{"ref_id":null}`, `[]`} {
+		if _, err := resolveCardContent(ctx, nil, msgTypeTripCard, "u1", json.RawMessage(raw)); !errors.Is(err, errCardRefRequired) {
+			t.Errorf("%q: err = %v, want errCardRefRequired", raw, err)
+		}
+	}
+	if _, err := resolveCardContent(ctx, nil, msgTypeOrderCard, "u1", json.RawMessage(`{"ref_id":42}`)); !errors.Is(err, errCardsUnavailable) {
+		t.Errorf("without main db: err = %v", err)
+	}
+}
+
+// The trip card snapshot carries the keys the main API returns for a trip card.
+func TestTripSnapshotMatchesGolden(t *testing.T) {
+	raw, err := os.ReadFile("../../tests/golden/trip_card_create.json")
+	if err != nil {
+		t.Skipf("golden file not available: %v", err)
+	}
+	var golden struct {
+		RequiredKeys []string `json:"requiredKeys"`
+	}
+	if err := json.Unmarshal(raw, &golden); err != nil {
+		t.Fatal(err)
+	}
+	encoded, _ := json.Marshal(tripSnapshot{ID: "t", ProfileID: "p", DestinationCity: "c", StartDate: "d", EndDate: "e"})
+	var snapshot map[string]any
+	_ = json.Unmarshal(encoded, &snapshot)
+	for _, key := range golden.RequiredKeys {
+		if _, ok := snapshot[key]; !ok {
+			t.Errorf("trip snapshot missing %q", key)
+		}
+	}
+}
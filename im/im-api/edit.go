@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"terravoy/im/imkit/storage"
+)
+
+// allocChangeSeq bumps the thread's change cursor. Every in-place change to an
+// existing message (edit, recall) takes a change_seq so that clients syncing
+// by afterSeq can catch up on older seqs via /threads/{id}/changes.
+func allocChangeSeq(ctx context.Context, tx pgx.Tx, threadID string) (int64, error) {
+	var changeSeq int64
+	err := tx.QueryRow(ctx, `
+		update chat_threads
+		set last_change_seq = last_change_seq + 1,
+		    updated_at = now()
+		where id = $1
+		returning last_change_seq`,
+		threadID,
+	).Scan(&changeSeq)
+	return changeSeq, err
+}
+
+const (
+	textMaxRunes    = 4000
+	textMentionsMax = 50
+)
+
+// normalizeTextContent re-encodes text content for storage, keeping only
+// "text" and "mentions" (user ids, deduplicated). Sending and editing both
+// go through it, so the same limits apply to both.
+func normalizeTextContent(raw json.RawMessage) (json.RawMessage, error) {
+	var content struct {
+		Text     string   `json:"text"`
+		Mentions []string `json:"mentions"`
+	}
+	if len(raw) == 0 || json.Unmarshal(raw, &content) != nil {
+		return nil, errors.New("invalid text content")
+	}
+	if strings.TrimSpace(content.Text) == "" {
+		return nil, errors.New("text required")
+	}
+	if utf8.RuneCountInString(content.Text) > textMaxRunes {
+		return nil, fmt.Errorf("text longer than %d characters", textMaxRunes)
+	}
+	out := map[string]any{"text": content.Text}
+	if len(content.Mentions) > 0 {
+		mentions, ok := normalizeMemberIDs(content.Mentions, "")
+		if !ok {
+			return nil, errors.New("mentions must be user ids")
+		}
+		if len(mentions) > textMentionsMax {
+			return nil, fmt.Errorf("at most %d mentions", textMentionsMax)
+		}
+		out["mentions"] = mentions
+	}
+	return json.Marshal(out)
+}
+
+// handleEditMessage replaces the content of a text message. Only the sender
+// may edit, within the edit window; the previous content is kept in
+// chat_message_edits.
+func handleEditMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, cfg Config) {
+	userID := ctxValue(r, ctxUserID)
+	msgID := chi.URLParam(r, "id")
+	var payload struct {
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	content, err := normalizeTextContent(payload.Content)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		threadID, senderID, msgType string
+		threadStatus                string
+		seq                         int64
+		prevContent                 []byte
+		createdAt                   time.Time
+		recalledAt                  *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+		select m.thread_id, m.sender_id, m.seq, m.type, m.content, m.created_at, m.recalled_at, t.status
+		from chat_messages m
+		join chat_threads t on t.id = m.thread_id
+		join chat_thread_members tm on tm.thread_id = m.thread_id and tm.user_id = $2
+		where m.id = $1
+		for update of m`,
+		msgID, userID,
+	).Scan(&threadID, &senderID, &seq, &msgType, &prevContent, &createdAt, &recalledAt, &threadStatus)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "NOT_FOUND", "message not found")
+		return
+	}
+	if senderID != userID {
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "only the sender can edit")
+		return
+	}
+	if threadStatus != threadStatusActive {
+		writeError(w, r, http.StatusConflict, "THREAD_INACTIVE", "thread not active")
+		return
+	}
+	if msgType != "text" {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "only text messages can be edited")
+		return
+	}
+	if recalledAt != nil {
+		writeError(w, r, http.StatusConflict, "MESSAGE_RECALLED", "message recalled")
+		return
+	}
+	if window := time.Duration(cfg.EditWindowSecs) * time.Second; window > 0 && time.Since(createdAt) > window {
+		writeError(w, r, http.StatusConflict, "EDIT_WINDOW_EXPIRED", "edit window expired")
+		return
+	}
+	if _, err := tx.Exec(ctx, `
+		insert into chat_message_edits (message_id, thread_id, editor_id, prev_content)
+		values ($1, $2, $3, $4)`,
+		msgID, threadID, userID, prevContent,
+	); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	changeSeq, err := allocChangeSeq(ctx, tx, threadID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	var (
+		editedAt  time.Time
+		editCount int
+	)
+	err = tx.QueryRow(ctx, `
+		update chat_messages
+		set content = $2,
+		    edited_at = now(),
+		    edit_count = edit_count + 1,
+		    change_seq = $3
+		where id = $1
+		returning edited_at, edit_count`,
+		msgID, content, changeSeq,
+	).Scan(&editedAt, &editCount)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	publishThreadEvent(ctx, redisClient, threadID, "edit", map[string]any{
+		"msg_id":     msgID,
+		"seq":        seq,
+		"content":    content,
+		"edited_at":  editedAt,
+		"edit_count": editCount,
+		"change_seq": changeSeq,
+	})
+	log.Info().
+		Str("trace_id", ctxValue(r, ctxTraceID)).
+		Str("user_id", userID).
+		Str("thread_id", threadID).
+		Str("msg_id", msgID).
+		Int64("change_seq", changeSeq).
+		Msg("message edited")
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"msg_id":     msgID,
+		"thread_id":  threadID,
+		"seq":        seq,
+		"edited_at":  editedAt,
+		"edit_count": editCount,
+		"change_seq": changeSeq,
+	})
+}
+
+// handleListChanges returns messages changed in place after afterChangeSeq,
+// in change order, with their current state.
+func handleListChanges(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, cfg Config, store storage.Storage) {
+	userID := ctxValue(r, ctxUserID)
+	threadID := chi.URLParam(r, "id")
+	var (
+		ttype         string
+		retentionDays int
+		lastChangeSeq int64
+		visibleFrom   int64
+	)
+	err := pool.QueryRow(r.Context(), `
+		select t.type, t.retention_days, t.last_change_seq, m.visible_from_seq
+		from chat_threads t
+		join chat_thread_members m on m.thread_id = t.id
+		where t.id = $1 and m.user_id = $2`,
+		threadID, userID,
+	).Scan(&ttype, &retentionDays, &lastChangeSeq, &visibleFrom)
+	if err != nil {
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "not a member")
+		return
+	}
+	afterChangeSeq := int64(0)
+	if v := queryInt64(r, "afterChangeSeq"); v != nil {
+		afterChangeSeq = *v
+	}
+	limit := clampInt(queryInt(r, "limit", 100), 1, 500)
+	rows, err := pool.Query(r.Context(), `
+		select id, seq, type, content, edited_at, edit_count, recalled_at, change_seq
+		from chat_messages
+		where thread_id = $1 and change_seq > $2 and created_at >= $3 and seq >= $5
+		order by change_seq asc
+		limit $4`,
+		threadID, afterChangeSeq, retentionCutoff(ttype, retentionDays, cfg), limit, visibleFrom,
+	)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer rows.Close()
+	type change struct {
+		MsgID      string          `json:"msg_id"`
+		Seq        int64           `json:"seq"`
+		Type       string          `json:"type"`
+		Content    json.RawMessage `json:"content"`
+		EditedAt   *time.Time      `json:"edited_at,omitempty"`
+		EditCount  int             `json:"edit_count"`
+		Recalled   bool            `json:"recalled"`
+		RecalledAt *time.Time      `json:"recalled_at,omitempty"`
+		ChangeSeq  int64           `json:"change_seq"`
+	}
+	changes := []change{}
+	for rows.Next() {
+		var c change
+		if err := rows.Scan(&c.MsgID, &c.Seq, &c.Type, &c.Content, &c.EditedAt, &c.EditCount, &c.RecalledAt, &c.ChangeSeq); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+		c.Recalled = c.RecalledAt != nil
+		c.Content = signMediaContent(r.Context(), store, cfg, c.Type, c.Content)
+		changes = append(changes, c)
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"changes":         changes,
+		"last_change_seq": lastChangeSeq,
+		"has_more":        len(changes) == limit,
+	})
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeTextContent(t *testing.T) {
+	u := "11111111-1111-4111-8111-111111111111"
+	got, err := normalizeTextContent(json.RawMessage(`{"text":"hi","mentions":["` + u + `","` + u + `"],"html":"<b>x</b>"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"mentions":["` + u + `"],"text":"hi"}`; string(got) != want {
+		t.Errorf("content = %s, want %s", got, want)
+	}
+	bad := []string{
+		``,
+		`{"text":"  "}`,
+		`{"text":"` + strings.Repeat("字", textMaxRunes+1) + `"}`,
+		`{"text":"hi","mentions":["bob"]}`,
+		`[1]`,
+	}
+	for _, raw := range bad {
+		if _, err := normalizeTextContent(json.RawMessage(raw)); err == nil {
+			t.Errorf("normalizeTextContent(%.40q) accepted", raw)
+		}
+	}
+	if _, err := normalizeTextContent(json.RawMessage(`{"text":"` + strings.Repeat("字", textMaxRunes) + `"}`)); err != nil {
+		t.Errorf("text at the limit rejected: %v", err)
+	}
+}
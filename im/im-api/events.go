@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"terravoy/im/im-api/internal/redisx"
+)
+
+// publishThreadEvent fans an event out to live subscribers of threadID through
+// the gateways' Redis fanout channel. The frame has the same shape as gateway
+// messages ({"type": ..., "payload": ...}); delivery is best-effort and
+// clients that miss it reconcile through the list APIs.
+func publishThreadEvent(ctx context.Context, redisClient *redis.Client, threadID, eventType string, payload map[string]any) {
+	if redisClient == nil {
+		return
+	}
+	payload["thread_id"] = threadID
+	data, err := json.Marshal(map[string]any{
+		"type":    eventType,
+		"payload": payload,
+	})
+	if err != nil {
+		return
+	}
+	if err := redisClient.Publish(ctx, redisx.KeyFanout(threadID), data).Err(); err != nil {
+		log.Warn().Err(err).Str("thread_id", threadID).Str("event", eventType).Msg("thread event publish failed")
+	}
+}
@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Group threads have any number of members. The creator is the owner; the
+// owner appoints admins, and owner/admins add and remove members. Whether a
+// new member sees the history from before they joined is a per-thread
+// setting (history_visibility) that the adder can override per call; it is
+// stored as the member's visible_from_seq, which every read path honours.
+const (
+	roleOwner  = "owner"
+	roleAdmin  = "admin"
+	roleMember = "member"
+
+	historyFull     = "full"
+	historyFromJoin = "from_join"
+
+	groupTitleMaxRunes = 50
+)
+
+var (
+	errNotGroupThread  = errors.New("not a group thread")
+	errGroupForbidden  = errors.New("not allowed in this group")
+	errGroupFull       = errors.New("group member limit reached")
+	errGroupOwnerLeave = errors.New("owner must transfer ownership before leaving")
+	errMemberNotFound  = errors.New("member not found")
+	errGroupInactive   = errors.New("group not active")
+)
+
+type groupMember struct {
+	UserID         string `json:"user_id"`
+	Role           string `json:"role"`
+	VisibleFromSeq int64  `json:"visible_from_seq"`
+}
+
+// memberChange is one add/remove/role change, fanned out as members_changed
+// (which gateways also use to update their subscriptions) plus a notice.
+type memberChange struct {
+	ThreadID string
+	Kind     string // created, join, leave, remove, role
+	ActorID  string
+	Added    []groupMember
+	Removed  []string
+	Updated  []groupMember
+	Notice   *serviceMessage
+}
+
+// appendSystemNotice takes the next seq in a thread locked by tx and inserts
+// a system message with the given content.
+func appendSystemNotice(ctx context.Context, tx pgx.Tx, threadID string, content map[string]any) (*serviceMessage, error) {
+	raw, err := json.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	msg := &serviceMessage{ThreadID: threadID, Type: "system", Content: raw}
+	err = tx.QueryRow(ctx, `
+		update chat_threads
+		set last_seq = last_seq + 1,
+		    last_message_at = now(),
+		    updated_at = now()
+		where id = $1
+		returning last_seq`,
+		threadID,
+	).Scan(&msg.Seq)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `
+		insert into chat_messages (thread_id, sender_id, client_msg_id, seq, type, content)
+		values ($1, $2, gen_random_uuid(), $3, 'system', $4)
+		returning id, client_msg_id::text, created_at`,
+		threadID, systemSenderID, msg.Seq, raw,
+	).Scan(&msg.MsgID, &msg.ClientMsgID, &msg.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// publishMemberChange sends members_changed before the notice so gateways
+// subscribe new members in time to receive it.
+func publishMemberChange(ctx context.Context, pool *pgxpool.Pool, redisClient *redis.Client, change *memberChange) {
+	if change == nil || change.Notice == nil {
+		return
+	}
+	publishThreadEvent(ctx, redisClient, change.ThreadID, "members_changed", memberChangePayload(change))
+	fanoutServiceMessage(ctx, pool, redisClient, change.Notice)
+}
+
+func memberChangePayload(change *memberChange) map[string]any {
+	added, removed, updated := change.Added, change.Removed, change.Updated
+	if added == nil {
+		added = []groupMember{}
+	}
+	if removed == nil {
+		removed = []string{}
+	}
+	if updated == nil {
+		updated = []groupMember{}
+	}
+	payload := map[string]any{
+		"kind":     change.Kind,
+		"actor_id": change.ActorID,
+		"added":    added,
+		"removed":  removed,
+		"updated":  updated,
+	}
+	if change.Notice != nil {
+		payload["seq"] = change.Notice.Seq
+	}
+	return payload
+}
+
+func normalizeMemberIDs(ids []string, exclude string) ([]string, bool) {
+	seen := map[string]bool{exclude: true}
+	out := make([]string, 0, len(ids))
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if !isUUID(id) {
+			return nil, false
+		}
+		if !seen[id] {
+			seen[id] = true
+			out = append(out, id)
+		}
+	}
+	return out, true
+}
+
+// canRemoveMember: anyone but the owner may leave; the owner removes admins
+// and members, admins remove members.
+func canRemoveMember(actorRole, targetRole string, self bool) error {
+	if self {
+		if actorRole == roleOwner {
+			return errGroupOwnerLeave
+		}
+		return nil
+	}
+	switch {
+	case actorRole == roleOwner:
+		return nil
+	case actorRole == roleAdmin && targetRole == roleMember:
+		return nil
+	default:
+		return errGroupForbidden
+	}
+}
+
+func writeGroupError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errThreadNotFound):
+		writeError(w, r, http.StatusNotFound, "THREAD_NOT_FOUND", err.Error())
+	case errors.Is(err, errNotGroupThread):
+		writeError(w, r, http.StatusBadRequest, "NOT_GROUP_THREAD", err.Error())
+	case errors.Is(err, errGroupForbidden):
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", err.Error())
+	case errors.Is(err, errGroupFull):
+		writeError(w, r, http.StatusConflict, "GROUP_FULL", err.Error())
+	case errors.Is(err, errGroupOwnerLeave):
+		writeError(w, r, http.StatusConflict, "OWNER_MUST_TRANSFER", err.Error())
+	case errors.Is(err, errMemberNotFound):
+		writeError(w, r, http.StatusNotFound, "MEMBER_NOT_FOUND", err.Error())
+	case errors.Is(err, errGroupInactive):
+		writeError(w, r, http.StatusConflict, "THREAD_INACTIVE", err.Error())
+	default:
+		log.Error().Err(err).Str("trace_id", ctxValue(r, ctxTraceID)).Msg("group change failed")
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+	}
+}
+
+type groupState struct {
+	Status            string
+	HistoryVisibility string
+	ActorRole         string
+	MemberCount       int
+}
+
+// lockGroup locks a group thread and loads the acting member's role.
+func lockGroup(ctx context.Context, tx pgx.Tx, threadID, actorID string) (*groupState, error) {
+	if !isUUID(threadID) {
+		return nil, errThreadNotFound
+	}
+	var (
+		g     groupState
+		ttype string
+		role  *string
+	)
+	err := tx.QueryRow(ctx, `
+		select t.type, t.status, t.history_visibility, m.role,
+		       (select count(*) from chat_thread_members where thread_id = t.id)
+		from chat_threads t
+		left join chat_thread_members m on m.thread_id = t.id and m.user_id = $2
+		where t.id = $1
+		for update of t`,
+		threadID, actorID,
+	).Scan(&ttype, &g.Status, &g.HistoryVisibility, &role, &g.MemberCount)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errThreadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, errThreadNotFound
+	}
+	if ttype != "group" {
+		return nil, errNotGroupThread
+	}
+	g.ActorRole = *role
+	return &g, nil
+}
+
+// handleCreateGroup is POST /v1/groups with {"title", "member_ids",
+// "history_visibility"}; the caller becomes the owner.
+func handleCreateGroup(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, cfg Config) {
+	userID := ctxValue(r, ctxUserID)
+	var payload struct {
+		Title             string   `json:"title"`
+		MemberIDs         []string `json:"member_ids"`
+		HistoryVisibility string   `json:"history_visibility"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	title := truncateRunes(strings.TrimSpace(payload.Title), groupTitleMaxRunes)
+	if payload.HistoryVisibility == "" {
+		payload.HistoryVisibility = historyFull
+	}
+	if payload.HistoryVisibility != historyFull && payload.HistoryVisibility != historyFromJoin {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "history_visibility must be full or from_join")
+		return
+	}
+	memberIDs, ok := normalizeMemberIDs(payload.MemberIDs, userID)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "INVALID_MEMBERS", "member_ids must be user ids")
+		return
+	}
+	if len(memberIDs)+1 > cfg.GroupMaxMembers {
+		writeError(w, r, http.StatusBadRequest, "GROUP_FULL", errGroupFull.Error())
+		return
+	}
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var threadID string
+	err = tx.QueryRow(ctx, `
+		insert into chat_threads (type, title, history_visibility, created_by, retention_days, sync_policy)
+		values ('group', nullif($1, ''), $2, $3, $4, 'local_first')
+		returning id`,
+		title, payload.HistoryVisibility, userID, cfg.RetentionOrderDays,
+	).Scan(&threadID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	change := &memberChange{ThreadID: threadID, Kind: "created", ActorID: userID}
+	change.Added = append(change.Added, groupMember{UserID: userID, Role: roleOwner})
+	for _, id := range memberIDs {
+		change.Added = append(change.Added, groupMember{UserID: id, Role: roleMember})
+	}
+	for _, m := range change.Added {
+		if _, err := tx.Exec(ctx, `
+			insert into chat_thread_members (thread_id, user_id, role)
+			values ($1, $2, $3)`,
+			threadID, m.UserID, m.Role,
+		); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+	}
+	change.Notice, err = appendSystemNotice(ctx, tx, threadID, map[string]any{
+		"text":     "群聊已创建",
+		"event":    "group_created",
+		"actor_id": userID,
+		"user_ids": append([]string{userID}, memberIDs...),
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	publishMemberChange(ctx, pool, redisClient, change)
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"thread_id":          threadID,
+		"type":               "group",
+		"status":             threadStatusActive,
+		"title":              title,
+		"history_visibility": payload.HistoryVisibility,
+		"members":            change.Added,
+		"last_seq":           change.Notice.Seq,
+	})
+}
+
+// handleAddGroupMembers is POST /v1/threads/{id}/members with {"user_ids",
+// "share_history"}; owner/admin only. share_history defaults to the thread's
+// history_visibility.
+func handleAddGroupMembers(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, cfg Config) {
+	userID := ctxValue(r, ctxUserID)
+	threadID := chi.URLParam(r, "id")
+	var payload struct {
+		UserIDs      []string `json:"user_ids"`
+		ShareHistory *bool    `json:"share_history"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	ids, ok := normalizeMemberIDs(payload.UserIDs, userID)
+	if !ok || len(ids) == 0 {
+		writeError(w, r, http.StatusBadRequest, "INVALID_MEMBERS", "user_ids must be user ids")
+		return
+	}
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	g, err := lockGroup(ctx, tx, threadID, userID)
+	if err == nil && g.ActorRole != roleOwner && g.ActorRole != roleAdmin {
+		err = errGroupForbidden
+	}
+	if err == nil && g.Status != threadStatusActive {
+		err = errGroupInactive
+	}
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	rows, err := tx.Query(ctx, `
+		select user_id::text from chat_thread_members
+		where thread_id = $1 and user_id = any($2::uuid[])`,
+		threadID, ids,
+	)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err == nil {
+			existing[id] = true
+		}
+	}
+	rows.Close()
+	var newIDs []string
+	for _, id := range ids {
+		if !existing[id] {
+			newIDs = append(newIDs, id)
+		}
+	}
+	if len(newIDs) == 0 {
+		_ = tx.Commit(ctx)
+		writeJSON(w, r, http.StatusOK, map[string]any{"thread_id": threadID, "added": []groupMember{}})
+		return
+	}
+	if g.MemberCount+len(newIDs) > cfg.GroupMaxMembers {
+		writeGroupError(w, r, errGroupFull)
+		return
+	}
+	share := g.HistoryVisibility == historyFull
+	if payload.ShareHistory != nil {
+		share = *payload.ShareHistory
+	}
+	change := &memberChange{ThreadID: threadID, Kind: "join", ActorID: userID}
+	change.Notice, err = appendSystemNotice(ctx, tx, threadID, map[string]any{
+		"text":     "新成员加入了群聊",
+		"event":    "member_joined",
+		"actor_id": userID,
+		"user_ids": newIDs,
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	visibleFrom := int64(0)
+	if !share {
+		visibleFrom = change.Notice.Seq
+	}
+	for _, id := range newIDs {
+		if _, err := tx.Exec(ctx, `
+			insert into chat_thread_members (thread_id, user_id, role, visible_from_seq, last_read_seq)
+			values ($1, $2, $3, $4, $5)`,
+			threadID, id, roleMember, visibleFrom, change.Notice.Seq-1,
+		); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+		change.Added = append(change.Added, groupMember{UserID: id, Role: roleMember, VisibleFromSeq: visibleFrom})
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	publishMemberChange(ctx, pool, redisClient, change)
+	writeJSON(w, r, http.StatusOK, map[string]any{"thread_id": threadID, "added": change.Added, "seq": change.Notice.Seq})
+}
+
+// handleRemoveGroupMember is DELETE /v1/threads/{id}/members/{user_id}:
+// leaving (user_id is the caller) or removing someone else.
+func handleRemoveGroupMember(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	userID := ctxValue(r, ctxUserID)
+	threadID := chi.URLParam(r, "id")
+	targetID := chi.URLParam(r, "user_id")
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	g, err := lockGroup(ctx, tx, threadID, userID)
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	self := targetID == userID
+	targetRole := g.ActorRole
+	if !self {
+		if !isUUID(targetID) {
+			writeGroupError(w, r, errMemberNotFound)
+			return
+		}
+		err = tx.QueryRow(ctx, `
+			select role from chat_thread_members where thread_id = $1 and user_id = $2`,
+			threadID, targetID,
+		).Scan(&targetRole)
+		if errors.Is(err, pgx.ErrNoRows) {
+			writeGroupError(w, r, errMemberNotFound)
+			return
+		}
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+	}
+	if err := canRemoveMember(g.ActorRole, targetRole, self); err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	if _, err := tx.Exec(ctx, `
+		delete from chat_thread_members where thread_id = $1 and user_id = $2`,
+		threadID, targetID,
+	); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	change := &memberChange{ThreadID: threadID, Kind: "remove", ActorID: userID, Removed: []string{targetID}}
+	notice := map[string]any{"text": "成员已被移出群聊", "event": "member_removed", "actor_id": userID, "user_ids": change.Removed}
+	if self {
+		change.Kind = "leave"
+		notice["text"], notice["event"] = "成员退出了群聊", "member_left"
+	}
+	change.Notice, err = appendSystemNotice(ctx, tx, threadID, notice)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	publishMemberChange(ctx, pool, redisClient, change)
+	writeJSON(w, r, http.StatusOK, map[string]any{"thread_id": threadID, "removed": change.Removed, "seq": change.Notice.Seq})
+}
+
+// handleUpdateGroupMember is PATCH /v1/threads/{id}/members/{user_id} with
+// {"role": "admin" | "member" | "owner"}; owner only. Making someone the
+// owner transfers ownership and turns the previous owner into an admin.
+func handleUpdateGroupMember(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	userID := ctxValue(r, ctxUserID)
+	threadID := chi.URLParam(r, "id")
+	targetID := chi.URLParam(r, "user_id")
+	var payload struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	if payload.Role != roleOwner && payload.Role != roleAdmin && payload.Role != roleMember {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "role must be owner, admin or member")
+		return
+	}
+	if targetID == userID || !isUUID(targetID) {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "cannot change your own role")
+		return
+	}
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	g, err := lockGroup(ctx, tx, threadID, userID)
+	if err == nil && g.ActorRole != roleOwner {
+		err = errGroupForbidden
+	}
+	if err != nil {
+		writeGroupError(w, r, err)
+		return
+	}
+	var currentRole string
+	err = tx.QueryRow(ctx, `
+		select role from chat_thread_members
+		where thread_id = $1 and user_id = $2
+		for update`,
+		threadID, targetID,
+	).Scan(&currentRole)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeGroupError(w, r, errMemberNotFound)
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if currentRole == payload.Role {
+		_ = tx.Commit(ctx)
+		writeJSON(w, r, http.StatusOK, map[string]any{"thread_id": threadID, "updated": []groupMember{}})
+		return
+	}
+	change := &memberChange{ThreadID: threadID, Kind: "role", ActorID: userID}
+	change.Updated = append(change.Updated, groupMember{UserID: targetID, Role: payload.Role})
+	text := "成员角色已变更"
+	if payload.Role == roleOwner {
+		change.Updated = append(change.Updated, groupMember{UserID: userID, Role: roleAdmin})
+		text = "群主已转让"
+	}
+	for _, m := range change.Updated {
+		if _, err := tx.Exec(ctx, `
+			update chat_thread_members set role = $3 where thread_id = $1 and user_id = $2`,
+			threadID, m.UserID, m.Role,
+		); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+	}
+	change.Notice, err = appendSystemNotice(ctx, tx, threadID, map[string]any{
+		"text":     text,
+		"event":    "member_role_changed",
+		"actor_id": userID,
+		"members":  change.Updated,
+	})
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	publishMemberChange(ctx, pool, redisClient, change)
+	writeJSON(w, r, http.StatusOK, map[string]any{"thread_id": threadID, "updated": change.Updated, "seq": change.Notice.Seq})
+}
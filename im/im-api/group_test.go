@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"terravoy/im/imkit/ratelimit"
+)
+
+func TestCanRemoveMember(t *testing.T) {
+	cases := []struct {
+		actor, target string
+		self          bool
+		want          error
+	}{
+		{roleMember, roleMember, true, nil},
+		{roleAdmin, roleAdmin, true, nil},
+		{roleOwner, roleOwner, true, errGroupOwnerLeave},
+		{roleOwner, roleAdmin, false, nil},
+		{roleOwner, roleMember, false, nil},
+		{roleAdmin, roleMember, false, nil},
+		{roleAdmin, roleAdmin, false, errGroupForbidden},
+		{roleAdmin, roleOwner, false, errGroupForbidden},
+		{roleMember, roleMember, false, errGroupForbidden},
+	}
+	for _, tc := range cases {
+		if got := canRemoveMember(tc.actor, tc.target, tc.self); !errors.Is(got, tc.want) {
+			t.Errorf("canRemoveMember(%s, %s, %v) = %v, want %v", tc.actor, tc.target, tc.self, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeMemberIDs(t *testing.T) {
+	self := "11111111-1111-4111-8111-111111111111"
+	other := "22222222-2222-4222-8222-222222222222"
+	got, ok := normalizeMemberIDs([]string{other, " " + other, self}, self)
+	if !ok || len(got) != 1 || got[0] != other {
+		t.Fatalf("normalizeMemberIDs = %v, %v", got, ok)
+	}
+	if _, ok := normalizeMemberIDs([]string{"u1"}, self); ok {
+		t.Fatal("non-uuid member accepted")
+	}
+}
+
+func TestMemberChangePayload(t *testing.T) {
+	raw, err := json.Marshal(memberChangePayload(&memberChange{ThreadID: "t", Kind: "leave", ActorID: "u", Removed: []string{"u"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"actor_id":"u","added":[],"kind":"leave","removed":["u"],"updated":[]}`
+	if string(raw) != want {
+		t.Errorf("payload = %s, want %s", raw, want)
+	}
+}
+
+func TestGroupHandlersValidation(t *testing.T) {
+	cfg := Config{GroupMaxMembers: 2}
+	create := func(w http.ResponseWriter, r *http.Request) { handleCreateGroup(w, r, nil, nil, cfg) }
+	add := func(w http.ResponseWriter, r *http.Request) { handleAddGroupMembers(w, r, nil, nil, cfg) }
+	update := func(w http.ResponseWriter, r *http.Request) { handleUpdateGroupMember(w, r, nil, nil) }
+	u1 := `"11111111-1111-4111-8111-111111111111"`
+	u2 := `"22222222-2222-4222-8222-222222222222"`
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		method  string
+		body    string
+		status  int
+		code    string
+	}{
+		{"create bad visibility", create, http.MethodPost, `{"title":"t","history_visibility":"none"}`, http.StatusBadRequest, "INVALID_REQUEST"},
+		{"create bad member", create, http.MethodPost, `{"title":"t","member_ids":["x"]}`, http.StatusBadRequest, "INVALID_MEMBERS"},
+		{"create too many", create, http.MethodPost, `{"title":"t","member_ids":[` + u1 + `,` + u2 + `]}`, http.StatusBadRequest, "GROUP_FULL"},
+		{"add nobody", add, http.MethodPost, `{"user_ids":[]}`, http.StatusBadRequest, "INVALID_MEMBERS"},
+		{"update bad role", update, http.MethodPatch, `{"role":"support_agent"}`, http.StatusBadRequest, "INVALID_REQUEST"},
+	}
+	for _, tc := range cases {
+		if status, code := callHandler(tc.handler, testRequest(tc.method, "/", tc.body, "")); status != tc.status || code != tc.code {
+			t.Errorf("%s: got %d %s, want %d %s", tc.name, status, code, tc.status, tc.code)
+		}
+	}
+}
+
+func TestGroupMembershipDB(t *testing.T) {
+	pool := testPool(t)
+	cfg := Config{GroupMaxMembers: 10, RateUserMax: 100, RateThreadMax: 100, RateUserWindowMs: 1000, RateThreadWindowMs: 1000}
+	owner, m1, m2 := newUUID(), newUUID(), newUUID()
+	create := func(w http.ResponseWriter, r *http.Request) { handleCreateGroup(w, r, pool, nil, cfg) }
+	add := func(w http.ResponseWriter, r *http.Request) { handleAddGroupMembers(w, r, pool, nil, cfg) }
+	remove := func(w http.ResponseWriter, r *http.Request) { handleRemoveGroupMember(w, r, pool, nil) }
+	update := func(w http.ResponseWriter, r *http.Request) { handleUpdateGroupMember(w, r, pool, nil) }
+	send := func(w http.ResponseWriter, r *http.Request) {
+		handleCreateMessage(w, r, pool, nil, nil, ratelimit.New(nil, ratelimit.FailOpen), cfg, nil)
+	}
+
+	var created struct {
+		ThreadID string `json:"thread_id"`
+		LastSeq  int64  `json:"last_seq"`
+	}
+	serveJSON(t, create, testRequest(http.MethodPost, "/", `{"title":"t","member_ids":["`+m1+`"]}`, owner), &created)
+	threadID := created.ThreadID
+	cleanupTestThread(t, pool, threadID, owner, m1, m2)
+	firstNotice := created.LastSeq
+
+	var added struct {
+		Added []groupMember `json:"added"`
+		Seq   int64         `json:"seq"`
+	}
+	serveJSON(t, add, testRequest(http.MethodPost, "/", `{"user_ids":["`+m2+`"],"share_history":false}`, owner, "id", threadID), &added)
+	if len(added.Added) != 1 || added.Added[0].VisibleFromSeq != added.Seq {
+		t.Fatalf("added = %+v", added)
+	}
+	var lastRead int64
+	if err := pool.QueryRow(context.Background(), `
+		select last_read_seq from chat_thread_members where thread_id = $1 and user_id = $2`,
+		threadID, m2,
+	).Scan(&lastRead); err != nil || lastRead != added.Seq-1 {
+		t.Errorf("new member last_read_seq = %d, %v; want %d", lastRead, err, added.Seq-1)
+	}
+
+	// m2 joined without history, so it can't quote the creation notice.
+	var firstMsgID string
+	if err := pool.QueryRow(context.Background(), `
+		select id from chat_messages where thread_id = $1 and seq = $2`,
+		threadID, firstNotice,
+	).Scan(&firstMsgID); err != nil {
+		t.Fatal(err)
+	}
+	body := `{"thread_id":"` + threadID + `","client_msg_id":"` + newUUID() + `","type":"text","content":{"text":"hi"},"reply_to_msg_id":"` + firstMsgID + `"}`
+	if status, code := callHandler(send, testRequest(http.MethodPost, "/", body, m2)); status != http.StatusBadRequest || code != "INVALID_REPLY" {
+		t.Errorf("reply before visible_from_seq: %d %s, want 400 INVALID_REPLY", status, code)
+	}
+
+	if status, code := callHandler(remove, testRequest(http.MethodDelete, "/", "", m1, "id", threadID, "user_id", m2)); status != http.StatusForbidden || code != "FORBIDDEN" {
+		t.Errorf("member removes member: %d %s", status, code)
+	}
+	var updated struct {
+		Updated []groupMember `json:"updated"`
+	}
+	serveJSON(t, update, testRequest(http.MethodPatch, "/", `{"role":"admin"}`, owner, "id", threadID, "user_id", m1), &updated)
+	var removed struct {
+		Removed []string `json:"removed"`
+	}
+	serveJSON(t, remove, testRequest(http.MethodDelete, "/", "", m1, "id", threadID, "user_id", m2), &removed)
+	serveJSON(t, update, testRequest(http.MethodPatch, "/", `{"role":"owner"}`, owner, "id", threadID, "user_id", m1), &updated)
+	if len(updated.Updated) != 2 {
+		t.Errorf("ownership transfer updated = %+v", updated.Updated)
+	}
+	roles := map[string]string{}
+	rows, err := pool.Query(context.Background(), `select user_id::text, role from chat_thread_members where thread_id = $1`, threadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			t.Fatal(err)
+		}
+		roles[userID] = role
+	}
+	rows.Close()
+	if len(roles) != 2 || roles[m1] != roleOwner || roles[owner] != roleAdmin {
+		t.Errorf("roles = %v", roles)
+	}
+
+	if _, err := pool.Exec(context.Background(), `update chat_threads set status = 'frozen' where id = $1`, threadID); err != nil {
+		t.Fatal(err)
+	}
+	if status, code := callHandler(add, testRequest(http.MethodPost, "/", `{"user_ids":["`+m2+`"]}`, m1, "id", threadID)); status != http.StatusConflict || code != "THREAD_INACTIVE" {
+		t.Errorf("add to frozen group: %d %s, want 409 THREAD_INACTIVE", status, code)
+	}
+}
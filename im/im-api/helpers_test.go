@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// testRequest builds a handler request. userID, when set, is put in the
+// context the way authMiddleware does; params are chi URL params given as
+// name, value pairs.
+func testRequest(method, target, body, userID string, params ...string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	ctx := req.Context()
+	if userID != "" {
+		ctx = context.WithValue(ctx, ctxUserID, userID)
+	}
+	if len(params) > 0 {
+		rctx := chi.NewRouteContext()
+		for i := 0; i+1 < len(params); i += 2 {
+			rctx.URLParams.Add(params[i], params[i+1])
+		}
+		ctx = context.WithValue(ctx, chi.RouteCtxKey, rctx)
+	}
+	return req.WithContext(ctx)
+}
+
+// callHandler runs handler on req and returns the status and the error code
+// from the body ("" for success responses).
+func callHandler(handler http.HandlerFunc, req *http.Request) (int, string) {
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	var resp struct {
+		Code string `json:"code"`
+	}
+	_ = json.Unmarshal(rec.Body.Bytes(), &resp)
+	return rec.Code, resp.Code
+}
+
+// testPool connects to IM_TEST_DB_DSN, an IM database with db/migrations
+// applied, and skips the test when it is not set. Tests only touch rows they
+// create under fresh ids, so a shared dev database works.
+func testPool(t *testing.T) *pgxpool.Pool {
+	t.Helper()
+	dsn := os.Getenv("IM_TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("IM_TEST_DB_DSN not set")
+	}
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+// createTestThread inserts a thread of ttype with members given as user id,
+// role pairs (a support thread belongs to its first member). The thread and
+// its members' unread counters are deleted when the test ends.
+func createTestThread(t *testing.T, pool *pgxpool.Pool, ttype string, members ...string) string {
+	t.Helper()
+	ctx := context.Background()
+	var supportUser *string
+	if ttype == "support" {
+		supportUser = &members[0]
+	}
+	var threadID string
+	err := pool.QueryRow(ctx, `
+		insert into chat_threads (type, order_id, match_session_id, support_user_id, retention_days, sync_policy)
+		values ($1,
+		        case when $1 = 'order' then gen_random_uuid() end,
+		        case when $1 = 'match' then gen_random_uuid() end,
+		        $2::uuid, 30, 'local_first')
+		returning id`,
+		ttype, supportUser,
+	).Scan(&threadID)
+	if err != nil {
+		t.Fatalf("create thread: %v", err)
+	}
+	var userIDs []string
+	for i := 0; i+1 < len(members); i += 2 {
+		userIDs = append(userIDs, members[i])
+	}
+	cleanupTestThread(t, pool, threadID, userIDs...)
+	for i := 0; i+1 < len(members); i += 2 {
+		if _, err := pool.Exec(ctx, `
+			insert into chat_thread_members (thread_id, user_id, role) values ($1, $2, $3)`,
+			threadID, members[i], members[i+1],
+		); err != nil {
+			t.Fatalf("add member: %v", err)
+		}
+	}
+	return threadID
+}
+
+// cleanupTestThread deletes a thread created by a test, and the unread
+// counters of the given users, when the test ends.
+func cleanupTestThread(t *testing.T, pool *pgxpool.Pool, threadID string, userIDs ...string) {
+	t.Cleanup(func() {
+		ctx := context.Background()
+		_, _ = pool.Exec(ctx, `delete from chat_threads where id = $1`, threadID)
+		_, _ = pool.Exec(ctx, `delete from chat_unread_counters where user_id = any($1::uuid[])`, userIDs)
+	})
+}
+
+// serveJSON runs handler on req, fails the test unless it answers 200, and
+// decodes the body into out.
+func serveJSON(t *testing.T, handler http.HandlerFunc, req *http.Request, out any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("%s %s: status %d: %s", req.Method, req.URL, rec.Code, rec.Body.String())
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), out); err != nil {
+		t.Fatalf("%s %s: decode: %v", req.Method, req.URL, err)
+	}
+}
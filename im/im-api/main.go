@@ -13,9 +13,9 @@ import (
 	"strings"
 	"time"
 
-	"github.com/aliyun/aliyun-oss-go-sdk/oss"
 	"github.com/go-chi/chi/v5"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/prometheus/client_golang/prometheus"
@@ -24,31 +24,60 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"terravoy/im/im-api/internal/redisx"
+	"terravoy/im/imkit/msgcontent"
+	"terravoy/im/imkit/ratelimit"
+	"terravoy/im/imkit/storage"
 )
 
 type Config struct {
-	Addr                 string
-	DBDsn                string
-	RedisURL             string
-	AuthJWTSecret        string
-	LocalJWTSecret       string
-	RetentionMatchDays   int
-	RetentionOrderDays   int
-	PresenceTTLSeconds   int
-	PresenceRefreshSec   int
-	RateUserMax          int
-	RateUserWindowMs     int
-	RateThreadMax        int
-	RateThreadWindowMs   int
-	EnvName              string
-	OSSEndpoint          string
-	OSSBucketIM          string
-	OSSAccessKeyID       string
-	OSSAccessKeySecret   string
-	OSSIMPublicBaseURL   string
+	Addr                   string
+	DBDsn                  string
+	RedisURL               string
+	AuthJWTSecret          string
+	LocalJWTSecret         string
+	RetentionMatchDays     int
+	RetentionOrderDays     int
+	PresenceTTLSeconds     int
+	PresenceRefreshSec     int
+	RateUserMax            int
+	RateUserWindowMs       int
+	RateThreadMax          int
+	RateThreadWindowMs     int
+	EnvName                string
+	OSSEndpoint            string
+	OSSBucketIM            string
+	OSSAccessKeyID         string
+	OSSAccessKeySecret     string
+	OSSIMPublicBaseURL     string
 	OSSUploadExpiresSecs   int
 	OSSIMUploadExpiresSecs int
-	OSSIMRetentionDays     int  // IM 消息媒体文件保留天数，0=不自动配置生命周期
+	OSSIMRetentionDays     int                         // IM 消息媒体文件保留天数，0=不自动配置生命周期
+	RateFailMode           string                      // Redis 不可用时的限流策略：open/closed/local
+	RecallWindowSecs       int                         // 消息撤回时间窗口（秒），0=不限制
+	EditWindowSecs         int                         // 消息编辑时间窗口（秒），0=不限制
+	Attachments            map[string]attachmentPolicy // 按消息类型的附件策略（扩展名/MIME/大小/OSS 前缀）
+	MediaVerify            bool                        // 发送媒体消息前校验对象（存在/大小/Content-Type）
+	MediaVerifyMagic       bool                        // 同时校验文件头（magic bytes）
+	StorageBackend         string                      // 媒体存储后端：oss/s3/local
+	MediaPublicBaseURL     string                      // 旧版公开 url 前缀，仅用于解析旧客户端提交的 url
+	MediaURLExpiresSecs    int                         // 签名下载链接有效期（秒）
+	MainDBDsn              string                      // 主业务库（体验/订单/行程卡），卡片消息快照用，只读
+	S3Endpoint             string                      // S3 兼容存储 endpoint（host[:port]）
+	S3Region               string
+	S3Bucket               string
+	S3AccessKeyID          string
+	S3SecretAccessKey      string
+	S3UseSSL               bool
+	S3PathStyle            bool // MinIO 等需 path-style 访问
+	S3PublicBaseURL        string
+	LocalStorageDir        string   // local 后端：文件存放目录
+	LocalStorageBaseURL    string   // local 后端：im-api 对外地址 + /v1/media/local
+	LocalStorageSecret     string   // local 后端：签名 URL 密钥（专用，不复用 LOCAL_JWT_SECRET）
+	ServiceTokens          []string // 服务间调用凭证（/internal/v1），逗号分隔可轮换
+	OrderCloseGraceHours   int      // 订单完成后会话自动关闭的宽限期（小时）
+	RetentionSupportDays   int      // 客服会话消息保留天数
+	SupportAutoAssign      bool     // 用户发起客服会话时自动分配空闲客服
+	GroupMaxMembers        int      // 群聊成员上限（含群主）
 }
 
 type ctxKey string
@@ -84,15 +113,39 @@ func main() {
 
 	prometheus.MustRegister(httpDuration)
 	prometheus.MustRegister(dbWriteLatency, messagesWrittenTotal)
+	prometheus.MustRegister(ratelimit.Collectors()...)
 
 	pool, err := pgxpool.New(context.Background(), cfg.DBDsn)
 	if err != nil {
 		log.Fatal().Err(err).Msg("db connect failed")
 	}
+	var mainDB *pgxpool.Pool
+	if cfg.MainDBDsn != "" {
+		if mainDB, err = pgxpool.New(context.Background(), cfg.MainDBDsn); err != nil {
+			log.Warn().Err(err).Msg("main db connect failed: card messages disabled")
+			mainDB = nil
+		}
+	} else {
+		log.Warn().Msg("IM_MAIN_DB_DSN not set: card messages disabled")
+	}
 	redisClient := newRedisClient(cfg.RedisURL)
+	limiter := ratelimit.New(redisClient, cfg.RateFailMode)
 
-	// 自动配置 OSS IM Bucket 生命周期规则
-	setupOSSLifecycle(cfg)
+	// local 后端的签名 URL 密钥必须单独配置，缺失时直接拒绝启动
+	if cfg.StorageBackend == "local" && cfg.LocalStorageSecret == "" {
+		log.Fatal().Msg("IM_STORAGE_LOCAL_SECRET is required with IM_STORAGE_BACKEND=local")
+	}
+	store, localStore, err := newStorage(cfg)
+	if err != nil {
+		log.Warn().Err(err).Str("backend", cfg.StorageBackend).Msg("media storage not configured")
+		store, localStore = nil, nil
+	}
+	// 媒体校验默认仅在存储已配置时开启；显式 IM_MEDIA_VERIFY=true 但无存储时发送返回 503
+	cfg.MediaVerify = envBool("IM_MEDIA_VERIFY", store != nil)
+	// 自动配置 IM 媒体存储生命周期规则
+	setupStorageLifecycle(context.Background(), cfg, store)
+	// 到期自动关闭会话（订单完成宽限期）
+	go runThreadCloseSweep(context.Background(), pool, redisClient)
 
 	router := chi.NewRouter()
 	router.Use(traceMiddleware)
@@ -103,21 +156,78 @@ func main() {
 		writeJSON(w, r, http.StatusOK, map[string]any{"ok": true})
 	})
 
+	router.Route("/internal/v1", func(r chi.Router) {
+		r.Use(serviceAuthMiddleware(cfg.ServiceTokens))
+		r.Post("/messages", func(w http.ResponseWriter, r *http.Request) {
+			handleServiceMessage(w, r, pool, redisClient)
+		})
+		r.Post("/threads/status", func(w http.ResponseWriter, r *http.Request) {
+			handleServiceThreadStatus(w, r, pool, redisClient)
+		})
+		r.Post("/orders/{order_id}/status", func(w http.ResponseWriter, r *http.Request) {
+			handleOrderThreadStatus(w, r, pool, redisClient, cfg)
+		})
+		r.Put("/support/agents/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+			handleServiceSupportAgent(w, r, pool)
+		})
+		r.Post("/support/threads/{id}/assign", func(w http.ResponseWriter, r *http.Request) {
+			handleServiceSupportAssign(w, r, pool, redisClient)
+		})
+	})
 	router.Route("/v1", func(r chi.Router) {
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/threads", func(w http.ResponseWriter, r *http.Request) {
-			handleListThreads(w, r, pool)
+			handleListThreads(w, r, pool, cfg, store)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/unread", func(w http.ResponseWriter, r *http.Request) {
+			handleUnreadSummary(w, r, pool)
 		})
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/threads/ensure", func(w http.ResponseWriter, r *http.Request) {
 			handleEnsureThread(w, r, pool)
 		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/groups", func(w http.ResponseWriter, r *http.Request) {
+			handleCreateGroup(w, r, pool, redisClient, cfg)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/support/thread", func(w http.ResponseWriter, r *http.Request) {
+			handleEnsureSupportThread(w, r, pool, redisClient, cfg)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/support/queue", func(w http.ResponseWriter, r *http.Request) {
+			handleSupportQueue(w, r, pool)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/support/threads/{id}/claim", func(w http.ResponseWriter, r *http.Request) {
+			handleSupportClaim(w, r, pool, redisClient)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/support/threads/{id}/transfer", func(w http.ResponseWriter, r *http.Request) {
+			handleSupportTransfer(w, r, pool, redisClient)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/threads/{id}/status", func(w http.ResponseWriter, r *http.Request) {
+			handleThreadStatus(w, r, pool, redisClient)
+		})
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/threads/{id}/read", func(w http.ResponseWriter, r *http.Request) {
 			handleReadThread(w, r, pool)
 		})
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/threads/{id}/messages", func(w http.ResponseWriter, r *http.Request) {
-			handleListMessages(w, r, pool, cfg)
+			handleListMessages(w, r, pool, cfg, store)
 		})
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/messages", func(w http.ResponseWriter, r *http.Request) {
-			handleCreateMessage(w, r, pool, redisClient, cfg)
+			handleCreateMessage(w, r, pool, mainDB, redisClient, limiter, cfg, store)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/messages/{id}/recall", func(w http.ResponseWriter, r *http.Request) {
+			handleRecallMessage(w, r, pool, redisClient, cfg, store)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Patch("/messages/{id}", func(w http.ResponseWriter, r *http.Request) {
+			handleEditMessage(w, r, pool, redisClient, cfg)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/messages/{id}/reactions", func(w http.ResponseWriter, r *http.Request) {
+			handleReaction(w, r, pool, redisClient)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Delete("/messages/{id}/reactions", func(w http.ResponseWriter, r *http.Request) {
+			handleReaction(w, r, pool, redisClient)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/messages/search", func(w http.ResponseWriter, r *http.Request) {
+			handleSearchMessages(w, r, pool, cfg)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/threads/{id}/changes", func(w http.ResponseWriter, r *http.Request) {
+			handleListChanges(w, r, pool, cfg, store)
 		})
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/threads/{id}/permission", func(w http.ResponseWriter, r *http.Request) {
 			handlePermission(w, r, pool)
@@ -125,12 +235,33 @@ func main() {
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/threads/{id}/members", func(w http.ResponseWriter, r *http.Request) {
 			handleThreadMembers(w, r, pool)
 		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/threads/{id}/settings", func(w http.ResponseWriter, r *http.Request) {
+			handleThreadSettings(w, r, pool)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Patch("/threads/{id}/settings", func(w http.ResponseWriter, r *http.Request) {
+			handleThreadSettings(w, r, pool)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/threads/{id}/members", func(w http.ResponseWriter, r *http.Request) {
+			handleAddGroupMembers(w, r, pool, redisClient, cfg)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Delete("/threads/{id}/members/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+			handleRemoveGroupMember(w, r, pool, redisClient)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Patch("/threads/{id}/members/{user_id}", func(w http.ResponseWriter, r *http.Request) {
+			handleUpdateGroupMember(w, r, pool, redisClient)
+		})
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/push/token", func(w http.ResponseWriter, r *http.Request) {
 			handlePushToken(w, r, pool)
 		})
 		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Post("/media/upload-url", func(w http.ResponseWriter, r *http.Request) {
-			handleMediaUpload(w, r, cfg)
+			handleMediaUpload(w, r, cfg, store)
+		})
+		r.With(authMiddleware(cfg.AuthJWTSecret, cfg.LocalJWTSecret)).Get("/messages/{id}/media", func(w http.ResponseWriter, r *http.Request) {
+			handleMediaURL(w, r, pool, cfg, store)
 		})
+		if localStore != nil {
+			r.Handle("/media/local/*", http.StripPrefix("/v1/media/local", localStore.Handler()))
+		}
 	})
 
 	server := &http.Server{
@@ -155,30 +286,56 @@ func setupLogger() {
 }
 
 func loadConfig() Config {
-	return Config{
-		Addr:                 env("IM_API_ADDR", ":8090"),
-		DBDsn:                env("IM_DB_DSN", ""),
-		RedisURL:             env("IM_REDIS_URL", ""),
-		AuthJWTSecret:        env("AUTH_JWT_SECRET", ""),
-		LocalJWTSecret:       env("LOCAL_JWT_SECRET", ""),
-		RetentionMatchDays:   envInt("IM_RETENTION_MATCH_DAYS", 14),
-		RetentionOrderDays:   envInt("IM_RETENTION_ORDER_DAYS", 180),
-		PresenceTTLSeconds:   envInt("IM_PRESENCE_TTL_SECONDS", 75),
-		PresenceRefreshSec:   envInt("IM_PRESENCE_REFRESH_SECONDS", 30),
-		RateUserMax:          envInt("IM_RATE_USER_MAX", 20),
-		RateUserWindowMs:     envInt("IM_RATE_USER_WINDOW_MS", 10000),
-		RateThreadMax:        envInt("IM_RATE_THREAD_MAX", 30),
-		RateThreadWindowMs:   envInt("IM_RATE_THREAD_WINDOW_MS", 10000),
-		EnvName:              env("NODE_ENV", "dev"),
-		OSSEndpoint:          env("OSS_ENDPOINT", ""),
-		OSSBucketIM:          env("OSS_BUCKET_IM", ""),
-		OSSAccessKeyID:       env("OSS_ACCESS_KEY_ID", ""),
-		OSSAccessKeySecret:   env("OSS_ACCESS_KEY_SECRET", ""),
-		OSSIMPublicBaseURL:   env("OSS_IM_PUBLIC_BASE_URL", ""),
+	cfg := Config{
+		Addr:                   env("IM_API_ADDR", ":8090"),
+		DBDsn:                  env("IM_DB_DSN", ""),
+		RedisURL:               env("IM_REDIS_URL", ""),
+		AuthJWTSecret:          env("AUTH_JWT_SECRET", ""),
+		LocalJWTSecret:         env("LOCAL_JWT_SECRET", ""),
+		RetentionMatchDays:     envInt("IM_RETENTION_MATCH_DAYS", 14),
+		RetentionOrderDays:     envInt("IM_RETENTION_ORDER_DAYS", 180),
+		PresenceTTLSeconds:     envInt("IM_PRESENCE_TTL_SECONDS", 75),
+		PresenceRefreshSec:     envInt("IM_PRESENCE_REFRESH_SECONDS", 30),
+		RateUserMax:            envInt("IM_RATE_USER_MAX", 20),
+		RateUserWindowMs:       envInt("IM_RATE_USER_WINDOW_MS", 10000),
+		RateThreadMax:          envInt("IM_RATE_THREAD_MAX", 30),
+		RateThreadWindowMs:     envInt("IM_RATE_THREAD_WINDOW_MS", 10000),
+		EnvName:                env("NODE_ENV", "dev"),
+		OSSEndpoint:            env("OSS_ENDPOINT", ""),
+		OSSBucketIM:            env("OSS_BUCKET_IM", ""),
+		OSSAccessKeyID:         env("OSS_ACCESS_KEY_ID", ""),
+		OSSAccessKeySecret:     env("OSS_ACCESS_KEY_SECRET", ""),
+		OSSIMPublicBaseURL:     env("OSS_IM_PUBLIC_BASE_URL", ""),
 		OSSUploadExpiresSecs:   envInt("OSS_UPLOAD_EXPIRES_SECONDS", 900),
 		OSSIMUploadExpiresSecs: envInt("OSS_IM_UPLOAD_EXPIRES_SECONDS", envInt("OSS_UPLOAD_EXPIRES_SECONDS", 900)),
 		OSSIMRetentionDays:     envInt("OSS_IM_RETENTION_DAYS", 90), // 默认90天
-	}
+		RateFailMode:           ratelimit.NormalizeFailMode(env("IM_RATE_FAIL_MODE", ratelimit.FailLocal)),
+		RecallWindowSecs:       envInt("IM_RECALL_WINDOW_SECONDS", 120),
+		EditWindowSecs:         envInt("IM_EDIT_WINDOW_SECONDS", 900),
+		Attachments:            loadAttachmentPolicies(envInt("OSS_IM_RETENTION_DAYS", 90)),
+		MediaVerifyMagic:       envBool("IM_MEDIA_VERIFY_MAGIC", true),
+		StorageBackend:         strings.ToLower(env("IM_STORAGE_BACKEND", "oss")),
+		S3Endpoint:             env("IM_S3_ENDPOINT", ""),
+		S3Region:               env("IM_S3_REGION", ""),
+		S3Bucket:               env("IM_S3_BUCKET", ""),
+		S3AccessKeyID:          env("IM_S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey:      env("IM_S3_SECRET_ACCESS_KEY", ""),
+		S3UseSSL:               envBool("IM_S3_USE_SSL", true),
+		S3PathStyle:            envBool("IM_S3_PATH_STYLE", false),
+		S3PublicBaseURL:        env("IM_S3_PUBLIC_BASE_URL", ""),
+		LocalStorageDir:        env("IM_STORAGE_LOCAL_DIR", "./data/im-media"),
+		LocalStorageBaseURL:    env("IM_STORAGE_LOCAL_BASE_URL", "http://localhost:8090/v1/media/local"),
+		LocalStorageSecret:     env("IM_STORAGE_LOCAL_SECRET", ""),
+		MediaURLExpiresSecs:    envInt("IM_MEDIA_URL_EXPIRES_SECONDS", 600),
+		MainDBDsn:              env("IM_MAIN_DB_DSN", ""),
+		ServiceTokens:          parseServiceTokens(env("IM_SERVICE_TOKEN", "")),
+		OrderCloseGraceHours:   envInt("IM_ORDER_CLOSE_GRACE_HOURS", 72),
+		RetentionSupportDays:   envInt("IM_RETENTION_SUPPORT_DAYS", 180),
+		SupportAutoAssign:      envBool("IM_SUPPORT_AUTO_ASSIGN", true),
+		GroupMaxMembers:        envInt("IM_GROUP_MAX_MEMBERS", 50),
+	}
+	cfg.MediaPublicBaseURL = mediaPublicBaseURL(cfg)
+	return cfg
 }
 
 func env(key, fallback string) string {
@@ -188,6 +345,15 @@ func env(key, fallback string) string {
 	return fallback
 }
 
+func envBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := strconv.ParseBool(v); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
 func envInt(key string, fallback int) int {
 	if v := os.Getenv(key); v != "" {
 		if parsed, err := strconv.Atoi(v); err == nil {
@@ -197,52 +363,94 @@ func envInt(key string, fallback int) int {
 	return fallback
 }
 
-// setupOSSLifecycle 自动配置 OSS IM Bucket 的生命周期规则
-// 根据 OSSIMRetentionDays 设置消息媒体文件的过期删除规则
-func setupOSSLifecycle(cfg Config) {
-	if cfg.OSSIMRetentionDays <= 0 {
-		log.Info().Msg("OSS lifecycle disabled (OSS_IM_RETENTION_DAYS <= 0)")
-		return
-	}
-	if cfg.OSSEndpoint == "" || cfg.OSSBucketIM == "" || cfg.OSSAccessKeyID == "" || cfg.OSSAccessKeySecret == "" {
-		log.Warn().Msg("OSS lifecycle skipped: missing OSS configuration")
-		return
+// newStorage 根据 IM_STORAGE_BACKEND 创建媒体存储（oss/s3/local）
+// local 模式返回 *storage.LocalStorage，由 im-api 自己提供签名 URL 的上传/下载
+func newStorage(cfg Config) (storage.Storage, *storage.LocalStorage, error) {
+	switch cfg.StorageBackend {
+	case "s3":
+		store, err := storage.NewS3(storage.S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			UseSSL:          cfg.S3UseSSL,
+			PathStyle:       cfg.S3PathStyle,
+		})
+		return store, nil, err
+	case "local":
+		local, err := storage.NewLocal(storage.LocalConfig{
+			Root:    cfg.LocalStorageDir,
+			BaseURL: cfg.LocalStorageBaseURL,
+			Secret:  cfg.LocalStorageSecret,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return local, local, nil
+	default:
+		store, err := storage.NewOSS(storage.OSSConfig{
+			Endpoint:        cfg.OSSEndpoint,
+			Bucket:          cfg.OSSBucketIM,
+			AccessKeyID:     cfg.OSSAccessKeyID,
+			AccessKeySecret: cfg.OSSAccessKeySecret,
+		})
+		return store, nil, err
 	}
+}
 
-	client, err := oss.New(cfg.OSSEndpoint, cfg.OSSAccessKeyID, cfg.OSSAccessKeySecret)
-	if err != nil {
-		log.Error().Err(err).Msg("OSS lifecycle: failed to create client")
-		return
+// mediaPublicBaseURL 返回消息内容中媒体 url 的公共前缀（随存储后端而定）
+func mediaPublicBaseURL(cfg Config) string {
+	switch cfg.StorageBackend {
+	case "s3":
+		return cfg.S3PublicBaseURL
+	case "local":
+		return cfg.LocalStorageBaseURL
+	default:
+		return cfg.OSSIMPublicBaseURL
 	}
+}
 
-	// 定义生命周期规则：im/ 前缀下的文件在 N 天后过期删除
-	ruleID := "im-message-media-expire"
-	rules := []oss.LifecycleRule{
-		{
+// setupStorageLifecycle 自动配置 IM 媒体存储的生命周期规则
+// 每种附件类型一个前缀、一条规则，天数取 IM_MEDIA_{TYPE}_RETENTION_DAYS（默认 OSSIMRetentionDays）
+func setupStorageLifecycle(ctx context.Context, cfg Config, store storage.Storage) {
+	// 定义生命周期规则：各类型前缀下的文件在 N 天后过期删除
+	var rules []storage.LifecycleRule
+	for msgType, policy := range cfg.Attachments {
+		if policy.RetentionDays <= 0 {
+			continue
+		}
+		ruleID := "im-message-" + msgType + "-expire"
+		if msgType == "image" {
+			ruleID = "im-message-media-expire" // 沿用原有规则 ID
+		}
+		rules = append(rules, storage.LifecycleRule{
 			ID:     ruleID,
-			Prefix: "im/",
-			Status: "Enabled",
-			Expiration: &oss.LifecycleExpiration{
-				Days: cfg.OSSIMRetentionDays,
-			},
-		},
+			Prefix: policy.Prefix + "/",
+			Days:   policy.RetentionDays,
+		})
 	}
-
-	// SetBucketLifecycle 是 Client 的方法，不是 Bucket 的方法
-	err = client.SetBucketLifecycle(cfg.OSSBucketIM, rules)
-	if err != nil {
-		log.Error().Err(err).Int("days", cfg.OSSIMRetentionDays).Msg("OSS lifecycle: failed to set rule")
+	if len(rules) == 0 {
+		log.Info().Msg("storage lifecycle disabled (retention days <= 0)")
 		return
 	}
-
-	log.Info().
-		Str("bucket", cfg.OSSBucketIM).
-		Str("prefix", "im/").
-		Int("expire_days", cfg.OSSIMRetentionDays).
-		Msg("OSS lifecycle rule configured successfully")
+	if store == nil {
+		log.Warn().Msg("storage lifecycle skipped: storage not configured")
+		return
+	}
+	if err := store.SetLifecycle(ctx, rules); err != nil {
+		log.Error().Err(err).Str("backend", store.Name()).Int("rules", len(rules)).Msg("storage lifecycle: failed to set rules")
+		return
+	}
+	for _, rule := range rules {
+		log.Info().
+			Str("backend", store.Name()).
+			Str("prefix", rule.Prefix).
+			Int("expire_days", rule.Days).
+			Msg("storage lifecycle rule configured successfully")
+	}
 }
 
-
 func traceMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		trace := r.Header.Get("X-Trace-Id")
@@ -473,37 +681,67 @@ func handleEnsureThread(w http.ResponseWriter, r *http.Request, pool *pgxpool.Po
 	})
 }
 
-func handleListThreads(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool) {
+func handleListThreads(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, cfg Config, store storage.Storage) {
 	userID := ctxValue(r, ctxUserID)
 	limit := clampInt(queryInt(r, "limit", 50), 1, 200)
-	offset := clampInt(queryInt(r, "offset", 0), 0, 10000)
-	rows, err := pool.Query(r.Context(), `
-		with last_messages as (
-			select distinct on (thread_id) thread_id, id, type, content, created_at, seq
-			from chat_messages
-			order by thread_id, seq desc
+	conds, args, err := threadListConditions(r.URL.Query(), userID)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+	// offset is kept for older clients; it is ignored once a cursor is sent.
+	offset := 0
+	if r.URL.Query().Get("cursor") == "" {
+		offset = clampInt(queryInt(r, "offset", 0), 0, 10000)
+	}
+	args = append(args, limit+1, offset)
+	// Page the caller's memberships first, then look up the last message of
+	// just those threads, so the cost follows the page, not chat_messages.
+	query := fmt.Sprintf(`
+		with page as (
+			select t.id, t.type, t.status, t.status_reason, t.close_at, t.title, t.match_session_id, t.order_id,
+			       t.last_seq, t.last_message_at, m.last_read_seq,
+			       m.muted_until, m.pinned_at, m.archived_at, m.notify_level,
+			       coalesce(t.last_message_at, t.updated_at) as activity_at
+			from chat_thread_members m
+			join chat_threads t on t.id = m.thread_id
+			where %s
+			order by %s
+			limit $%d offset $%d
 		)
-		select t.id, t.type, t.status, t.match_session_id, t.order_id,
-		       t.last_seq, t.last_message_at, m.last_read_seq,
-		       greatest(t.last_seq - m.last_read_seq, 0) as unread_count,
-		       lm.type as last_type, lm.content as last_content, lm.created_at as last_created_at, lm.seq as last_seq_msg
-		from chat_thread_members m
-		join chat_threads t on t.id = m.thread_id
-		left join last_messages lm on lm.thread_id = t.id
-		where m.user_id = $1
-		order by coalesce(t.last_message_at, t.updated_at) desc
-		limit $2 offset $3`,
-		userID, limit, offset,
-	)
+		select p.id, p.type, p.status, p.status_reason, p.close_at, p.title, p.match_session_id, p.order_id,
+		       p.last_seq, p.last_message_at, p.last_read_seq,
+		       greatest(p.last_seq - p.last_read_seq, 0) as unread_count,
+		       lm.type as last_type, lm.content as last_content, lm.created_at as last_created_at, lm.seq as last_seq_msg,
+		       lm.recalled_at as last_recalled_at,
+		       p.muted_until, p.pinned_at, p.archived_at, p.notify_level, now(), p.activity_at
+		from page p
+		left join lateral (
+			select type, content, created_at, seq, recalled_at
+			from chat_messages
+			where thread_id = p.id
+			order by seq desc
+			limit 1
+		) lm on true
+		order by (p.pinned_at is not null) desc, p.activity_at desc, p.id desc`,
+		strings.Join(conds, " and "), threadListOrder, len(args)-1, len(args))
+	rows, err := pool.Query(r.Context(), query, args...)
 	if err != nil {
 		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
 		return
 	}
 	defer rows.Close()
 	threads := []map[string]any{}
+	var (
+		nextCursor threadCursor
+		hasMore    bool
+	)
 	for rows.Next() {
 		var (
 			id, ttype, status string
+			statusReason      *string
+			closeAt           *time.Time
+			title             *string
 			matchID, orderID  *string
 			lastSeq           int64
 			lastAt            *time.Time
@@ -513,24 +751,42 @@ func handleListThreads(w http.ResponseWriter, r *http.Request, pool *pgxpool.Poo
 			lastContent       []byte
 			lastCreated       *time.Time
 			lastSeqMsg        *int64
+			lastRecalledAt    *time.Time
+			mutedUntil        *time.Time
+			pinnedAt          *time.Time
+			archivedAt        *time.Time
+			notifyLevel       string
+			now               time.Time
+			activityAt        time.Time
 		)
-		if err := rows.Scan(&id, &ttype, &status, &matchID, &orderID, &lastSeq, &lastAt, &lastRead, &unread, &lastType, &lastContent, &lastCreated, &lastSeqMsg); err != nil {
+		if err := rows.Scan(&id, &ttype, &status, &statusReason, &closeAt, &title, &matchID, &orderID, &lastSeq, &lastAt, &lastRead, &unread, &lastType, &lastContent, &lastCreated, &lastSeqMsg, &lastRecalledAt,
+			&mutedUntil, &pinnedAt, &archivedAt, &notifyLevel, &now, &activityAt); err != nil {
 			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
 			return
 		}
+		if len(threads) == limit {
+			// The extra row only tells us there is another page.
+			hasMore = true
+			break
+		}
+		nextCursor = threadCursor{Pinned: pinnedAt != nil, ActivityAt: activityAt, ThreadID: id}
 		var preview any = nil
 		if lastType != nil {
 			preview = map[string]any{
 				"type":      *lastType,
-				"content":   json.RawMessage(lastContent),
+				"content":   signMediaContent(r.Context(), store, cfg, *lastType, lastContent),
 				"created_at": lastCreated,
 				"seq":       lastSeqMsg,
+				"recalled":  lastRecalledAt != nil,
 			}
 		}
 		threads = append(threads, map[string]any{
 			"id":               id,
 			"type":             ttype,
 			"status":           status,
+			"status_reason":    statusReason,
+			"close_at":         closeAt,
+			"title":            title,
 			"match_session_id": matchID,
 			"order_id":         orderID,
 			"last_seq":         lastSeq,
@@ -538,9 +794,14 @@ func handleListThreads(w http.ResponseWriter, r *http.Request, pool *pgxpool.Poo
 			"last_read_seq":    lastRead,
 			"unread_count":     unread,
 			"last_message_preview": preview,
+			"settings":         newThreadSettings(mutedUntil, pinnedAt, archivedAt, notifyLevel, now),
 		})
 	}
-	writeJSON(w, r, http.StatusOK, map[string]any{"threads": threads})
+	response := map[string]any{"threads": threads}
+	if hasMore {
+		response["next_cursor"] = encodeThreadCursor(nextCursor)
+	}
+	writeJSON(w, r, http.StatusOK, response)
 }
 
 func handleReadThread(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool) {
@@ -570,19 +831,21 @@ func handleReadThread(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool
 	writeJSON(w, r, http.StatusOK, map[string]any{"last_read_seq": payload.LastReadSeq})
 }
 
-func handleListMessages(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, cfg Config) {
+func handleListMessages(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, cfg Config, store storage.Storage) {
 	userID := ctxValue(r, ctxUserID)
 	threadID := chi.URLParam(r, "id")
 	var ttype string
 	var lastSeq int64
+	var lastChangeSeq int64
 	var retentionDays int
+	var visibleFromSeq int64
 	err := pool.QueryRow(r.Context(), `
-		select t.type, t.last_seq, t.retention_days
+		select t.type, t.last_seq, t.last_change_seq, t.retention_days, m.visible_from_seq
 		from chat_threads t
 		join chat_thread_members m on m.thread_id = t.id
 		where t.id = $1 and m.user_id = $2`,
 		threadID, userID,
-	).Scan(&ttype, &lastSeq, &retentionDays)
+	).Scan(&ttype, &lastSeq, &lastChangeSeq, &retentionDays, &visibleFromSeq)
 	if err != nil {
 		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "not a member")
 		return
@@ -590,30 +853,29 @@ func handleListMessages(w http.ResponseWriter, r *http.Request, pool *pgxpool.Po
 	afterSeq := queryInt64(r, "afterSeq")
 	beforeSeq := queryInt64(r, "beforeSeq")
 	limit := clampInt(queryInt(r, "limit", 50), 1, 200)
-	if retentionDays <= 0 {
-		retentionDays = cfg.RetentionOrderDays
-		if ttype == "match" {
-			retentionDays = cfg.RetentionMatchDays
-		}
-	}
-	cutoff := time.Now().AddDate(0, 0, -retentionDays)
+	cutoff := retentionCutoff(ttype, retentionDays, cfg)
 
-	conds := []string{"thread_id = $1", "created_at >= $2"}
-	args := []any{threadID, cutoff}
+	// Members added to a group without history only see from their join.
+	conds := []string{"m.thread_id = $1", "m.created_at >= $2", "m.seq >= $3"}
+	args := []any{threadID, cutoff, visibleFromSeq}
 	if afterSeq != nil {
 		args = append(args, *afterSeq)
-		conds = append(conds, fmt.Sprintf("seq > $%d", len(args)))
+		conds = append(conds, fmt.Sprintf("m.seq > $%d", len(args)))
 	}
 	if beforeSeq != nil {
 		args = append(args, *beforeSeq)
-		conds = append(conds, fmt.Sprintf("seq < $%d", len(args)))
+		conds = append(conds, fmt.Sprintf("m.seq < $%d", len(args)))
 	}
 	args = append(args, limit)
 	query := fmt.Sprintf(`
-		select id, thread_id, sender_id, client_msg_id, seq, type, content, created_at
-		from chat_messages
+		select m.id, m.thread_id, m.sender_id, m.client_msg_id, m.seq, m.type, m.content, m.created_at, m.recalled_at,
+		       m.edited_at, m.edit_count, m.change_seq,
+		       m.reply_to_msg_id::text, rm.seq, rm.sender_id, rm.type, rm.content, rm.recalled_at
+		from chat_messages m
+		left join chat_messages rm
+		  on rm.id = m.reply_to_msg_id and rm.thread_id = m.thread_id and rm.created_at >= $2 and rm.seq >= $3
 		where %s
-		order by seq desc
+		order by m.seq desc
 		limit $%d`, strings.Join(conds, " and "), len(args))
 	rows, err := pool.Query(r.Context(), query, args...)
 	if err != nil {
@@ -622,30 +884,65 @@ func handleListMessages(w http.ResponseWriter, r *http.Request, pool *pgxpool.Po
 	}
 	defer rows.Close()
 	type msg struct {
-		ID          string          `json:"id"`
-		ThreadID    string          `json:"thread_id"`
-		SenderID    string          `json:"sender_id"`
-		ClientMsgID string          `json:"client_msg_id"`
-		Seq         int64           `json:"seq"`
-		Type        string          `json:"type"`
-		Content     json.RawMessage `json:"content"`
-		CreatedAt   time.Time       `json:"created_at"`
+		ID          string            `json:"id"`
+		ThreadID    string            `json:"thread_id"`
+		SenderID    string            `json:"sender_id"`
+		ClientMsgID string            `json:"client_msg_id"`
+		Seq         int64             `json:"seq"`
+		Type        string            `json:"type"`
+		Content     json.RawMessage   `json:"content"`
+		CreatedAt   time.Time         `json:"created_at"`
+		Recalled    bool              `json:"recalled"`
+		RecalledAt  *time.Time        `json:"recalled_at,omitempty"`
+		Edited      bool              `json:"edited"`
+		EditedAt    *time.Time        `json:"edited_at,omitempty"`
+		EditCount   int               `json:"edit_count"`
+		ChangeSeq   int64             `json:"change_seq"`
+		ReplyTo     *replyRef         `json:"reply_to,omitempty"`
+		Reactions   []reactionSummary `json:"reactions,omitempty"`
 	}
 	messages := []msg{}
 	for rows.Next() {
 		var m msg
-		if err := rows.Scan(&m.ID, &m.ThreadID, &m.SenderID, &m.ClientMsgID, &m.Seq, &m.Type, &m.Content, &m.CreatedAt); err != nil {
+		var (
+			replyToID              *string
+			replySeq               *int64
+			replySender, replyType *string
+			replyContent           []byte
+			replyRecalledAt        *time.Time
+		)
+		if err := rows.Scan(&m.ID, &m.ThreadID, &m.SenderID, &m.ClientMsgID, &m.Seq, &m.Type, &m.Content, &m.CreatedAt, &m.RecalledAt, &m.EditedAt, &m.EditCount, &m.ChangeSeq,
+			&replyToID, &replySeq, &replySender, &replyType, &replyContent, &replyRecalledAt); err != nil {
 			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
 			return
 		}
+		m.Recalled = m.RecalledAt != nil
+		m.Edited = m.EditedAt != nil
+		m.Content = signMediaContent(r.Context(), store, cfg, m.Type, m.Content)
+		if replyToID != nil {
+			m.ReplyTo = newReplyRef(*replyToID, replySeq, replySender, replyType, replyContent, replyRecalledAt)
+		}
 		messages = append(messages, m)
 	}
 	// reverse to ascending seq
 	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
 		messages[i], messages[j] = messages[j], messages[i]
 	}
+	msgIDs := make([]string, 0, len(messages))
+	for _, m := range messages {
+		msgIDs = append(msgIDs, m.ID)
+	}
+	reactions, err := loadReactions(r, pool, userID, msgIDs)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	for i := range messages {
+		messages[i].Reactions = reactions[messages[i].ID]
+	}
 	response := map[string]any{
-		"messages": messages,
+		"messages":        messages,
+		"last_change_seq": lastChangeSeq,
 	}
 	// report truncation
 	var minSeq int64
@@ -664,7 +961,69 @@ func handleListMessages(w http.ResponseWriter, r *http.Request, pool *pgxpool.Po
 	writeJSON(w, r, http.StatusOK, response)
 }
 
-func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, cfg Config) {
+// retentionCutoff returns the oldest created_at visible in a thread, using
+// the thread's retention_days or the per-type default.
+func retentionCutoff(ttype string, retentionDays int, cfg Config) time.Time {
+	if retentionDays <= 0 {
+		retentionDays = defaultRetentionDays(ttype, cfg)
+	}
+	return time.Now().AddDate(0, 0, -retentionDays)
+}
+
+// defaultRetentionDays is the retention of a thread type when the thread has
+// no retention_days of its own.
+func defaultRetentionDays(ttype string, cfg Config) int {
+	switch ttype {
+	case "match":
+		return cfg.RetentionMatchDays
+	case "support":
+		return cfg.RetentionSupportDays
+	default:
+		return cfg.RetentionOrderDays
+	}
+}
+
+// rowQuerier is satisfied by both *pgxpool.Pool and pgx.Tx.
+type rowQuerier interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// loadSentMessage renders the response for a message the caller already sent
+// with this client_msg_id, for idempotent retries. It returns pgx.ErrNoRows
+// when there is none.
+func loadSentMessage(ctx context.Context, q rowQuerier, store storage.Storage, cfg Config, userID, threadID, clientMsgID string) (map[string]any, error) {
+	var (
+		msgID, msgType string
+		seq            int64
+		createdAt      time.Time
+		replyToID      *string
+		content        json.RawMessage
+	)
+	err := q.QueryRow(ctx, `
+		select id, seq, created_at, reply_to_msg_id::text, type, content
+		from chat_messages
+		where sender_id = $1 and client_msg_id = $2
+		limit 1`,
+		userID, clientMsgID,
+	).Scan(&msgID, &seq, &createdAt, &replyToID, &msgType, &content)
+	if err != nil {
+		return nil, err
+	}
+	resp := map[string]any{
+		"msg_id":     msgID,
+		"seq":        seq,
+		"created_at": createdAt,
+		"content":    signMediaContent(ctx, store, cfg, msgType, content),
+	}
+	if replyToID != nil {
+		if ref, err := loadReplyTarget(ctx, q, userID, threadID, *replyToID, time.Time{}); err == nil {
+			resp["reply_to"] = ref
+		}
+	}
+	return resp, nil
+}
+
+func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool, mainDB *pgxpool.Pool, redisClient *redis.Client, limiter *ratelimit.Limiter, cfg Config, store storage.Storage) {
 	userID := ctxValue(r, ctxUserID)
 	start := time.Now()
 	var payload struct {
@@ -672,36 +1031,57 @@ func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 		ClientMsgID string          `json:"client_msg_id"`
 		Type        string          `json:"type"`
 		Content     json.RawMessage `json:"content"`
+		ReplyToID   string          `json:"reply_to_msg_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
 		return
 	}
+	payload.ReplyToID = strings.TrimSpace(payload.ReplyToID)
 	if payload.ThreadID == "" || payload.ClientMsgID == "" || payload.Type == "" {
 		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "thread_id/client_msg_id/type required")
 		return
 	}
-	if payload.Type != "text" && payload.Type != "image" && payload.Type != "system" && payload.Type != "order_event" {
+	_, isMedia := cfg.Attachments[payload.Type]
+	if payload.Type == "system" || payload.Type == "order_event" {
+		// 系统/订单事件消息只能由服务通过 /internal/v1/messages 写入
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "system and order_event messages are posted by services only")
+		return
+	}
+	if !isMedia && !isCardType(payload.Type) && payload.Type != "text" && payload.Type != msgcontent.TypeLocation {
 		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid message type")
 		return
 	}
-	if payload.Type == "image" {
-		normalized, err := normalizeImageContent(payload.Content, userID, cfg)
+	if isMedia {
+		normalized, err := normalizeMediaContent(payload.Type, payload.Content, cfg)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "INVALID_"+strings.ToUpper(payload.Type)+"_CONTENT", err.Error())
+			return
+		}
+		payload.Content = normalized
+	}
+	if payload.Type == "text" {
+		normalized, err := normalizeTextContent(payload.Content)
 		if err != nil {
-			writeError(w, r, http.StatusBadRequest, "INVALID_IMAGE_CONTENT", err.Error())
+			writeError(w, r, http.StatusBadRequest, "INVALID_TEXT_CONTENT", err.Error())
 			return
 		}
 		payload.Content = normalized
 	}
-	if allowed, _, err := redisx.AllowRate(r.Context(), redisClient, redisx.KeyRateUser(userID), cfg.RateUserWindowMs, cfg.RateUserMax); err == nil && !allowed {
-		writeError(w, r, http.StatusTooManyRequests, "RATE_LIMITED", "user rate limited")
+	if payload.Type == msgcontent.TypeLocation {
+		normalized, err := msgcontent.NormalizeLocation(payload.Content)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "INVALID_LOCATION_CONTENT", err.Error())
+			return
+		}
+		payload.Content = normalized
+	}
+	if !checkRate(w, r, limiter, redisx.KeyRateUser(userID), cfg.RateUserWindowMs, cfg.RateUserMax, "user rate limited") {
 		return
 	}
-	if allowed, _, err := redisx.AllowRate(r.Context(), redisClient, redisx.KeyRateThread(payload.ThreadID), cfg.RateThreadWindowMs, cfg.RateThreadMax); err == nil && !allowed {
-		writeError(w, r, http.StatusTooManyRequests, "RATE_LIMITED", "thread rate limited")
+	if !checkRate(w, r, limiter, redisx.KeyRateThread(payload.ThreadID), cfg.RateThreadWindowMs, cfg.RateThreadMax, "thread rate limited") {
 		return
 	}
-
 	ctx := r.Context()
 	tx, err := pool.Begin(ctx)
 	if err != nil {
@@ -710,36 +1090,23 @@ func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 	}
 	defer tx.Rollback(ctx)
 
-	var existing struct {
-		ID        string
-		Seq       int64
-		CreatedAt time.Time
-	}
-	err = tx.QueryRow(ctx, `
-		select id, seq, created_at
-		from chat_messages
-		where sender_id = $1 and client_msg_id = $2
-		limit 1`,
-		userID, payload.ClientMsgID,
-	).Scan(&existing.ID, &existing.Seq, &existing.CreatedAt)
-	if err == nil && existing.ID != "" {
+	if resp, err := loadSentMessage(ctx, tx, store, cfg, userID, payload.ThreadID, payload.ClientMsgID); err == nil {
 		_ = tx.Commit(ctx)
-		writeJSON(w, r, http.StatusOK, map[string]any{
-			"msg_id":     existing.ID,
-			"seq":        existing.Seq,
-			"created_at": existing.CreatedAt,
-		})
+		writeJSON(w, r, http.StatusOK, resp)
 		return
 	}
 
-	var threadStatus string
+	var (
+		threadStatus, threadType string
+		retentionDays            int
+	)
 	err = tx.QueryRow(ctx, `
-		select t.status
+		select t.status, t.type, t.retention_days
 		from chat_threads t
 		join chat_thread_members m on m.thread_id = t.id
 		where t.id = $1 and m.user_id = $2`,
 		payload.ThreadID, userID,
-	).Scan(&threadStatus)
+	).Scan(&threadStatus, &threadType, &retentionDays)
 	if err != nil {
 		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "not a member")
 		return
@@ -748,6 +1115,58 @@ func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 		writeError(w, r, http.StatusConflict, "THREAD_INACTIVE", "thread not active")
 		return
 	}
+	// 卡片解析与媒体校验（存储 HEAD）放在成员/状态检查之后，非成员无法借此探测
+	if isCardType(payload.Type) {
+		content, err := resolveCardContent(ctx, mainDB, payload.Type, userID, payload.Content)
+		switch {
+		case errors.Is(err, errCardNotFound):
+			writeError(w, r, http.StatusNotFound, "CARD_NOT_FOUND", err.Error())
+			return
+		case errors.Is(err, errCardForbidden):
+			writeError(w, r, http.StatusForbidden, "CARD_FORBIDDEN", err.Error())
+			return
+		case errors.Is(err, errCardsUnavailable):
+			writeError(w, r, http.StatusServiceUnavailable, "CARDS_UNAVAILABLE", err.Error())
+			return
+		case errors.Is(err, errCardRefRequired):
+			writeError(w, r, http.StatusBadRequest, "INVALID_CARD_CONTENT", err.Error())
+			return
+		case err != nil:
+			log.Error().Err(err).Str("trace_id", ctxValue(r, ctxTraceID)).Str("msg_type", payload.Type).Msg("card lookup failed")
+			writeError(w, r, http.StatusServiceUnavailable, "CARDS_UNAVAILABLE", "card lookup failed")
+			return
+		}
+		payload.Content = content
+	}
+	if isMedia && cfg.MediaVerify {
+		if err := verifyMediaObject(ctx, redisClient, cfg, store, payload.Content); err != nil {
+			var verr *mediaVerifyError
+			if errors.As(err, &verr) {
+				writeError(w, r, http.StatusUnprocessableEntity, "MEDIA_VERIFY_FAILED", verr.Error())
+				return
+			}
+			log.Error().Err(err).Str("trace_id", ctxValue(r, ctxTraceID)).Msg("media verify failed")
+			writeError(w, r, http.StatusServiceUnavailable, "STORAGE_ERROR", "media verify unavailable")
+			return
+		}
+	}
+	var replyTo *replyRef
+	var replyToID *string
+	if payload.ReplyToID != "" {
+		replyTo, err = loadReplyTarget(ctx, tx, userID, payload.ThreadID, payload.ReplyToID, retentionCutoff(threadType, retentionDays, cfg))
+		switch {
+		case errors.Is(err, errReplyNotFound):
+			writeError(w, r, http.StatusBadRequest, "INVALID_REPLY", err.Error())
+			return
+		case errors.Is(err, errReplyRecalled):
+			writeError(w, r, http.StatusConflict, "REPLY_TARGET_RECALLED", err.Error())
+			return
+		case err != nil:
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+		replyToID = &payload.ReplyToID
+	}
 	var nextSeq int64
 	err = tx.QueryRow(ctx, `
 		update chat_threads
@@ -765,29 +1184,22 @@ func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 	var msgID string
 	var createdAt time.Time
 	err = tx.QueryRow(ctx, `
-		insert into chat_messages (thread_id, sender_id, client_msg_id, seq, type, content)
-		values ($1, $2, $3, $4, $5, $6)
+		insert into chat_messages (thread_id, sender_id, client_msg_id, seq, type, content, reply_to_msg_id)
+		values ($1, $2, $3, $4, $5, $6, $7)
 		returning id, created_at`,
-		payload.ThreadID, userID, payload.ClientMsgID, nextSeq, payload.Type, payload.Content,
+		payload.ThreadID, userID, payload.ClientMsgID, nextSeq, payload.Type, payload.Content, replyToID,
 	).Scan(&msgID, &createdAt)
 	if err != nil {
 		if pgErr, ok := err.(*pgconn.PgError); ok && pgErr.Code == "23505" {
-			var existingID string
-			var existingSeq int64
-			var existingAt time.Time
-			_ = tx.QueryRow(ctx, `
-				select id, seq, created_at
-				from chat_messages
-				where sender_id = $1 and client_msg_id = $2
-				limit 1`,
-				userID, payload.ClientMsgID,
-			).Scan(&existingID, &existingSeq, &existingAt)
-			_ = tx.Commit(ctx)
-			writeJSON(w, r, http.StatusOK, map[string]any{
-				"msg_id":     existingID,
-				"seq":        existingSeq,
-				"created_at": existingAt,
-			})
+			// A concurrent retry won the insert. This transaction is aborted,
+			// so answer from the committed row, shaped like the check above.
+			_ = tx.Rollback(ctx)
+			resp, err := loadSentMessage(ctx, pool, store, cfg, userID, payload.ThreadID, payload.ClientMsgID)
+			if err != nil {
+				writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+				return
+			}
+			writeJSON(w, r, http.StatusOK, resp)
 			return
 		}
 		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
@@ -798,6 +1210,7 @@ func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 		return
 	}
 	enqueuePushJobs(ctx, pool, redisClient, payload.ThreadID, userID, msgID, nextSeq, payload.Type, payload.Content, createdAt)
+	enqueueMediaJob(ctx, redisClient, payload.ThreadID, msgID, payload.Type, payload.Content)
 	latencyMs := time.Since(start).Milliseconds()
 	dbWriteLatency.Observe(float64(latencyMs))
 	messagesWrittenTotal.Inc()
@@ -811,65 +1224,33 @@ func handleCreateMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 		Int64("latency_ms", latencyMs).
 		Str("err_code", "").
 		Msg("message written")
-	writeJSON(w, r, http.StatusOK, map[string]any{
+	resp := map[string]any{
 		"msg_id":     msgID,
 		"seq":        nextSeq,
 		"created_at": createdAt,
-	})
-}
-
-type imageContent struct {
-	URL       string `json:"url"`
-	ObjectKey string `json:"object_key"`
-	Mime      string `json:"mime"`
-	Width     int    `json:"width"`
-	Height    int    `json:"height"`
-	Size      int64  `json:"size"`
-}
-
-func normalizeImageContent(raw json.RawMessage, userID string, cfg Config) (json.RawMessage, error) {
-	if len(raw) == 0 || string(raw) == "null" {
-		return nil, errors.New("image content required")
+		"content":    signMediaContent(ctx, store, cfg, payload.Type, payload.Content),
 	}
-	var content imageContent
-	if err := json.Unmarshal(raw, &content); err != nil {
-		return nil, errors.New("invalid image content")
+	if replyTo != nil {
+		resp["reply_to"] = replyTo
 	}
-	content.ObjectKey = strings.TrimSpace(content.ObjectKey)
-	content.URL = strings.TrimSpace(content.URL)
-	content.Mime = strings.TrimSpace(content.Mime)
-	if content.URL == "" || content.Mime == "" {
-		return nil, errors.New("url/mime required")
-	}
-	if content.Width <= 0 || content.Height <= 0 || content.Size <= 0 {
-		return nil, errors.New("width/height/size required")
-	}
-	if !strings.HasPrefix(content.Mime, "image/") {
-		return nil, errors.New("mime must be image/*")
-	}
-	objectKey, err := parseObjectKeyFromURL(content.URL, cfg)
+	writeJSON(w, r, http.StatusOK, resp)
+}
+
+// checkRate applies a rate limit and writes the rejection response.
+func checkRate(w http.ResponseWriter, r *http.Request, limiter *ratelimit.Limiter, key string, windowMs, max int, limitedMsg string) bool {
+	allowed, retryMs, err := limiter.Allow(r.Context(), key, windowMs, max)
 	if err != nil {
-		return nil, err
-	}
-	if content.ObjectKey != "" && content.ObjectKey != objectKey {
-		return nil, errors.New("object_key mismatch")
-	}
-	content.ObjectKey = objectKey
-	if err := validateIMObjectKey(content.ObjectKey, cfg.EnvName); err != nil {
-		return nil, err
-	}
-	ext := ""
-	if idx := strings.LastIndex(content.ObjectKey, "."); idx != -1 && idx < len(content.ObjectKey)-1 {
-		ext = content.ObjectKey[idx+1:]
-	}
-	if ext == "" || !isAllowedExt(ext) {
-		return nil, errors.New("object_key ext invalid")
+		writeError(w, r, http.StatusServiceUnavailable, "RATE_LIMIT_UNAVAILABLE", "rate limiter unavailable")
+		return false
 	}
-	normalized, err := json.Marshal(content)
-	if err != nil {
-		return nil, errors.New("invalid image content")
+	if !allowed {
+		if retryMs > 0 {
+			w.Header().Set("Retry-After", strconv.FormatInt((retryMs+999)/1000, 10))
+		}
+		writeError(w, r, http.StatusTooManyRequests, "RATE_LIMITED", limitedMsg)
+		return false
 	}
-	return normalized, nil
+	return true
 }
 
 func enqueuePushJobs(ctx context.Context, pool *pgxpool.Pool, redisClient *redis.Client, threadID, senderID, msgID string, seq int64, msgType string, content json.RawMessage, createdAt time.Time) {
@@ -877,7 +1258,7 @@ func enqueuePushJobs(ctx context.Context, pool *pgxpool.Pool, redisClient *redis
 		return
 	}
 	rows, err := pool.Query(ctx, `
-		select user_id
+		select user_id, notify_level, coalesce(muted_until > now(), false)
 		from chat_thread_members
 		where thread_id = $1 and user_id <> $2`, threadID, senderID)
 	if err != nil {
@@ -887,11 +1268,15 @@ func enqueuePushJobs(ctx context.Context, pool *pgxpool.Pool, redisClient *redis
 	defer rows.Close()
 	preview := buildPushPreview(msgType, content)
 	for rows.Next() {
-		var toUserID string
-		if err := rows.Scan(&toUserID); err != nil {
+		var toUserID, notifyLevel string
+		var muted bool
+		if err := rows.Scan(&toUserID, &notifyLevel, &muted); err != nil {
 			log.Error().Err(err).Msg("push enqueue scan failed")
 			continue
 		}
+		if !shouldPush(notifyLevel, muted, content, toUserID) {
+			continue
+		}
 		if isUserOnline(ctx, redisClient, toUserID) {
 			continue
 		}
@@ -928,9 +1313,35 @@ func buildPushPreview(msgType string, content json.RawMessage) string {
 	switch msgType {
 	case "image":
 		return "[图片]"
+	case "voice":
+		return "[语音]"
+	case "video":
+		return "[视频]"
+	case "file":
+		var file struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(content, &file); err == nil && file.Name != "" {
+			return "[文件] " + file.Name
+		}
+		return "[文件]"
 	case "order_event":
 		return "[订单更新]"
+	case msgTypeExperienceCard, msgTypeOrderCard, msgTypeTripCard:
+		return cardPreview(msgType, content)
+	case msgcontent.TypeLocation:
+		var loc msgcontent.Location
+		if err := json.Unmarshal(content, &loc); err == nil && loc.Name != "" {
+			return "[位置] " + loc.Name
+		}
+		return "[位置]"
 	case "system":
+		var body struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(content, &body); err == nil {
+			return body.Text
+		}
 		return ""
 	default:
 		var body map[string]any
@@ -977,7 +1388,7 @@ func handleThreadMembers(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 		return
 	}
 	rows, err := pool.Query(r.Context(), `
-		select user_id, role
+		select user_id, role, visible_from_seq, joined_at
 		from chat_thread_members
 		where thread_id = $1`, threadID)
 	if err != nil {
@@ -989,13 +1400,17 @@ func handleThreadMembers(w http.ResponseWriter, r *http.Request, pool *pgxpool.P
 	for rows.Next() {
 		var uid string
 		var role string
-		if err := rows.Scan(&uid, &role); err != nil {
+		var visibleFromSeq int64
+		var joinedAt time.Time
+		if err := rows.Scan(&uid, &role, &visibleFromSeq, &joinedAt); err != nil {
 			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
 			return
 		}
 		members = append(members, map[string]any{
-			"user_id": uid,
-			"role":    role,
+			"user_id":          uid,
+			"role":             role,
+			"visible_from_seq": visibleFromSeq,
+			"joined_at":        joinedAt,
 		})
 	}
 	writeJSON(w, r, http.StatusOK, map[string]any{"members": members})
@@ -1029,7 +1444,7 @@ func handlePushToken(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool)
 	writeJSON(w, r, http.StatusOK, map[string]any{"ok": true})
 }
 
-func handleMediaUpload(w http.ResponseWriter, r *http.Request, cfg Config) {
+func handleMediaUpload(w http.ResponseWriter, r *http.Request, cfg Config, store storage.Storage) {
 	trace := ctxValue(r, ctxTraceID)
 	var payload struct {
 		Scope    string `json:"scope"`
@@ -1037,6 +1452,7 @@ func handleMediaUpload(w http.ResponseWriter, r *http.Request, cfg Config) {
 		Ext      string `json:"ext"`
 		Mime     string `json:"mime"`
 		Size     int64  `json:"size"`
+		MsgType  string `json:"msg_type"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		log.Warn().Str("trace_id", trace).Msg("im media upload invalid json")
@@ -1054,40 +1470,42 @@ func handleMediaUpload(w http.ResponseWriter, r *http.Request, cfg Config) {
 			ext = strings.ToLower(payload.Filename[idx+1:])
 		}
 	}
-	if !isAllowedExt(ext) || payload.Size <= 0 {
+	if payload.MsgType == "" {
+		payload.MsgType = "image"
+	}
+	policy, ok := cfg.Attachments[payload.MsgType]
+	if !ok {
+		log.Warn().Str("trace_id", trace).Str("msg_type", payload.MsgType).Msg("im media upload invalid msg_type")
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid msg_type")
+		return
+	}
+	if !policy.allowsExt(ext) || payload.Size <= 0 {
 		log.Warn().Str("trace_id", trace).Msg("im media upload invalid ext/size")
 		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid ext/size")
 		return
 	}
-	if cfg.OSSEndpoint == "" || cfg.OSSBucketIM == "" || cfg.OSSAccessKeyID == "" || cfg.OSSAccessKeySecret == "" || cfg.OSSIMPublicBaseURL == "" {
-		log.Warn().Str("trace_id", trace).Msg("im media upload misconfig")
-		writeError(w, r, http.StatusBadRequest, "MISCONFIG", "oss not configured")
+	if payload.Mime != "" && !policy.allowsMime(payload.Mime) {
+		log.Warn().Str("trace_id", trace).Str("msg_type", payload.MsgType).Msg("im media upload invalid mime")
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "mime not allowed")
 		return
 	}
-	client, err := oss.New(cfg.OSSEndpoint, cfg.OSSAccessKeyID, cfg.OSSAccessKeySecret)
-	if err != nil {
-		log.Error().Str("trace_id", trace).Msg("im media upload oss init failed")
-		writeError(w, r, http.StatusInternalServerError, "STORAGE_ERROR", "oss error")
+	if payload.Size > policy.MaxBytes {
+		log.Warn().Str("trace_id", trace).Str("msg_type", payload.MsgType).Int64("size", payload.Size).Msg("im media upload too large")
+		writeError(w, r, http.StatusBadRequest, "MEDIA_TOO_LARGE", fmt.Sprintf("max %d bytes", policy.MaxBytes))
 		return
 	}
-	bucket, err := client.Bucket(cfg.OSSBucketIM)
-	if err != nil {
-		log.Error().Str("trace_id", trace).Msg("im media upload bucket error")
-		writeError(w, r, http.StatusInternalServerError, "STORAGE_ERROR", "oss error")
+	if store == nil {
+		log.Warn().Str("trace_id", trace).Msg("im media upload misconfig")
+		writeError(w, r, http.StatusBadRequest, "MISCONFIG", "storage not configured")
 		return
 	}
-	objectKey := formatIMObjectKey(cfg.EnvName, ext)
-	expiresSec := int64(cfg.OSSIMUploadExpiresSecs)
-	if expiresSec <= 0 {
-		expiresSec = int64(cfg.OSSUploadExpiresSecs)
-	}
-	if expiresSec <= 0 {
-		expiresSec = 900
-	}
-	signedURL, err := bucket.SignURL(objectKey, oss.HTTPPut, expiresSec, oss.ContentType(payload.Mime))
+	objectKey := formatIMObjectKey(policy.Prefix, cfg.EnvName, ext)
+	expires := imUploadExpires(cfg)
+	expiresSec := int64(expires / time.Second)
+	signedURL, err := store.SignPut(r.Context(), objectKey, payload.Mime, expires)
 	if err != nil {
-		log.Error().Str("trace_id", trace).Msg("im media upload sign failed")
-		writeError(w, r, http.StatusInternalServerError, "STORAGE_ERROR", "oss error")
+		log.Error().Str("trace_id", trace).Str("backend", store.Name()).Msg("im media upload sign failed")
+		writeError(w, r, http.StatusInternalServerError, "STORAGE_ERROR", "storage error")
 		return
 	}
 	log.Info().Str("trace_id", trace).Str("object_key", objectKey).Int64("expires_in", expiresSec).Msg("im media upload url issued")
@@ -1103,15 +1521,15 @@ func handleMediaUpload(w http.ResponseWriter, r *http.Request, cfg Config) {
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
-func formatIMObjectKey(env, ext string) string {
+func formatIMObjectKey(prefix, env, ext string) string {
 	now := time.Now().UTC()
 	env = sanitizeEnvName(env)
-	return fmt.Sprintf("im/%s/%04d/%02d/%s.%s",
-		env, now.Year(), int(now.Month()), newUUID(), ext)
+	return fmt.Sprintf("%s/%s/%04d/%02d/%s.%s",
+		prefix, env, now.Year(), int(now.Month()), newUUID(), ext)
 }
 
 func parseObjectKeyFromURL(url string, cfg Config) (string, error) {
-	base := strings.TrimRight(cfg.OSSIMPublicBaseURL, "/")
+	base := strings.TrimRight(cfg.MediaPublicBaseURL, "/")
 	if base == "" {
 		return "", errors.New("public base url required")
 	}
@@ -1125,12 +1543,12 @@ func parseObjectKeyFromURL(url string, cfg Config) (string, error) {
 	return key, nil
 }
 
-func validateIMObjectKey(key, env string) error {
+func validateIMObjectKey(key, prefix, env string) error {
 	parts := strings.Split(key, "/")
 	if len(parts) != 5 {
 		return errors.New("object_key format invalid")
 	}
-	if parts[0] != "im" {
+	if parts[0] != prefix {
 		return errors.New("object_key prefix invalid")
 	}
 	if parts[1] != sanitizeEnvName(env) {
@@ -1214,15 +1632,6 @@ func newUUID() string {
 	)
 }
 
-func isAllowedExt(ext string) bool {
-	switch strings.ToLower(ext) {
-	case "jpg", "jpeg", "png", "webp", "gif":
-		return true
-	default:
-		return false
-	}
-}
-
 func newRedisClient(url string) *redis.Client {
 	if url == "" {
 		return nil
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"terravoy/im/im-api/internal/redisx"
+)
+
+// attachmentPolicy describes what a media message type accepts: upload
+// extensions and MIME types, size and duration limits, the metadata its
+// content must carry, and the OSS prefix its objects live under (each prefix
+// gets its own lifecycle rule).
+type attachmentPolicy struct {
+	Prefix        string
+	Exts          []string
+	MimePrefix    string   // e.g. "image/"; empty means Mimes is an allowlist
+	Mimes         []string // allowed MIME types when MimePrefix is empty
+	MaxBytes      int64
+	MaxDurationMs int64 // 0 = duration not used
+	RequireDims   bool
+	RequireName   bool
+	RetentionDays int
+}
+
+func (p attachmentPolicy) allowsExt(ext string) bool {
+	ext = strings.ToLower(ext)
+	for _, e := range p.Exts {
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (p attachmentPolicy) allowsMime(mime string) bool {
+	mime = strings.ToLower(mime)
+	if p.MimePrefix != "" {
+		return strings.HasPrefix(mime, p.MimePrefix)
+	}
+	for _, m := range p.Mimes {
+		if m == mime {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAttachmentPolicies reads per-type limits from IM_MEDIA_{TYPE}_*; OSS
+// retention defaults to OSS_IM_RETENTION_DAYS.
+func loadAttachmentPolicies(retentionDays int) map[string]attachmentPolicy {
+	policies := map[string]attachmentPolicy{
+		"image": {
+			Prefix:      "im",
+			Exts:        []string{"jpg", "jpeg", "png", "webp", "gif"},
+			MimePrefix:  "image/",
+			MaxBytes:    20 << 20,
+			RequireDims: true,
+		},
+		"voice": {
+			Prefix:        "im-voice",
+			Exts:          []string{"m4a", "aac", "opus"},
+			MimePrefix:    "audio/",
+			MaxBytes:      2 << 20,
+			MaxDurationMs: 60 * 1000,
+		},
+		"video": {
+			Prefix:        "im-video",
+			Exts:          []string{"mp4", "mov"},
+			MimePrefix:    "video/",
+			MaxBytes:      100 << 20,
+			MaxDurationMs: 300 * 1000,
+			RequireDims:   true,
+		},
+		"file": {
+			Prefix: "im-file",
+			Exts:   []string{"pdf", "doc", "docx", "xls", "xlsx", "ppt", "pptx", "txt", "zip"},
+			Mimes: []string{
+				"application/pdf",
+				"application/msword",
+				"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+				"application/vnd.ms-excel",
+				"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+				"application/vnd.ms-powerpoint",
+				"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+				"text/plain",
+				"application/zip",
+			},
+			MaxBytes:    50 << 20,
+			RequireName: true,
+		},
+	}
+	for msgType, p := range policies {
+		upper := strings.ToUpper(msgType)
+		p.MaxBytes = int64(envInt("IM_MEDIA_"+upper+"_MAX_BYTES", int(p.MaxBytes)))
+		if p.MaxDurationMs > 0 {
+			p.MaxDurationMs = int64(envInt("IM_MEDIA_"+upper+"_MAX_DURATION_SECONDS", int(p.MaxDurationMs/1000))) * 1000
+		}
+		p.RetentionDays = envInt("IM_MEDIA_"+upper+"_RETENTION_DAYS", retentionDays)
+		policies[msgType] = p
+	}
+	return policies
+}
+
+// mediaContent is the union of media message content fields; which ones are
+// required depends on the type's attachmentPolicy. Only the object key is
+// stored: URL is accepted from older clients and replaced by signed URLs on
+// the way out (see signMediaContent).
+type mediaContent struct {
+	URL        string `json:"url,omitempty"`
+	ObjectKey  string `json:"object_key"`
+	Mime       string `json:"mime"`
+	Size       int64  `json:"size"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+// normalizeMediaContent validates media content against the type's policy
+// and returns it re-encoded with the object key and without a URL.
+func normalizeMediaContent(msgType string, raw json.RawMessage, cfg Config) (json.RawMessage, error) {
+	policy, ok := cfg.Attachments[msgType]
+	if !ok {
+		return nil, errors.New("not a media type")
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, fmt.Errorf("%s content required", msgType)
+	}
+	var content mediaContent
+	if err := json.Unmarshal(raw, &content); err != nil {
+		return nil, fmt.Errorf("invalid %s content", msgType)
+	}
+	content.ObjectKey = strings.TrimSpace(content.ObjectKey)
+	content.URL = strings.TrimSpace(content.URL)
+	content.Mime = strings.TrimSpace(content.Mime)
+	content.Name = strings.TrimSpace(content.Name)
+	if (content.ObjectKey == "" && content.URL == "") || content.Mime == "" {
+		return nil, errors.New("object_key/mime required")
+	}
+	if !policy.allowsMime(content.Mime) {
+		return nil, errors.New("mime not allowed")
+	}
+	if content.Size <= 0 {
+		return nil, errors.New("size required")
+	}
+	if content.Size > policy.MaxBytes {
+		return nil, fmt.Errorf("%s too large", msgType)
+	}
+	if policy.RequireDims && (content.Width <= 0 || content.Height <= 0) {
+		return nil, errors.New("width/height required")
+	}
+	if policy.MaxDurationMs > 0 {
+		if content.DurationMs <= 0 {
+			return nil, errors.New("duration_ms required")
+		}
+		if content.DurationMs > policy.MaxDurationMs {
+			return nil, fmt.Errorf("%s too long", msgType)
+		}
+	} else {
+		content.DurationMs = 0
+	}
+	if policy.RequireName && content.Name == "" {
+		return nil, errors.New("name required")
+	}
+	objectKey, err := resolveIMObjectKey(content.URL, content.ObjectKey, policy, cfg)
+	if err != nil {
+		return nil, err
+	}
+	content.ObjectKey = objectKey
+	content.URL = ""
+	normalized, err := json.Marshal(content)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s content", msgType)
+	}
+	return normalized, nil
+}
+
+// resolveIMObjectKey returns the object key of media content, parsing it
+// from a legacy public URL when the client sent no object_key (a URL next to
+// an object_key is ignored; it may be a signed URL), and validates its
+// layout and extension.
+func resolveIMObjectKey(url, objectKey string, policy attachmentPolicy, cfg Config) (string, error) {
+	if objectKey == "" {
+		parsed, err := parseObjectKeyFromURL(url, cfg)
+		if err != nil {
+			return "", err
+		}
+		objectKey = parsed
+	}
+	if err := validateIMObjectKey(objectKey, policy.Prefix, cfg.EnvName); err != nil {
+		return "", err
+	}
+	ext := ""
+	if idx := strings.LastIndex(objectKey, "."); idx != -1 && idx < len(objectKey)-1 {
+		ext = objectKey[idx+1:]
+	}
+	if ext == "" || !policy.allowsExt(ext) {
+		return "", errors.New("object_key ext invalid")
+	}
+	return objectKey, nil
+}
+
+// enqueueMediaJob hands a freshly written image message to im-worker, which
+// generates its thumbnails and blurhash and emits media_ready.
+func enqueueMediaJob(ctx context.Context, redisClient *redis.Client, threadID, msgID, msgType string, content json.RawMessage) {
+	if redisClient == nil || msgType != "image" {
+		return
+	}
+	var media mediaContent
+	if err := json.Unmarshal(content, &media); err != nil || media.ObjectKey == "" {
+		return
+	}
+	payload := map[string]any{
+		"msg_id":          msgID,
+		"thread_id":       threadID,
+		"object_key":      media.ObjectKey,
+		"attempt":         0,
+		"available_at_ms": 0,
+	}
+	if _, err := redisClient.XAdd(ctx, &redis.XAddArgs{Stream: redisx.MediaStreamKey, Values: payload}).Result(); err != nil {
+		log.Error().Err(err).Str("msg_id", msgID).Msg("media job enqueue failed")
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/rs/zerolog/log"
+	"terravoy/im/imkit/storage"
+)
+
+// mediaURLExpiry is how long signed download URLs stay valid.
+func mediaURLExpiry(cfg Config) time.Duration {
+	if cfg.MediaURLExpiresSecs <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(cfg.MediaURLExpiresSecs) * time.Second
+}
+
+// signMediaContent returns media content with short-lived signed GET URLs in
+// "url" (and in each variant), plus "url_expires_at". Only object keys are
+// stored, so this runs every time content leaves im-api; callers must have
+// checked that the reader is a member of the thread. Other types, and
+// content that cannot be signed, are returned unchanged.
+func signMediaContent(ctx context.Context, store storage.Storage, cfg Config, msgType string, content json.RawMessage) json.RawMessage {
+	if _, isMedia := cfg.Attachments[msgType]; !isMedia || store == nil || len(content) == 0 {
+		return content
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return content
+	}
+	objectKey, _ := fields["object_key"].(string)
+	if objectKey == "" {
+		return content
+	}
+	expiry := mediaURLExpiry(cfg)
+	url, err := store.SignGet(ctx, objectKey, expiry)
+	if err != nil {
+		log.Warn().Err(err).Str("object_key", objectKey).Msg("media url sign failed")
+		return content
+	}
+	fields["url"] = url
+	fields["url_expires_at"] = time.Now().Add(expiry).UTC().Format(time.RFC3339)
+	if variants, ok := fields["variants"].(map[string]any); ok {
+		for _, v := range variants {
+			variant, ok := v.(map[string]any)
+			if !ok {
+				continue
+			}
+			if key, _ := variant["object_key"].(string); key != "" {
+				if url, err := store.SignGet(ctx, key, expiry); err == nil {
+					variant["url"] = url
+				}
+			}
+		}
+	}
+	signed, err := json.Marshal(fields)
+	if err != nil {
+		return content
+	}
+	return signed
+}
+
+// handleMediaURL issues a fresh signed URL for a media message, for clients
+// whose embedded url has expired. ?variant= selects a derived variant
+// (thumb, preview) instead of the original.
+func handleMediaURL(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, cfg Config, store storage.Storage) {
+	userID := ctxValue(r, ctxUserID)
+	msgID := chi.URLParam(r, "id")
+	if !isUUID(msgID) {
+		writeError(w, r, http.StatusNotFound, "NOT_FOUND", "message not found")
+		return
+	}
+	var (
+		threadID, msgType string
+		content           []byte
+		recalledAt        *time.Time
+	)
+	err := pool.QueryRow(r.Context(), `
+		select m.thread_id, m.type, m.content, m.recalled_at
+		from chat_messages m
+		join chat_thread_members tm on tm.thread_id = m.thread_id and tm.user_id = $2
+		join chat_threads t on t.id = m.thread_id
+		where m.id = $1
+		  and m.seq >= tm.visible_from_seq
+		  and m.created_at >= now() - make_interval(days => case
+		        when t.retention_days > 0 then t.retention_days
+		        when t.type = 'match' then $3::int
+		        else $4::int end)`,
+		msgID, userID, cfg.RetentionMatchDays, cfg.RetentionOrderDays,
+	).Scan(&threadID, &msgType, &content, &recalledAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusNotFound, "NOT_FOUND", "message not found")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if recalledAt != nil {
+		writeError(w, r, http.StatusConflict, "MESSAGE_RECALLED", "message recalled")
+		return
+	}
+	if _, isMedia := cfg.Attachments[msgType]; !isMedia {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "not a media message")
+		return
+	}
+	var media struct {
+		ObjectKey string `json:"object_key"`
+		Variants  map[string]struct {
+			ObjectKey string `json:"object_key"`
+		} `json:"variants"`
+	}
+	_ = json.Unmarshal(content, &media)
+	objectKey := media.ObjectKey
+	if name := r.URL.Query().Get("variant"); name != "" {
+		variant, ok := media.Variants[name]
+		if !ok || variant.ObjectKey == "" {
+			writeError(w, r, http.StatusNotFound, "VARIANT_NOT_FOUND", "variant not available")
+			return
+		}
+		objectKey = variant.ObjectKey
+	}
+	if objectKey == "" {
+		writeError(w, r, http.StatusNotFound, "NOT_FOUND", "media not found")
+		return
+	}
+	if store == nil {
+		writeError(w, r, http.StatusServiceUnavailable, "STORAGE_ERROR", "storage not configured")
+		return
+	}
+	expiry := mediaURLExpiry(cfg)
+	url, err := store.SignGet(r.Context(), objectKey, expiry)
+	if err != nil {
+		log.Error().Err(err).Str("trace_id", ctxValue(r, ctxTraceID)).Str("backend", store.Name()).Msg("media url sign failed")
+		writeError(w, r, http.StatusServiceUnavailable, "STORAGE_ERROR", "storage error")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"msg_id":     msgID,
+		"thread_id":  threadID,
+		"object_key": objectKey,
+		"url":        url,
+		"expires_at": time.Now().Add(expiry).UTC(),
+	})
+}
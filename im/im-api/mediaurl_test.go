@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"terravoy/im/imkit/storage"
+)
+
+func testMediaConfig() Config {
+	return Config{
+		EnvName:            "dev",
+		Attachments:        loadAttachmentPolicies(0),
+		MediaPublicBaseURL: "https://cdn.example.com",
+	}
+}
+
+func TestNormalizeMediaContentStoresKeyOnly(t *testing.T) {
+	cfg := testMediaConfig()
+	key := "im/dev/2026/01/0b5f3c1e-4a6d-4f0e-9a57-3a2c1d9e8b7f.jpg"
+	cases := map[string]string{
+		"key":        `{"object_key":"` + key + `","mime":"image/jpeg","size":10,"width":1,"height":1}`,
+		"legacy url": `{"url":"https://cdn.example.com/` + key + `","mime":"image/jpeg","size":10,"width":1,"height":1}`,
+		"signed url": `{"object_key":"` + key + `","url":"https://bucket.example.com/x?sig=1","mime":"image/jpeg","size":10,"width":1,"height":1}`,
+	}
+	for name, raw := range cases {
+		out, err := normalizeMediaContent("image", json.RawMessage(raw), cfg)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var content map[string]any
+		_ = json.Unmarshal(out, &content)
+		if content["object_key"] != key || content["url"] != nil {
+			t.Errorf("%s: stored %s", name, out)
+		}
+	}
+	if _, err := normalizeMediaContent("image", json.RawMessage(`{"mime":"image/jpeg","size":10,"width":1,"height":1}`), cfg); err == nil {
+		t.Error("content without object_key or url accepted")
+	}
+}
+
+func TestSignMediaContent(t *testing.T) {
+	cfg := testMediaConfig()
+	store, err := storage.NewLocal(storage.LocalConfig{Root: t.TempDir(), BaseURL: "http://im.local/media", Secret: "s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	raw := json.RawMessage(`{"object_key":"im/a.jpg","mime":"image/jpeg","blurhash":"LEHV6n","variants":{"thumb":{"object_key":"im/a_thumb.jpg","width":320}}}`)
+
+	var signed struct {
+		URL          string `json:"url"`
+		URLExpiresAt string `json:"url_expires_at"`
+		Blurhash     string `json:"blurhash"`
+		Variants     map[string]struct {
+			URL   string `json:"url"`
+			Width int    `json:"width"`
+		} `json:"variants"`
+	}
+	if err := json.Unmarshal(signMediaContent(ctx, store, cfg, "image", raw), &signed); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(signed.URL, "http://im.local/media/im/a.jpg?") || !strings.Contains(signed.URL, "signature=") || signed.URLExpiresAt == "" {
+		t.Fatalf("original not signed: %+v", signed)
+	}
+	if thumb := signed.Variants["thumb"]; !strings.HasPrefix(thumb.URL, "http://im.local/media/im/a_thumb.jpg?") || thumb.Width != 320 {
+		t.Fatalf("variant not signed: %+v", thumb)
+	}
+	if signed.Blurhash != "LEHV6n" {
+		t.Fatalf("other fields lost: %+v", signed)
+	}
+
+	text := json.RawMessage(`{"text":"hi"}`)
+	if out := signMediaContent(ctx, store, cfg, "text", text); string(out) != string(text) {
+		t.Fatalf("text content changed: %s", out)
+	}
+	if out := signMediaContent(ctx, nil, cfg, "image", raw); string(out) != string(raw) {
+		t.Fatalf("content changed without storage: %s", out)
+	}
+}
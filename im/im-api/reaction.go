@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	reactionMaxRunes = 8
+	reactionMaxBytes = 32
+	reactionsPerUser = 20
+)
+
+type reactionSummary struct {
+	Emoji       string `json:"emoji"`
+	Count       int    `json:"count"`
+	ReactedByMe bool   `json:"reacted_by_me"`
+}
+
+const (
+	variationSelector16 = '\uFE0F'
+	combiningKeycap     = '\u20E3'
+)
+
+// normalizeEmoji accepts a single short emoji sequence (ZWJ sequences, skin
+// tones and keycaps such as 1️⃣ included) and rejects plain text.
+func normalizeEmoji(raw string) (string, error) {
+	emoji := strings.TrimSpace(raw)
+	if emoji == "" {
+		return "", errors.New("emoji required")
+	}
+	if len(emoji) > reactionMaxBytes || utf8.RuneCountInString(emoji) > reactionMaxRunes {
+		return "", errors.New("emoji too long")
+	}
+	runes := []rune(emoji)
+	for i, r := range runes {
+		if r < 0x80 {
+			// ASCII is only allowed as the base of a keycap: [0-9#*] then
+			// U+20E3, optionally with U+FE0F in between.
+			if !isKeycapBase(r) || !isKeycapTail(runes[i+1:]) {
+				return "", errors.New("invalid emoji")
+			}
+			continue
+		}
+		if unicode.IsSpace(r) || unicode.IsControl(r) || unicode.IsLetter(r) {
+			return "", errors.New("invalid emoji")
+		}
+	}
+	return emoji, nil
+}
+
+func isKeycapBase(r rune) bool {
+	return (r >= '0' && r <= '9') || r == '#' || r == '*'
+}
+
+func isKeycapTail(rest []rune) bool {
+	if len(rest) > 0 && rest[0] == variationSelector16 {
+		rest = rest[1:]
+	}
+	return len(rest) > 0 && rest[0] == combiningKeycap
+}
+
+// handleReaction adds (POST) or removes (DELETE) the caller's reaction on a
+// message. Reactions take no seq or change_seq and never push; live
+// subscribers get a reaction event and offline clients see the aggregate on
+// the next message list.
+func handleReaction(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	userID := ctxValue(r, ctxUserID)
+	msgID := chi.URLParam(r, "id")
+	add := r.Method == http.MethodPost
+	var raw string
+	if add {
+		var payload struct {
+			Emoji string `json:"emoji"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+			return
+		}
+		raw = payload.Emoji
+	} else {
+		raw = r.URL.Query().Get("emoji")
+	}
+	emoji, err := normalizeEmoji(raw)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var (
+		threadID     string
+		threadStatus string
+		seq          int64
+		recalledAt   *time.Time
+	)
+	// Locking the message serializes reactions on it, so the per-user count
+	// check below can't be raced past reactionsPerUser. The reactions FK only
+	// takes key-share locks, which don't conflict with this one.
+	err = tx.QueryRow(ctx, `
+		select m.thread_id, m.seq, m.recalled_at, t.status
+		from chat_messages m
+		join chat_threads t on t.id = m.thread_id
+		join chat_thread_members tm on tm.thread_id = m.thread_id and tm.user_id = $2
+		where m.id = $1 and m.seq >= tm.visible_from_seq
+		for no key update of m`,
+		msgID, userID,
+	).Scan(&threadID, &seq, &recalledAt, &threadStatus)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "NOT_FOUND", "message not found")
+		return
+	}
+	if threadStatus != threadStatusActive {
+		writeError(w, r, http.StatusConflict, "THREAD_INACTIVE", "thread not active")
+		return
+	}
+	if add && recalledAt != nil {
+		writeError(w, r, http.StatusConflict, "MESSAGE_RECALLED", "message recalled")
+		return
+	}
+
+	changed := false
+	if add {
+		tag, err := tx.Exec(ctx, `
+			insert into chat_message_reactions (message_id, thread_id, user_id, emoji)
+			select $1, $2, $3, $4
+			where (select count(*) from chat_message_reactions where message_id = $1 and user_id = $3) < $5
+			on conflict do nothing`,
+			msgID, threadID, userID, emoji, reactionsPerUser,
+		)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+		changed = tag.RowsAffected() > 0
+		if !changed {
+			var exists bool
+			_ = tx.QueryRow(ctx, `
+				select exists(
+					select 1 from chat_message_reactions
+					where message_id = $1 and user_id = $2 and emoji = $3
+				)`,
+				msgID, userID, emoji,
+			).Scan(&exists)
+			if !exists {
+				writeError(w, r, http.StatusConflict, "REACTION_LIMIT", "too many reactions on this message")
+				return
+			}
+		}
+	} else {
+		tag, err := tx.Exec(ctx, `
+			delete from chat_message_reactions
+			where message_id = $1 and user_id = $2 and emoji = $3`,
+			msgID, userID, emoji,
+		)
+		if err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+		changed = tag.RowsAffected() > 0
+	}
+
+	var count int
+	if err := tx.QueryRow(ctx, `
+		select count(*) from chat_message_reactions
+		where message_id = $1 and emoji = $2`,
+		msgID, emoji,
+	).Scan(&count); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	action := "remove"
+	if add {
+		action = "add"
+	}
+	if changed {
+		publishThreadEvent(ctx, redisClient, threadID, "reaction", map[string]any{
+			"msg_id":  msgID,
+			"seq":     seq,
+			"user_id": userID,
+			"emoji":   emoji,
+			"action":  action,
+			"count":   count,
+		})
+		log.Info().
+			Str("trace_id", ctxValue(r, ctxTraceID)).
+			Str("user_id", userID).
+			Str("thread_id", threadID).
+			Str("msg_id", msgID).
+			Str("action", action).
+			Msg("reaction changed")
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"msg_id":        msgID,
+		"thread_id":     threadID,
+		"emoji":         emoji,
+		"count":         count,
+		"reacted_by_me": add,
+	})
+}
+
+// loadReactions aggregates reactions for a page of messages, in the order
+// each emoji was first used.
+func loadReactions(r *http.Request, pool *pgxpool.Pool, userID string, msgIDs []string) (map[string][]reactionSummary, error) {
+	out := map[string][]reactionSummary{}
+	if len(msgIDs) == 0 {
+		return out, nil
+	}
+	rows, err := pool.Query(r.Context(), `
+		select message_id::text, emoji, count(*), bool_or(user_id = $2)
+		from chat_message_reactions
+		where message_id = any($1::uuid[])
+		group by message_id, emoji
+		order by message_id, min(created_at)`,
+		msgIDs, userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			msgID string
+			s     reactionSummary
+		)
+		if err := rows.Scan(&msgID, &s.Emoji, &s.Count, &s.ReactedByMe); err != nil {
+			return nil, err
+		}
+		out[msgID] = append(out[msgID], s)
+	}
+	return out, rows.Err()
+}
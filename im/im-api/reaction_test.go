@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestNormalizeEmoji(t *testing.T) {
+	valid := []string{"👍", " ❤️ ", "👍🏽", "👨‍👩‍👧", "1️⃣", "#⃣", "*️⃣"}
+	for _, in := range valid {
+		if _, err := normalizeEmoji(in); err != nil {
+			t.Errorf("normalizeEmoji(%q) = %v", in, err)
+		}
+	}
+	invalid := []string{"", "a", "ok", "1", "1️", "a⃣", "👍 👍", "👍👍👍👍👍👍👍👍👍"}
+	for _, in := range invalid {
+		if _, err := normalizeEmoji(in); err == nil {
+			t.Errorf("normalizeEmoji(%q) accepted", in)
+		}
+	}
+}
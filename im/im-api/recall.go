@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"terravoy/im/imkit/storage"
+)
+
+// handleRecallMessage lets the sender take back a message within the recall
+// window. The row keeps its seq slot but its content is tombstoned along with
+// its edit history, any media object is deleted from storage, and a recall
+// event is fanned out.
+func handleRecallMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, cfg Config, store storage.Storage) {
+	userID := ctxValue(r, ctxUserID)
+	msgID := chi.URLParam(r, "id")
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		threadID, senderID, msgType string
+		threadStatus                string
+		seq                         int64
+		content                     []byte
+		createdAt                   time.Time
+		recalledAt                  *time.Time
+	)
+	err = tx.QueryRow(ctx, `
+		select m.thread_id, m.sender_id, m.seq, m.type, m.content, m.created_at, m.recalled_at, t.status
+		from chat_messages m
+		join chat_threads t on t.id = m.thread_id
+		join chat_thread_members tm on tm.thread_id = m.thread_id and tm.user_id = $2
+		where m.id = $1
+		for update of m`,
+		msgID, userID,
+	).Scan(&threadID, &senderID, &seq, &msgType, &content, &createdAt, &recalledAt, &threadStatus)
+	if err != nil {
+		writeError(w, r, http.StatusNotFound, "NOT_FOUND", "message not found")
+		return
+	}
+	if senderID != userID {
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "only the sender can recall")
+		return
+	}
+	if recalledAt != nil {
+		_ = tx.Commit(ctx)
+		writeJSON(w, r, http.StatusOK, map[string]any{
+			"msg_id":      msgID,
+			"thread_id":   threadID,
+			"seq":         seq,
+			"recalled_at": recalledAt,
+		})
+		return
+	}
+	if threadStatus != threadStatusActive {
+		writeError(w, r, http.StatusConflict, "THREAD_INACTIVE", "thread not active")
+		return
+	}
+	if !isRecallableType(msgType) {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "message type cannot be recalled")
+		return
+	}
+	if window := time.Duration(cfg.RecallWindowSecs) * time.Second; window > 0 && time.Since(createdAt) > window {
+		writeError(w, r, http.StatusConflict, "RECALL_WINDOW_EXPIRED", "recall window expired")
+		return
+	}
+	changeSeq, err := allocChangeSeq(ctx, tx, threadID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	var at time.Time
+	err = tx.QueryRow(ctx, `
+		update chat_messages
+		set content = '{}'::jsonb,
+		    recalled_at = now(),
+		    recalled_by = $2,
+		    change_seq = $3
+		where id = $1
+		returning recalled_at`,
+		msgID, userID, changeSeq,
+	).Scan(&at)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	// Earlier versions would otherwise survive in prev_content.
+	if _, err := tx.Exec(ctx, `delete from chat_message_edits where message_id = $1`, msgID); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if _, isMedia := cfg.Attachments[msgType]; isMedia {
+		deleteRecalledMedia(ctx, store, msgID, content)
+	}
+	publishThreadEvent(ctx, redisClient, threadID, "recall", map[string]any{
+		"msg_id":      msgID,
+		"seq":         seq,
+		"recalled_by": userID,
+		"recalled_at": at,
+		"change_seq":  changeSeq,
+	})
+	log.Info().
+		Str("trace_id", ctxValue(r, ctxTraceID)).
+		Str("user_id", userID).
+		Str("thread_id", threadID).
+		Str("msg_id", msgID).
+		Int64("seq", seq).
+		Msg("message recalled")
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"msg_id":      msgID,
+		"thread_id":   threadID,
+		"seq":         seq,
+		"recalled_at": at,
+		"change_seq":  changeSeq,
+	})
+}
+
+func isRecallableType(msgType string) bool {
+	switch msgType {
+	case "text", "image", "voice", "video", "file", msgTypeExperienceCard, msgTypeOrderCard, msgTypeTripCard:
+		return true
+	default:
+		return false
+	}
+}
+
+// deleteRecalledMedia removes the object referenced by recalled content,
+// along with its derived variants. The message is already tombstoned, so
+// failures are logged and left to the bucket lifecycle rule.
+func deleteRecalledMedia(ctx context.Context, store storage.Storage, msgID string, content []byte) {
+	var media struct {
+		ObjectKey string `json:"object_key"`
+		Variants  map[string]struct {
+			ObjectKey string `json:"object_key"`
+		} `json:"variants"`
+	}
+	if err := json.Unmarshal(content, &media); err != nil || media.ObjectKey == "" {
+		return
+	}
+	if store == nil {
+		log.Warn().Str("msg_id", msgID).Str("object_key", media.ObjectKey).Msg("recalled media not deleted: storage not configured")
+		return
+	}
+	keys := []string{media.ObjectKey}
+	for _, variant := range media.Variants {
+		if variant.ObjectKey != "" {
+			keys = append(keys, variant.ObjectKey)
+		}
+	}
+	for _, key := range keys {
+		if err := store.Delete(ctx, key); err != nil {
+			log.Warn().Err(err).Str("msg_id", msgID).Str("object_key", key).Msg("recalled media delete failed")
+		}
+	}
+}
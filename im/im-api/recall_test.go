@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRecallClearsEditHistoryDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	traveler, host := newUUID(), newUUID()
+	threadID := createTestThread(t, pool, "order", traveler, "traveler", host, "host")
+	var msgID string
+	err := pool.QueryRow(ctx, `
+		with bump as (update chat_threads set last_seq = 1 where id = $1)
+		insert into chat_messages (thread_id, sender_id, client_msg_id, seq, type, content)
+		values ($1, $2, gen_random_uuid(), 1, 'text', '{"text":"first draft"}')
+		returning id`,
+		threadID, traveler,
+	).Scan(&msgID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := Config{}
+	edit := func(w http.ResponseWriter, r *http.Request) { handleEditMessage(w, r, pool, nil, cfg) }
+	recall := func(w http.ResponseWriter, r *http.Request) { handleRecallMessage(w, r, pool, nil, cfg, nil) }
+
+	var edited map[string]any
+	serveJSON(t, edit, testRequest(http.MethodPatch, "/", `{"content":{"text":"second draft"}}`, traveler, "id", msgID), &edited)
+	var recalled map[string]any
+	serveJSON(t, recall, testRequest(http.MethodPost, "/", "", traveler, "id", msgID), &recalled)
+
+	var (
+		edits   int
+		content string
+	)
+	err = pool.QueryRow(ctx, `
+		select (select count(*) from chat_message_edits where message_id = $1), content::text
+		from chat_messages where id = $1`,
+		msgID,
+	).Scan(&edits, &content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if edits != 0 || content != "{}" {
+		t.Errorf("after recall: %d edit rows, content %s", edits, content)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const replySnippetMaxRunes = 80
+
+var (
+	errReplyNotFound = errors.New("reply target not found")
+	errReplyRecalled = errors.New("reply target recalled")
+)
+
+// replyRef is the quoted message carried by replies, rendered server-side so
+// clients need not have the original cached.
+type replyRef struct {
+	MsgID       string `json:"msg_id"`
+	Seq         int64  `json:"seq,omitempty"`
+	SenderID    string `json:"sender_id,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Snippet     string `json:"snippet"`
+	Recalled    bool   `json:"recalled"`
+	Unavailable bool   `json:"unavailable,omitempty"`
+}
+
+// replySnippet renders the quoted message the same way as push previews,
+// truncated to replySnippetMaxRunes.
+func replySnippet(msgType string, content json.RawMessage) string {
+	text := []rune(buildPushPreview(msgType, content))
+	if len(text) > replySnippetMaxRunes {
+		return string(text[:replySnippetMaxRunes]) + "…"
+	}
+	return string(text)
+}
+
+// newReplyRef builds the reply_to payload from the (nullable) columns of the
+// quoted message. A missing row means it aged out or never existed.
+func newReplyRef(msgID string, seq *int64, senderID, msgType *string, content []byte, recalledAt *time.Time) *replyRef {
+	ref := &replyRef{MsgID: msgID}
+	if seq == nil {
+		ref.Unavailable = true
+		return ref
+	}
+	ref.Seq = *seq
+	ref.SenderID = *senderID
+	ref.Type = *msgType
+	ref.Recalled = recalledAt != nil
+	if !ref.Recalled {
+		ref.Snippet = replySnippet(*msgType, content)
+	}
+	return ref
+}
+
+// loadReplyTarget validates a reply target inside the sending transaction:
+// it must be a message of the same thread that userID can see (within
+// retention and at or after their visible_from_seq) and not recalled.
+func loadReplyTarget(ctx context.Context, tx rowQuerier, userID, threadID, msgID string, cutoff time.Time) (*replyRef, error) {
+	var (
+		seq               int64
+		senderID, msgType string
+		content           []byte
+		recalledAt        *time.Time
+	)
+	if !isUUID(msgID) {
+		return nil, errReplyNotFound
+	}
+	err := tx.QueryRow(ctx, `
+		select m.seq, m.sender_id, m.type, m.content, m.recalled_at
+		from chat_messages m
+		join chat_thread_members tm on tm.thread_id = m.thread_id and tm.user_id = $4
+		where m.id = $1 and m.thread_id = $2 and m.created_at >= $3
+		  and m.seq >= tm.visible_from_seq`,
+		msgID, threadID, cutoff, userID,
+	).Scan(&seq, &senderID, &msgType, &content, &recalledAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errReplyNotFound
+		}
+		return nil, err
+	}
+	if recalledAt != nil {
+		return nil, errReplyRecalled
+	}
+	return newReplyRef(msgID, &seq, &senderID, &msgType, content, nil), nil
+}
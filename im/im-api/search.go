@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	searchMaxQueryRunes = 100
+	searchSnippetRunes  = 60
+)
+
+type searchHit struct {
+	MsgID      string        `json:"msg_id"`
+	ThreadID   string        `json:"thread_id"`
+	Seq        int64         `json:"seq"`
+	SenderID   string        `json:"sender_id"`
+	CreatedAt  time.Time     `json:"created_at"`
+	Snippet    string        `json:"snippet"`
+	Highlights []searchRange `json:"highlights"`
+}
+
+// searchRange is a highlighted span of the snippet, in characters (runes).
+type searchRange struct {
+	Start  int `json:"start"`
+	Length int `json:"length"`
+}
+
+// handleSearchMessages searches text messages in the caller's threads, or in
+// one thread with ?thread_id=. Matching uses im_search_tokens (see migration
+// 0044) and honors each thread's retention cutoff. Results are newest first;
+// pass next_cursor back as ?cursor= for the next page.
+func handleSearchMessages(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, cfg Config) {
+	userID := ctxValue(r, ctxUserID)
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" || utf8.RuneCountInString(q) > searchMaxQueryRunes {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "q required (max 100 characters)")
+		return
+	}
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "q has no searchable terms")
+		return
+	}
+	limit := clampInt(queryInt(r, "limit", 20), 1, 50)
+	threadID := strings.TrimSpace(r.URL.Query().Get("thread_id"))
+	var (
+		cursorAt time.Time
+		cursorID string
+	)
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		var ok bool
+		if cursorAt, cursorID, ok = decodeSearchCursor(c); !ok {
+			writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid cursor")
+			return
+		}
+	}
+
+	// Retention defaults per thread type, from the same helper as the
+	// single-thread reads.
+	retentionDays := make([]int, len(threadTypes))
+	for i, ttype := range threadTypes {
+		retentionDays[i] = defaultRetentionDays(ttype, cfg)
+	}
+	rows, err := pool.Query(r.Context(), `
+		select m.id, m.thread_id, m.seq, m.sender_id, m.created_at, m.content->>'text'
+		from chat_messages m
+		join chat_thread_members tm on tm.thread_id = m.thread_id and tm.user_id = $1
+		join chat_threads t on t.id = m.thread_id
+		where m.type = 'text'
+		  and m.recalled_at is null
+		  and m.seq >= tm.visible_from_seq
+		  and to_tsvector('simple', im_search_tokens(m.content->>'text')) @@ plainto_tsquery('simple', im_search_tokens($2))
+		  and m.created_at >= now() - make_interval(days => case
+		        when t.retention_days > 0 then t.retention_days
+		        else (select d.days from unnest($3::text[], $4::int[]) as d(type, days) where d.type = t.type) end)
+		  and ($5 = '' or m.thread_id::text = $5)
+		  and ($6::text = '' or (m.created_at, m.id::text) < ($7, $6::text))
+		order by m.created_at desc, m.id desc
+		limit $8`,
+		userID, q, threadTypes, retentionDays, threadID, cursorID, cursorAt, limit,
+	)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer rows.Close()
+	hits := []searchHit{}
+	for rows.Next() {
+		var (
+			h    searchHit
+			text string
+		)
+		if err := rows.Scan(&h.MsgID, &h.ThreadID, &h.Seq, &h.SenderID, &h.CreatedAt, &text); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+		h.Snippet, h.Highlights = highlightSnippet(text, terms)
+		hits = append(hits, h)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	response := map[string]any{"hits": hits}
+	if len(hits) == limit {
+		last := hits[len(hits)-1]
+		response["next_cursor"] = encodeSearchCursor(last.CreatedAt, last.MsgID)
+	}
+	writeJSON(w, r, http.StatusOK, response)
+}
+
+func encodeSearchCursor(at time.Time, msgID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(at.UTC().Format(time.RFC3339Nano) + "|" + msgID))
+}
+
+func decodeSearchCursor(cursor string) (time.Time, string, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	at, msgID, ok := strings.Cut(string(raw), "|")
+	if !ok || !isUUID(msgID) {
+		return time.Time{}, "", false
+	}
+	t, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return t, msgID, true
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// searchTerms splits a query into lowercased highlight terms: runs of
+// letters/digits, with CJK runs kept whole.
+func searchTerms(q string) [][]rune {
+	var (
+		terms [][]rune
+		cur   []rune
+		cjk   bool
+	)
+	flush := func() {
+		if len(cur) > 0 {
+			terms = append(terms, cur)
+			cur = nil
+		}
+	}
+	for _, r := range q {
+		switch {
+		case isCJK(r):
+			if !cjk {
+				flush()
+			}
+			cjk = true
+			cur = append(cur, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if cjk {
+				flush()
+			}
+			cjk = false
+			cur = append(cur, unicode.ToLower(r))
+		default:
+			flush()
+		}
+	}
+	flush()
+	return terms
+}
+
+// highlightSnippet cuts a window of text around the first matched term and
+// returns the ranges of all term occurrences inside it.
+func highlightSnippet(text string, terms [][]rune) (string, []searchRange) {
+	runes := []rune(text)
+	lower := make([]rune, len(runes))
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+	var matches []searchRange
+	for _, term := range terms {
+		for i := 0; i+len(term) <= len(lower); i++ {
+			if string(lower[i:i+len(term)]) == string(term) {
+				matches = append(matches, searchRange{Start: i, Length: len(term)})
+			}
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Start < matches[j].Start })
+	start := 0
+	if len(matches) > 0 {
+		start = max(0, matches[0].Start-searchSnippetRunes/4)
+	}
+	end := min(len(runes), start+searchSnippetRunes)
+	snippet := string(runes[start:end])
+	prefix := 0
+	if start > 0 {
+		snippet = "…" + snippet
+		prefix = 1
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	highlights := []searchRange{}
+	for _, m := range matches {
+		if m.Start >= start && m.Start+m.Length <= end {
+			highlights = append(highlights, searchRange{Start: m.Start - start + prefix, Length: m.Length})
+		}
+	}
+	return snippet, highlights
+}
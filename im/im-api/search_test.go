@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSearchTerms(t *testing.T) {
+	got := searchTerms("Hotel 地址, room-12")
+	want := []string{"hotel", "地址", "room", "12"}
+	if len(got) != len(want) {
+		t.Fatalf("terms = %q, want %q", got, want)
+	}
+	for i := range want {
+		if string(got[i]) != want[i] {
+			t.Fatalf("terms[%d] = %q, want %q", i, string(got[i]), want[i])
+		}
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	text := strings.Repeat("很长的前文", 10) + "酒店地址是人民路 1 号，Hotel 在地址旁边"
+	snippet, hl := highlightSnippet(text, searchTerms("地址 hotel"))
+	if !strings.HasPrefix(snippet, "…") || len(hl) != 3 {
+		t.Fatalf("snippet = %q, highlights = %+v", snippet, hl)
+	}
+	runes := []rune(snippet)
+	for i, want := range []string{"地址", "Hotel", "地址"} {
+		if got := string(runes[hl[i].Start : hl[i].Start+hl[i].Length]); got != want {
+			t.Fatalf("highlight %d = %q, want %q", i, got, want)
+		}
+	}
+}
+
+func TestDefaultRetentionDaysCoversSearchTypes(t *testing.T) {
+	cfg := Config{RetentionMatchDays: 30, RetentionOrderDays: 180, RetentionSupportDays: 365}
+	want := map[string]int{"match": 30, "order": 180, "support": 365}
+	for _, ttype := range threadTypes {
+		if w, ok := want[ttype]; ok && defaultRetentionDays(ttype, cfg) != w {
+			t.Fatalf("%s retention = %d, want %d", ttype, defaultRetentionDays(ttype, cfg), w)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Service messages are posted by backend services (the Node order service,
+// schedulers) rather than by a member. They are stored with systemSenderID so
+// clients can render them as system notices, and their client_msg_id is
+// derived from the caller's event key, so the (sender_id, client_msg_id)
+// unique index makes retries idempotent.
+const (
+	systemSenderID = "00000000-0000-0000-0000-000000000000"
+
+	serviceEventKeyMaxLen  = 200
+	serviceContentMaxBytes = 4096
+)
+
+var errEventKeyConflict = errors.New("event key already used in another thread")
+
+// serviceAuthMiddleware accepts `Authorization: Bearer <token>` where token is
+// one of the configured service tokens. Several tokens may be configured at
+// once so they can be rotated without downtime. User JWTs are never accepted.
+func serviceAuthMiddleware(tokens []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(tokens) == 0 {
+				writeError(w, r, http.StatusServiceUnavailable, "SERVICE_AUTH_DISABLED", "service token not configured")
+				return
+			}
+			parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+			if len(parts) != 2 || !strings.EqualFold(parts[0], "bearer") || parts[1] == "" {
+				writeError(w, r, http.StatusUnauthorized, "AUTH_REQUIRED", "missing service token")
+				return
+			}
+			if !matchServiceToken(tokens, parts[1]) {
+				writeError(w, r, http.StatusUnauthorized, "AUTH_INVALID", "invalid service token")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func matchServiceToken(tokens []string, presented string) bool {
+	ok := false
+	for _, token := range tokens {
+		if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(presented)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+// parseServiceTokens splits IM_SERVICE_TOKEN on commas.
+func parseServiceTokens(raw string) []string {
+	var tokens []string
+	for _, token := range strings.Split(raw, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// serviceClientMsgID maps an event key to a stable RFC 4122 v5-style UUID.
+func serviceClientMsgID(eventKey string) string {
+	sum := sha1.Sum([]byte("im-service-event:" + eventKey))
+	b := sum[:16]
+	b[6] = (b[6] & 0x0f) | 0x50
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// normalizeServiceContent checks service message content: system messages
+// need a non-empty text, order_event content is any JSON object.
+func normalizeServiceContent(msgType string, raw json.RawMessage) (json.RawMessage, error) {
+	if len(raw) > serviceContentMaxBytes {
+		return nil, fmt.Errorf("content exceeds %d bytes", serviceContentMaxBytes)
+	}
+	var body map[string]any
+	if err := json.Unmarshal(raw, &body); err != nil || body == nil {
+		return nil, errors.New("content must be a JSON object")
+	}
+	if msgType == "system" {
+		text, _ := body["text"].(string)
+		if strings.TrimSpace(text) == "" {
+			return nil, errors.New("system content requires text")
+		}
+	}
+	return json.Marshal(body)
+}
+
+// handleServiceMessage posts a system or order_event message into a thread
+// addressed by thread_id, order_id or match_session_id. Unlike member
+// messages it is not rate limited and may target frozen or closed threads,
+// so lifecycle notices can still be recorded.
+func handleServiceMessage(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	var payload struct {
+		ThreadID       string          `json:"thread_id"`
+		OrderID        string          `json:"order_id"`
+		MatchSessionID string          `json:"match_session_id"`
+		EventKey       string          `json:"event_key"`
+		Type           string          `json:"type"`
+		Content        json.RawMessage `json:"content"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	payload.EventKey = strings.TrimSpace(payload.EventKey)
+	if payload.EventKey == "" || len(payload.EventKey) > serviceEventKeyMaxLen {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "event_key required (max 200 bytes)")
+		return
+	}
+	if payload.Type != "system" && payload.Type != "order_event" {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "type must be system or order_event")
+		return
+	}
+	content, err := normalizeServiceContent(payload.Type, payload.Content)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_CONTENT", err.Error())
+		return
+	}
+	threadID, ok := resolveServiceThread(w, r, pool, payload.ThreadID, payload.OrderID, payload.MatchSessionID)
+	if !ok {
+		return
+	}
+	msg, err := insertServiceMessage(r.Context(), pool, threadID, payload.EventKey, payload.Type, content)
+	if errors.Is(err, errThreadNotFound) {
+		writeError(w, r, http.StatusNotFound, "THREAD_NOT_FOUND", err.Error())
+		return
+	}
+	if errors.Is(err, errEventKeyConflict) {
+		writeError(w, r, http.StatusConflict, "EVENT_KEY_CONFLICT", err.Error())
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Str("trace_id", ctxValue(r, ctxTraceID)).Str("event_key", payload.EventKey).Msg("service message write failed")
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if !msg.Duplicate {
+		fanoutServiceMessage(r.Context(), pool, redisClient, msg)
+		messagesWrittenTotal.Inc()
+		log.Info().
+			Str("trace_id", ctxValue(r, ctxTraceID)).
+			Str("thread_id", msg.ThreadID).
+			Str("msg_id", msg.MsgID).
+			Int64("seq", msg.Seq).
+			Str("event_key", payload.EventKey).
+			Msg("service message written")
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"thread_id":  msg.ThreadID,
+		"msg_id":     msg.MsgID,
+		"seq":        msg.Seq,
+		"created_at": msg.CreatedAt,
+		"duplicate":  msg.Duplicate,
+	})
+}
+
+type serviceMessage struct {
+	ThreadID    string
+	MsgID       string
+	ClientMsgID string
+	Seq         int64
+	Type        string
+	Content     json.RawMessage
+	CreatedAt   time.Time
+	Duplicate   bool
+}
+
+// insertServiceMessage writes a service message, or returns the one already
+// written for the same event key (Duplicate set).
+func insertServiceMessage(ctx context.Context, pool *pgxpool.Pool, threadID, eventKey, msgType string, content json.RawMessage) (*serviceMessage, error) {
+	msg := &serviceMessage{ClientMsgID: serviceClientMsgID(eventKey), Type: msgType, Content: content}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	// Lock the thread first: it serializes seq allocation and makes a
+	// concurrent retry of the same event wait for, then see, this insert.
+	err = tx.QueryRow(ctx, `select id from chat_threads where id = $1 for update`, threadID).Scan(&msg.ThreadID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errThreadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if done, err := loadServiceMessage(ctx, tx, msg); err != nil || done {
+		return msg, err
+	}
+	err = tx.QueryRow(ctx, `
+		update chat_threads
+		set last_seq = last_seq + 1,
+		    last_message_at = now(),
+		    updated_at = now()
+		where id = $1
+		returning last_seq`,
+		msg.ThreadID,
+	).Scan(&msg.Seq)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `
+		insert into chat_messages (thread_id, sender_id, client_msg_id, seq, type, content)
+		values ($1, $2, $3, $4, $5, $6)
+		returning id, created_at`,
+		msg.ThreadID, systemSenderID, msg.ClientMsgID, msg.Seq, msgType, content,
+	).Scan(&msg.MsgID, &msg.CreatedAt)
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			// The thread lock serializes retries on the same thread, so this
+			// is the same event key posted to another thread concurrently.
+			return nil, errEventKeyConflict
+		}
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// loadServiceMessage fills msg from an earlier write of the same event key. A
+// key already used in another thread is errEventKeyConflict, not a duplicate.
+func loadServiceMessage(ctx context.Context, tx pgx.Tx, msg *serviceMessage) (bool, error) {
+	var existingThread string
+	err := tx.QueryRow(ctx, `
+		select id, thread_id, seq, type, content, created_at
+		from chat_messages
+		where sender_id = $1 and client_msg_id = $2`,
+		systemSenderID, msg.ClientMsgID,
+	).Scan(&msg.MsgID, &existingThread, &msg.Seq, &msg.Type, &msg.Content, &msg.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if existingThread != msg.ThreadID {
+		return false, errEventKeyConflict
+	}
+	msg.Duplicate = true
+	return true, tx.Commit(ctx)
+}
+
+// fanoutServiceMessage delivers a new service message like a member message:
+// a "msg" frame to live subscribers and push jobs for offline members.
+func fanoutServiceMessage(ctx context.Context, pool *pgxpool.Pool, redisClient *redis.Client, msg *serviceMessage) {
+	publishThreadEvent(ctx, redisClient, msg.ThreadID, "msg", map[string]any{
+		"msg_id":        msg.MsgID,
+		"seq":           msg.Seq,
+		"created_at":    msg.CreatedAt.Format(time.RFC3339Nano),
+		"sender_id":     systemSenderID,
+		"msg_type":      msg.Type,
+		"content":       msg.Content,
+		"client_msg_id": msg.ClientMsgID,
+	})
+	enqueuePushJobs(ctx, pool, redisClient, msg.ThreadID, systemSenderID, msg.MsgID, msg.Seq, msg.Type, msg.Content, msg.CreatedAt)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServiceAuthMiddleware(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	cases := []struct {
+		name   string
+		tokens []string
+		header string
+		want   int
+	}{
+		{"not configured", nil, "Bearer anything", http.StatusServiceUnavailable},
+		{"missing", []string{"s1"}, "", http.StatusUnauthorized},
+		{"wrong", []string{"s1"}, "Bearer s2", http.StatusUnauthorized},
+		{"current", []string{"s1", "s2"}, "Bearer s1", http.StatusNoContent},
+		{"rotated", []string{"s1", "s2"}, "bearer s2", http.StatusNoContent},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodPost, "/internal/v1/messages", nil)
+		if tc.header != "" {
+			req.Header.Set("Authorization", tc.header)
+		}
+		rec := httptest.NewRecorder()
+		serviceAuthMiddleware(tc.tokens)(ok).ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: status = %d, want %d", tc.name, rec.Code, tc.want)
+		}
+	}
+	if got := parseServiceTokens(" s1, ,s2 "); len(got) != 2 || got[0] != "s1" || got[1] != "s2" {
+		t.Errorf("parseServiceTokens = %q", got)
+	}
+}
+
+func TestServiceClientMsgID(t *testing.T) {
+	a := serviceClientMsgID("order:42:paid")
+	if a != serviceClientMsgID("order:42:paid") {
+		t.Fatal("client_msg_id must be stable for an event key")
+	}
+	if a == serviceClientMsgID("order:42:cancelled") {
+		t.Fatal("different event keys must not collide")
+	}
+	if !isUUID(a) || a[14] != '5' {
+		t.Fatalf("%q is not a v5-style uuid", a)
+	}
+}
+
+func TestHandleServiceMessageValidation(t *testing.T) {
+	cases := []struct {
+		body string
+		code string
+	}{
+		{`{"event_key":"k","type":"system","content":{"text":"hi"}}`, "INVALID_REQUEST"},
+		{`{"thread_id":"t","order_id":"o","event_key":"k","type":"system","content":{"text":"hi"}}`, "INVALID_REQUEST"},
+		{`{"thread_id":"t","type":"system","content":{"text":"hi"}}`, "INVALID_REQUEST"},
+		{`{"thread_id":"t","event_key":"k","type":"text","content":{"text":"hi"}}`, "INVALID_REQUEST"},
+		{`{"thread_id":"t","event_key":"k","type":"system","content":{"text":" "}}`, "INVALID_CONTENT"},
+		{`{"thread_id":"t","event_key":"k","type":"order_event","content":[1]}`, "INVALID_CONTENT"},
+		{`{"thread_id":"t","event_key":"` + strings.Repeat("k", 201) + `","type":"system","content":{"text":"hi"}}`, "INVALID_REQUEST"},
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) { handleServiceMessage(w, r, nil, nil) }
+	for _, tc := range cases {
+		status, code := callHandler(handler, testRequest(http.MethodPost, "/internal/v1/messages", tc.body, ""))
+		if status != http.StatusBadRequest || code != tc.code {
+			t.Errorf("%s: got %d %s, want 400 %s", tc.body, status, code, tc.code)
+		}
+	}
+}
+
+func TestCreateMessageRejectsServiceTypes(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		handleCreateMessage(w, r, nil, nil, nil, nil, Config{}, nil)
+	}
+	for _, msgType := range []string{"system", "order_event"} {
+		body := `{"thread_id":"t","client_msg_id":"c","type":"` + msgType + `","content":{"text":"hi"}}`
+		status, code := callHandler(handler, testRequest(http.MethodPost, "/v1/messages", body, ""))
+		if status != http.StatusBadRequest || code != "INVALID_REQUEST" {
+			t.Errorf("%s: got %d %s, want 400 INVALID_REQUEST", msgType, status, code)
+		}
+	}
+}
+
+func TestSystemPushPreview(t *testing.T) {
+	if got := buildPushPreview("system", json.RawMessage(`{"text":"订单已支付"}`)); got != "订单已支付" {
+		t.Errorf("preview = %q", got)
+	}
+}
+
+func TestServiceEventKeyReusedInOtherThreadDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	first := createTestThread(t, pool, "order", newUUID(), "traveler")
+	second := createTestThread(t, pool, "order", newUUID(), "traveler")
+	eventKey := "test:" + newUUID()
+	content := json.RawMessage(`{"text":"paid"}`)
+
+	if _, err := insertServiceMessage(ctx, pool, first, eventKey, "system", content); err != nil {
+		t.Fatal(err)
+	}
+	again, err := insertServiceMessage(ctx, pool, first, eventKey, "system", content)
+	if err != nil || !again.Duplicate {
+		t.Fatalf("retry in same thread: %+v, %v", again, err)
+	}
+	if _, err := insertServiceMessage(ctx, pool, second, eventKey, "system", content); !errors.Is(err, errEventKeyConflict) {
+		t.Fatalf("other thread: err = %v, want errEventKeyConflict", err)
+	}
+}
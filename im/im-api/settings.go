@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Per-member thread settings live on chat_thread_members and only affect
+// the member who set them: list order/filtering and whether they get pushed.
+const (
+	notifyAll      = "all"
+	notifyMentions = "mentions"
+	notifyNone     = "none"
+)
+
+type threadSettings struct {
+	Muted       bool       `json:"muted"`
+	MutedUntil  *time.Time `json:"muted_until"`
+	Pinned      bool       `json:"pinned"`
+	PinnedAt    *time.Time `json:"pinned_at"`
+	Archived    bool       `json:"archived"`
+	ArchivedAt  *time.Time `json:"archived_at"`
+	NotifyLevel string     `json:"notify_level"`
+}
+
+func newThreadSettings(mutedUntil, pinnedAt, archivedAt *time.Time, notifyLevel string, now time.Time) threadSettings {
+	return threadSettings{
+		Muted:       mutedUntil != nil && mutedUntil.After(now),
+		MutedUntil:  mutedUntil,
+		Pinned:      pinnedAt != nil,
+		PinnedAt:    pinnedAt,
+		Archived:    archivedAt != nil,
+		ArchivedAt:  archivedAt,
+		NotifyLevel: notifyLevel,
+	}
+}
+
+func validNotifyLevel(level string) bool {
+	return level == notifyAll || level == notifyMentions || level == notifyNone
+}
+
+// shouldPush decides whether a member gets an offline push for a message.
+// Muted members get nothing; "mentions" only pushes messages that list the
+// member in content.mentions.
+func shouldPush(level string, muted bool, content json.RawMessage, userID string) bool {
+	if muted {
+		return false
+	}
+	switch level {
+	case notifyNone:
+		return false
+	case notifyMentions:
+		return mentionsUser(content, userID)
+	default:
+		return true
+	}
+}
+
+func mentionsUser(content json.RawMessage, userID string) bool {
+	var body struct {
+		Mentions []string `json:"mentions"`
+	}
+	if err := json.Unmarshal(content, &body); err != nil {
+		return false
+	}
+	for _, id := range body.Mentions {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// archivedFilter maps ?archived= on the thread list to a condition on the
+// member row m: unarchived by default, "true" for the archive, "all" for both.
+func archivedFilter(v string) (string, bool) {
+	switch v {
+	case "", "false":
+		return "m.archived_at is null", true
+	case "true":
+		return "m.archived_at is not null", true
+	case "all":
+		return "", true
+	default:
+		return "", false
+	}
+}
+
+// handleThreadSettings serves GET and PATCH /v1/threads/{id}/settings. PATCH
+// takes any of {"muted_until": RFC3339 | null, "pinned", "archived",
+// "notify_level"}; omitted fields are left alone.
+func handleThreadSettings(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool) {
+	userID := ctxValue(r, ctxUserID)
+	threadID := chi.URLParam(r, "id")
+	var payload struct {
+		MutedUntil  json.RawMessage `json:"muted_until"`
+		Pinned      *bool           `json:"pinned"`
+		Archived    *bool           `json:"archived"`
+		NotifyLevel *string         `json:"notify_level"`
+	}
+	var (
+		setMute    bool
+		mutedUntil *time.Time
+	)
+	if r.Method == http.MethodPatch {
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+			return
+		}
+		if payload.MutedUntil != nil {
+			setMute = true
+			if !bytes.Equal(payload.MutedUntil, []byte("null")) {
+				var ts time.Time
+				if err := json.Unmarshal(payload.MutedUntil, &ts); err != nil {
+					writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "muted_until must be an RFC3339 time or null")
+					return
+				}
+				mutedUntil = &ts
+			}
+		}
+		if payload.NotifyLevel != nil && !validNotifyLevel(*payload.NotifyLevel) {
+			writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "notify_level must be all, mentions or none")
+			return
+		}
+	}
+	if !isUUID(threadID) {
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "not a member")
+		return
+	}
+	var (
+		mu, pinnedAt, archivedAt *time.Time
+		level                    string
+		now                      time.Time
+	)
+	query, args := `
+		select muted_until, pinned_at, archived_at, notify_level, now()
+		from chat_thread_members
+		where thread_id = $1 and user_id = $2`, []any{threadID, userID}
+	if r.Method == http.MethodPatch {
+		query = `
+		update chat_thread_members
+		set muted_until = case when $3 then $4 else muted_until end,
+		    pinned_at = case
+		      when $5::boolean is null then pinned_at
+		      when $5 then coalesce(pinned_at, now())
+		      else null end,
+		    archived_at = case
+		      when $6::boolean is null then archived_at
+		      when $6 then coalesce(archived_at, now())
+		      else null end,
+		    notify_level = coalesce($7, notify_level)
+		where thread_id = $1 and user_id = $2
+		returning muted_until, pinned_at, archived_at, notify_level, now()`
+		args = append(args, setMute, mutedUntil, payload.Pinned, payload.Archived, payload.NotifyLevel)
+	}
+	err := pool.QueryRow(r.Context(), query, args...).Scan(&mu, &pinnedAt, &archivedAt, &level, &now)
+	if errors.Is(err, pgx.ErrNoRows) {
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "not a member")
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"thread_id": threadID,
+		"settings":  newThreadSettings(mu, pinnedAt, archivedAt, level, now),
+	})
+}
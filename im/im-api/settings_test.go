@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestShouldPush(t *testing.T) {
+	mention := json.RawMessage(`{"text":"@bob hi","mentions":["bob"]}`)
+	plain := json.RawMessage(`{"text":"hi"}`)
+	cases := []struct {
+		name    string
+		level   string
+		muted   bool
+		content json.RawMessage
+		want    bool
+	}{
+		{"all", notifyAll, false, plain, true},
+		{"muted", notifyAll, true, mention, false},
+		{"none", notifyNone, false, mention, false},
+		{"mentions hit", notifyMentions, false, mention, true},
+		{"mentions miss", notifyMentions, false, plain, false},
+	}
+	for _, tc := range cases {
+		if got := shouldPush(tc.level, tc.muted, tc.content, "bob"); got != tc.want {
+			t.Errorf("%s: shouldPush = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestNewThreadSettings(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	past, future := now.Add(-time.Minute), now.Add(time.Hour)
+	if s := newThreadSettings(&past, nil, nil, notifyAll, now); s.Muted || s.Pinned || s.Archived {
+		t.Errorf("expired mute reported: %+v", s)
+	}
+	if s := newThreadSettings(&future, &past, &past, notifyNone, now); !s.Muted || !s.Pinned || !s.Archived {
+		t.Errorf("settings = %+v", s)
+	}
+}
+
+func TestArchivedFilter(t *testing.T) {
+	for v, want := range map[string]string{"": "m.archived_at is null", "true": "m.archived_at is not null", "all": ""} {
+		if got, ok := archivedFilter(v); !ok || got != want {
+			t.Errorf("archivedFilter(%q) = %q, %v", v, got, ok)
+		}
+	}
+	if _, ok := archivedFilter("yes"); ok {
+		t.Error("unknown archived filter accepted")
+	}
+}
+
+func TestThreadSettingsValidation(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) { handleThreadSettings(w, r, nil) }
+	for _, body := range []string{`{"muted_until":"tomorrow"}`, `{"notify_level":"loud"}`, `not json`} {
+		if status, _ := callHandler(handler, testRequest(http.MethodPatch, "/", body, "")); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", body, status)
+		}
+	}
+}
+
+func TestThreadSettingsDB(t *testing.T) {
+	pool := testPool(t)
+	traveler, host := newUUID(), newUUID()
+	threadID := createTestThread(t, pool, "order", traveler, "traveler", host, "host")
+	handler := func(w http.ResponseWriter, r *http.Request) { handleThreadSettings(w, r, pool) }
+	patch := func(body string) threadSettings {
+		t.Helper()
+		var resp struct {
+			Settings threadSettings `json:"settings"`
+		}
+		serveJSON(t, handler, testRequest(http.MethodPatch, "/", body, traveler, "id", threadID), &resp)
+		return resp.Settings
+	}
+
+	until := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	s := patch(`{"muted_until":"` + until + `","pinned":true,"notify_level":"mentions"}`)
+	if !s.Muted || !s.Pinned || s.Archived || s.NotifyLevel != notifyMentions {
+		t.Fatalf("first patch = %+v", s)
+	}
+	pinnedAt := s.PinnedAt
+
+	// Omitted fields keep their values, and pinning again keeps pinned_at.
+	s = patch(`{"archived":true,"pinned":true}`)
+	if !s.Muted || !s.Archived || s.NotifyLevel != notifyMentions || s.PinnedAt == nil || !s.PinnedAt.Equal(*pinnedAt) {
+		t.Errorf("second patch = %+v, pinned_at was %v", s, pinnedAt)
+	}
+	s = patch(`{"muted_until":null,"pinned":false,"archived":false}`)
+	if s.Muted || s.MutedUntil != nil || s.Pinned || s.Archived || s.NotifyLevel != notifyMentions {
+		t.Errorf("clearing patch = %+v", s)
+	}
+
+	var got struct {
+		Settings threadSettings `json:"settings"`
+	}
+	serveJSON(t, handler, testRequest(http.MethodGet, "/", "", traveler, "id", threadID), &got)
+	if got.Settings != s {
+		t.Errorf("GET = %+v, want %+v", got.Settings, s)
+	}
+	if status, code := callHandler(handler, testRequest(http.MethodPatch, "/", `{}`, newUUID(), "id", threadID)); status != http.StatusForbidden || code != "FORBIDDEN" {
+		t.Errorf("non-member: %d %s, want 403 FORBIDDEN", status, code)
+	}
+}
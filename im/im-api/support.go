@@ -0,0 +1,609 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Support threads connect one user (role customer) with the CS team. The
+// team is a pool of agents in im_support_agents; a thread is assigned to at
+// most one agent at a time, who is a member with role support_agent. Being a
+// member gives the agent the whole history, so a thread can move between
+// agents without losing context; an agent that hands a thread over stops
+// being a member and loses access.
+const (
+	roleCustomer     = "customer"
+	roleSupportAgent = "support_agent"
+
+	supportQueueMaxLimit = 100
+)
+
+var (
+	errNotSupportThread    = errors.New("not a support thread")
+	errAgentUnavailable    = errors.New("agent not found or inactive")
+	errAssignmentConflict  = errors.New("thread assignment changed")
+	errNotAssignedAgent    = errors.New("thread is not assigned to you")
+	errSupportThreadClosed = errors.New("support thread closed")
+	errAgentAtCapacity     = errors.New("agent has reached max_active_threads")
+)
+
+type supportAssignment struct {
+	ThreadID        string
+	AgentID         string
+	AgentName       string
+	PreviousAgentID string
+	Actor           statusActor
+	AssignedAt      time.Time
+	Changed         bool
+	Notice          *serviceMessage
+}
+
+// isSupportAgent reports whether userID is an active agent in the pool.
+func isSupportAgent(ctx context.Context, pool *pgxpool.Pool, userID string) (bool, error) {
+	var ok bool
+	err := pool.QueryRow(ctx, `
+		select exists(select 1 from im_support_agents where user_id = $1 and active)`,
+		userID,
+	).Scan(&ok)
+	return ok, err
+}
+
+func supportAssignmentNotice(agentName, previousAgentID, agentID string) string {
+	switch {
+	case agentID == "":
+		return "会话已转回客服队列"
+	case previousAgentID == "":
+		return "客服" + agentName + "为您服务"
+	default:
+		return "会话已转接给客服" + agentName
+	}
+}
+
+// assignSupportAgent hands a support thread to agentID ("" returns it to the
+// queue). When expectFrom is set the current assignee must match it, which
+// lets claim and transfer fail cleanly if someone else got there first.
+func assignSupportAgent(ctx context.Context, pool *pgxpool.Pool, threadID, agentID string, expectFrom *string, actor statusActor) (*supportAssignment, error) {
+	a := &supportAssignment{ThreadID: threadID, AgentID: agentID, Actor: actor}
+	if !isUUID(threadID) {
+		return nil, errThreadNotFound
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var (
+		ttype, status string
+		current       *string
+	)
+	err = tx.QueryRow(ctx, `
+		select type, status, assigned_agent_id::text
+		from chat_threads
+		where id = $1
+		for update`,
+		threadID,
+	).Scan(&ttype, &status, &current)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errThreadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ttype != "support" {
+		return nil, errNotSupportThread
+	}
+	if current != nil {
+		a.PreviousAgentID = *current
+	}
+	if expectFrom != nil && *expectFrom != a.PreviousAgentID {
+		return nil, errAssignmentConflict
+	}
+	if agentID == a.PreviousAgentID {
+		return a, tx.Commit(ctx)
+	}
+	if agentID != "" && status == threadStatusClosed {
+		return nil, errSupportThreadClosed
+	}
+	if agentID != "" {
+		// Locking the agent row serializes assignments to the same agent, so
+		// the open-thread count can't be raced past max_active_threads.
+		var maxThreads, open int
+		err = tx.QueryRow(ctx, `
+			select display_name, max_active_threads from im_support_agents
+			where user_id = $1 and active
+			for update`,
+			agentID,
+		).Scan(&a.AgentName, &maxThreads)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, errAgentUnavailable
+		}
+		if err != nil {
+			return nil, err
+		}
+		err = tx.QueryRow(ctx, `
+			select count(*) from chat_threads
+			where assigned_agent_id = $1 and type = 'support' and status <> 'closed'`,
+			agentID,
+		).Scan(&open)
+		if err != nil {
+			return nil, err
+		}
+		if open >= maxThreads {
+			return nil, errAgentAtCapacity
+		}
+	}
+	if a.PreviousAgentID != "" {
+		_, err = tx.Exec(ctx, `
+			delete from chat_thread_members
+			where thread_id = $1 and user_id = $2 and role = $3`,
+			threadID, a.PreviousAgentID, roleSupportAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if agentID != "" {
+		_, err = tx.Exec(ctx, `
+			insert into chat_thread_members (thread_id, user_id, role)
+			values ($1, $2, $3)
+			on conflict do nothing`,
+			threadID, agentID, roleSupportAgent,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	notice, err := json.Marshal(map[string]any{
+		"text":              supportAssignmentNotice(a.AgentName, a.PreviousAgentID, agentID),
+		"event":             "support_assignment",
+		"agent_id":          agentID,
+		"agent_name":        a.AgentName,
+		"previous_agent_id": a.PreviousAgentID,
+	})
+	if err != nil {
+		return nil, err
+	}
+	msg := &serviceMessage{ThreadID: threadID, Type: "system", Content: notice}
+	err = tx.QueryRow(ctx, `
+		update chat_threads
+		set assigned_agent_id = nullif($2, '')::uuid,
+		    assigned_at = now(),
+		    last_seq = last_seq + 1,
+		    last_message_at = now(),
+		    updated_at = now()
+		where id = $1
+		returning last_seq, assigned_at`,
+		threadID, agentID,
+	).Scan(&msg.Seq, &a.AssignedAt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(ctx, `
+		insert into chat_support_assignments (thread_id, agent_id, previous_agent_id, actor_type, actor_id)
+		values ($1, nullif($2, '')::uuid, nullif($3, '')::uuid, $4, $5)`,
+		threadID, agentID, a.PreviousAgentID, actor.Type, actor.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `
+		insert into chat_messages (thread_id, sender_id, client_msg_id, seq, type, content)
+		values ($1, $2, gen_random_uuid(), $3, 'system', $4)
+		returning id, client_msg_id::text, created_at`,
+		threadID, systemSenderID, msg.Seq, notice,
+	).Scan(&msg.MsgID, &msg.ClientMsgID, &msg.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	a.Changed = true
+	a.Notice = msg
+	return a, nil
+}
+
+// publishSupportAssignment fans out the support_assignment event and notice.
+func publishSupportAssignment(ctx context.Context, pool *pgxpool.Pool, redisClient *redis.Client, a *supportAssignment) {
+	if !a.Changed {
+		return
+	}
+	// Gateways subscribe the new agent and drop the previous one.
+	publishThreadEvent(ctx, redisClient, a.ThreadID, "members_changed", memberChangePayload(supportMemberChange(a)))
+	publishThreadEvent(ctx, redisClient, a.ThreadID, "support_assignment", map[string]any{
+		"agent_id":          a.AgentID,
+		"agent_name":        a.AgentName,
+		"previous_agent_id": a.PreviousAgentID,
+		"actor":             a.Actor,
+		"assigned_at":       a.AssignedAt,
+		"seq":               a.Notice.Seq,
+	})
+	fanoutServiceMessage(ctx, pool, redisClient, a.Notice)
+}
+
+// supportMemberChange is the membership side of an assignment: the new agent
+// joins (unless the thread went back to the queue) and the previous one leaves.
+func supportMemberChange(a *supportAssignment) *memberChange {
+	change := &memberChange{
+		ThreadID: a.ThreadID,
+		Kind:     "support_assignment",
+		ActorID:  a.Actor.ID,
+		Notice:   a.Notice,
+	}
+	if a.AgentID != "" {
+		change.Added = []groupMember{{UserID: a.AgentID, Role: roleSupportAgent}}
+	}
+	if a.PreviousAgentID != "" {
+		change.Removed = []string{a.PreviousAgentID}
+	}
+	return change
+}
+
+func supportAssignmentResponse(a *supportAssignment) map[string]any {
+	return map[string]any{
+		"thread_id":         a.ThreadID,
+		"agent_id":          a.AgentID,
+		"previous_agent_id": a.PreviousAgentID,
+		"changed":           a.Changed,
+	}
+}
+
+func writeSupportError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errThreadNotFound):
+		writeError(w, r, http.StatusNotFound, "THREAD_NOT_FOUND", err.Error())
+	case errors.Is(err, errNotSupportThread):
+		writeError(w, r, http.StatusBadRequest, "NOT_SUPPORT_THREAD", err.Error())
+	case errors.Is(err, errAgentUnavailable):
+		writeError(w, r, http.StatusBadRequest, "AGENT_UNAVAILABLE", err.Error())
+	case errors.Is(err, errAssignmentConflict):
+		writeError(w, r, http.StatusConflict, "ASSIGNMENT_CONFLICT", err.Error())
+	case errors.Is(err, errNotAssignedAgent):
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", err.Error())
+	case errors.Is(err, errSupportThreadClosed):
+		writeError(w, r, http.StatusConflict, "THREAD_INACTIVE", err.Error())
+	case errors.Is(err, errAgentAtCapacity):
+		writeError(w, r, http.StatusConflict, "AGENT_AT_CAPACITY", err.Error())
+	default:
+		log.Error().Err(err).Str("trace_id", ctxValue(r, ctxTraceID)).Msg("support assignment failed")
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+	}
+}
+
+// pickSupportAgent returns the active agent with the fewest open support
+// threads that is still under its limit, or "" when everyone is full.
+func pickSupportAgent(ctx context.Context, pool *pgxpool.Pool) (string, error) {
+	var agentID string
+	err := pool.QueryRow(ctx, `
+		select a.user_id::text
+		from im_support_agents a
+		left join chat_threads t
+		  on t.assigned_agent_id = a.user_id and t.type = 'support' and t.status <> 'closed'
+		where a.active
+		group by a.user_id, a.max_active_threads
+		having count(t.id) < a.max_active_threads
+		order by count(t.id), random()
+		limit 1`,
+	).Scan(&agentID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil
+	}
+	return agentID, err
+}
+
+// handleEnsureSupportThread is POST /v1/support/thread: returns the caller's
+// support thread, creating it (or reopening a closed one) as needed, and
+// assigns an agent when IM_SUPPORT_AUTO_ASSIGN is on and one is free.
+func handleEnsureSupportThread(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, cfg Config) {
+	userID := ctxValue(r, ctxUserID)
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var (
+		threadID, status string
+		assignedAgent    *string
+	)
+	err = tx.QueryRow(ctx, `
+		insert into chat_threads (type, support_user_id, retention_days, sync_policy)
+		values ('support', $1, $2, 'local_first')
+		on conflict (support_user_id) where type = 'support'
+		do update set updated_at = now()
+		returning id, status, assigned_agent_id::text`,
+		userID, cfg.RetentionSupportDays,
+	).Scan(&threadID, &status, &assignedAgent)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	_, err = tx.Exec(ctx, `
+		insert into chat_thread_members (thread_id, user_id, role)
+		values ($1, $2, $3)
+		on conflict do nothing`,
+		threadID, userID, roleCustomer,
+	)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	if status == threadStatusClosed {
+		change, err := changeThreadStatus(ctx, pool, threadID, threadStatusActive, "", statusActor{Type: actorTypeUser, ID: userID})
+		if err != nil {
+			writeStatusChangeError(w, r, err)
+			return
+		}
+		publishStatusChange(ctx, pool, redisClient, change)
+		status = threadStatusActive
+	}
+	agentID := ""
+	if assignedAgent != nil {
+		agentID = *assignedAgent
+	}
+	if agentID == "" && cfg.SupportAutoAssign && status == threadStatusActive {
+		if picked, err := pickSupportAgent(ctx, pool); err != nil {
+			log.Warn().Err(err).Str("thread_id", threadID).Msg("support agent pick failed")
+		} else if picked != "" {
+			none := ""
+			a, err := assignSupportAgent(ctx, pool, threadID, picked, &none, statusActor{Type: actorTypeSystem, ID: "auto_assign"})
+			if err == nil {
+				publishSupportAssignment(ctx, pool, redisClient, a)
+				agentID = a.AgentID
+			} else if !errors.Is(err, errAssignmentConflict) && !errors.Is(err, errAgentAtCapacity) {
+				log.Warn().Err(err).Str("thread_id", threadID).Msg("support auto-assign failed")
+			}
+		}
+	}
+	var lastSeq int64
+	var lastAt *time.Time
+	_ = pool.QueryRow(ctx, `select last_seq, last_message_at from chat_threads where id = $1`, threadID).Scan(&lastSeq, &lastAt)
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"thread_id":         threadID,
+		"type":              "support",
+		"status":            status,
+		"assigned_agent_id": nullableString(agentID),
+		"last_seq":          lastSeq,
+		"last_message_at":   lastAt,
+	})
+}
+
+func nullableString(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// requireSupportAgent writes 403 unless the caller is an active agent.
+func requireSupportAgent(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool) (string, bool) {
+	userID := ctxValue(r, ctxUserID)
+	ok, err := isSupportAgent(r.Context(), pool, userID)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return "", false
+	}
+	if !ok {
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "not a support agent")
+		return "", false
+	}
+	return userID, true
+}
+
+// handleSupportQueue is GET /v1/support/queue?scope=unassigned|mine for
+// agents: open support threads, longest waiting first.
+func handleSupportQueue(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool) {
+	agentID, ok := requireSupportAgent(w, r, pool)
+	if !ok {
+		return
+	}
+	limit := clampInt(queryInt(r, "limit", 50), 1, supportQueueMaxLimit)
+	scope := r.URL.Query().Get("scope")
+	cond := "t.assigned_agent_id is null"
+	args := []any{limit}
+	switch scope {
+	case "", "unassigned":
+		scope = "unassigned"
+	case "mine":
+		cond = "t.assigned_agent_id = $2"
+		args = append(args, agentID)
+	default:
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "scope must be unassigned or mine")
+		return
+	}
+	rows, err := pool.Query(r.Context(), `
+		select t.id, t.status, t.support_user_id::text, t.assigned_agent_id::text, t.assigned_at,
+		       t.last_seq, t.last_message_at, t.created_at
+		from chat_threads t
+		where t.type = 'support' and t.status <> 'closed' and `+cond+`
+		order by coalesce(t.last_message_at, t.created_at)
+		limit $1`,
+		args...,
+	)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	defer rows.Close()
+	threads := []map[string]any{}
+	for rows.Next() {
+		var (
+			id, status, customer string
+			assigned             *string
+			assignedAt, lastAt   *time.Time
+			createdAt            time.Time
+			lastSeq              int64
+		)
+		if err := rows.Scan(&id, &status, &customer, &assigned, &assignedAt, &lastSeq, &lastAt, &createdAt); err != nil {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return
+		}
+		threads = append(threads, map[string]any{
+			"thread_id":         id,
+			"status":            status,
+			"support_user_id":   customer,
+			"assigned_agent_id": assigned,
+			"assigned_at":       assignedAt,
+			"last_seq":          lastSeq,
+			"last_message_at":   lastAt,
+			"created_at":        createdAt,
+		})
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{"scope": scope, "threads": threads})
+}
+
+// handleSupportClaim is POST /v1/support/threads/{id}/claim: an agent takes
+// an unassigned thread.
+func handleSupportClaim(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	agentID, ok := requireSupportAgent(w, r, pool)
+	if !ok {
+		return
+	}
+	none := ""
+	a, err := assignSupportAgent(r.Context(), pool, chi.URLParam(r, "id"), agentID, &none, statusActor{Type: actorTypeUser, ID: agentID})
+	if errors.Is(err, errAssignmentConflict) {
+		writeError(w, r, http.StatusConflict, "ALREADY_ASSIGNED", "thread already assigned")
+		return
+	}
+	if err != nil {
+		writeSupportError(w, r, err)
+		return
+	}
+	publishSupportAssignment(r.Context(), pool, redisClient, a)
+	writeJSON(w, r, http.StatusOK, supportAssignmentResponse(a))
+}
+
+// handleSupportTransfer is POST /v1/support/threads/{id}/transfer with
+// {"agent_id"}: the assigned agent hands the thread to another agent, or back
+// to the queue with an empty agent_id.
+func handleSupportTransfer(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	agentID, ok := requireSupportAgent(w, r, pool)
+	if !ok {
+		return
+	}
+	var payload struct {
+		AgentID string `json:"agent_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	payload.AgentID = strings.TrimSpace(payload.AgentID)
+	if payload.AgentID != "" && !isUUID(payload.AgentID) {
+		writeError(w, r, http.StatusBadRequest, "AGENT_UNAVAILABLE", errAgentUnavailable.Error())
+		return
+	}
+	a, err := assignSupportAgent(r.Context(), pool, chi.URLParam(r, "id"), payload.AgentID, &agentID, statusActor{Type: actorTypeUser, ID: agentID})
+	if errors.Is(err, errAssignmentConflict) {
+		err = errNotAssignedAgent
+	}
+	if err != nil {
+		writeSupportError(w, r, err)
+		return
+	}
+	publishSupportAssignment(r.Context(), pool, redisClient, a)
+	writeJSON(w, r, http.StatusOK, supportAssignmentResponse(a))
+}
+
+// handleServiceSupportAssign is POST /internal/v1/support/threads/{id}/assign
+// with {"agent_id", "actor"}: assigns regardless of the current assignee.
+func handleServiceSupportAssign(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	var payload struct {
+		AgentID string `json:"agent_id"`
+		Actor   string `json:"actor"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	threadID := chi.URLParam(r, "id")
+	if payload.AgentID != "" && !isUUID(payload.AgentID) {
+		writeError(w, r, http.StatusBadRequest, "AGENT_UNAVAILABLE", errAgentUnavailable.Error())
+		return
+	}
+	actor := statusActor{Type: actorTypeService, ID: strings.TrimSpace(payload.Actor)}
+	if actor.ID == "" {
+		actor.ID = "service"
+	}
+	a, err := assignSupportAgent(r.Context(), pool, threadID, payload.AgentID, nil, actor)
+	if err != nil {
+		writeSupportError(w, r, err)
+		return
+	}
+	publishSupportAssignment(r.Context(), pool, redisClient, a)
+	writeJSON(w, r, http.StatusOK, supportAssignmentResponse(a))
+}
+
+// handleServiceSupportAgent is PUT /internal/v1/support/agents/{user_id} with
+// {"display_name", "active", "max_active_threads"}: adds or updates an agent
+// in the pool. Omitted fields keep their current value (or the column default
+// for a new agent). Deactivating an agent keeps their current assignments.
+func handleServiceSupportAgent(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool) {
+	userID := chi.URLParam(r, "user_id")
+	if !isUUID(userID) {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "user_id must be a uuid")
+		return
+	}
+	var payload struct {
+		DisplayName      *string `json:"display_name"`
+		Active           *bool   `json:"active"`
+		MaxActiveThreads *int    `json:"max_active_threads"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	if payload.MaxActiveThreads != nil && *payload.MaxActiveThreads < 0 {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "max_active_threads must be >= 0")
+		return
+	}
+	if payload.DisplayName != nil {
+		name := truncateRunes(strings.TrimSpace(*payload.DisplayName), 50)
+		payload.DisplayName = &name
+	}
+	var (
+		name                 string
+		active               bool
+		maxThreads           int
+		createdAt, updatedAt time.Time
+	)
+	err := pool.QueryRow(r.Context(), `
+		insert into im_support_agents (user_id, display_name, active, max_active_threads)
+		values ($1, coalesce($2::text, ''), coalesce($3::boolean, true), coalesce($4::int, 20))
+		on conflict (user_id) do update
+		set display_name = coalesce($2::text, im_support_agents.display_name),
+		    active = coalesce($3::boolean, im_support_agents.active),
+		    max_active_threads = coalesce($4::int, im_support_agents.max_active_threads),
+		    updated_at = now()
+		returning display_name, active, max_active_threads, created_at, updated_at`,
+		userID, payload.DisplayName, payload.Active, payload.MaxActiveThreads,
+	).Scan(&name, &active, &maxThreads, &createdAt, &updatedAt)
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]any{
+		"user_id":            userID,
+		"display_name":       name,
+		"active":             active,
+		"max_active_threads": maxThreads,
+		"created_at":         createdAt,
+		"updated_at":         updatedAt,
+	})
+}
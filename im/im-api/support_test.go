@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestSupportAssignmentNotice(t *testing.T) {
+	cases := []struct {
+		name, previous, agent, want string
+	}{
+		{"小王", "", "a1", "客服小王为您服务"},
+		{"小李", "a1", "a2", "会话已转接给客服小李"},
+		{"", "a1", "", "会话已转回客服队列"},
+	}
+	for _, tc := range cases {
+		if got := supportAssignmentNotice(tc.name, tc.previous, tc.agent); got != tc.want {
+			t.Errorf("notice(%q, %q, %q) = %q, want %q", tc.name, tc.previous, tc.agent, got, tc.want)
+		}
+	}
+}
+
+func TestAssignSupportAgentRejectsBadThreadID(t *testing.T) {
+	_, err := assignSupportAgent(context.Background(), nil, "not-a-uuid", "", nil, statusActor{Type: actorTypeService, ID: "test"})
+	if !errors.Is(err, errThreadNotFound) {
+		t.Fatalf("err = %v, want errThreadNotFound", err)
+	}
+}
+
+func TestSupportMemberChange(t *testing.T) {
+	toQueue := supportMemberChange(&supportAssignment{ThreadID: "t", PreviousAgentID: "a1"})
+	if len(toQueue.Added) != 0 || len(toQueue.Removed) != 1 || toQueue.Removed[0] != "a1" {
+		t.Errorf("return to queue: added %v, removed %v", toQueue.Added, toQueue.Removed)
+	}
+	transfer := supportMemberChange(&supportAssignment{ThreadID: "t", AgentID: "a2", PreviousAgentID: "a1"})
+	if len(transfer.Added) != 1 || transfer.Added[0].UserID != "a2" || len(transfer.Removed) != 1 {
+		t.Errorf("transfer: added %v, removed %v", transfer.Added, transfer.Removed)
+	}
+}
+
+func TestServiceSupportHandlersValidation(t *testing.T) {
+	agent := func(w http.ResponseWriter, r *http.Request) { handleServiceSupportAgent(w, r, nil) }
+	assign := func(w http.ResponseWriter, r *http.Request) { handleServiceSupportAssign(w, r, nil, nil) }
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		userID  string
+		body    string
+		status  int
+	}{
+		{"agent without uuid", agent, "", `{}`, http.StatusBadRequest},
+		{"agent negative max", agent, "11111111-1111-4111-8111-111111111111", `{"max_active_threads":-1}`, http.StatusBadRequest},
+		{"assign bad agent", assign, "", `{"agent_id":"x"}`, http.StatusBadRequest},
+		{"assign bad thread", assign, "", `{"agent_id":""}`, http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		if status, _ := callHandler(tc.handler, testRequest(http.MethodPost, "/", tc.body, "", "user_id", tc.userID)); status != tc.status {
+			t.Errorf("%s: status = %d, want %d", tc.name, status, tc.status)
+		}
+	}
+}
+
+// putSupportAgent calls the agent upsert endpoint and removes the agent when
+// the test ends.
+func putSupportAgent(t *testing.T, pool *pgxpool.Pool, agentID, body string) map[string]any {
+	t.Helper()
+	t.Cleanup(func() {
+		_, _ = pool.Exec(context.Background(), `delete from im_support_agents where user_id = $1`, agentID)
+	})
+	var resp map[string]any
+	handler := func(w http.ResponseWriter, r *http.Request) { handleServiceSupportAgent(w, r, pool) }
+	serveJSON(t, handler, testRequest(http.MethodPut, "/", body, "", "user_id", agentID), &resp)
+	return resp
+}
+
+func TestServiceSupportAgentPartialUpdateDB(t *testing.T) {
+	pool := testPool(t)
+	agentID := newUUID()
+	putSupportAgent(t, pool, agentID, `{"display_name":"小王","max_active_threads":5}`)
+	resp := putSupportAgent(t, pool, agentID, `{"active":false}`)
+	if resp["display_name"] != "小王" || resp["active"] != false || resp["max_active_threads"] != float64(5) {
+		t.Errorf("after deactivate: %v", resp)
+	}
+	resp = putSupportAgent(t, pool, newUUID(), `{}`)
+	if resp["display_name"] != "" || resp["active"] != true || resp["max_active_threads"] != float64(20) {
+		t.Errorf("new agent defaults: %v", resp)
+	}
+}
+
+func TestAssignSupportAgentDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	agent1, agent2 := newUUID(), newUUID()
+	putSupportAgent(t, pool, agent1, `{"display_name":"小王"}`)
+	putSupportAgent(t, pool, agent2, `{"display_name":"小李","max_active_threads":1}`)
+	customer := newUUID()
+	threadID := createTestThread(t, pool, "support", customer, roleCustomer)
+	actor := statusActor{Type: actorTypeService, ID: "test"}
+	none := ""
+
+	a, err := assignSupportAgent(ctx, pool, threadID, agent1, &none, actor)
+	if err != nil || !a.Changed || a.AgentName != "小王" || a.Notice == nil {
+		t.Fatalf("claim = %+v, %v", a, err)
+	}
+	if _, err := assignSupportAgent(ctx, pool, threadID, agent2, &none, actor); !errors.Is(err, errAssignmentConflict) {
+		t.Fatalf("second claim: %v, want errAssignmentConflict", err)
+	}
+	if a, err = assignSupportAgent(ctx, pool, threadID, agent2, &agent1, actor); err != nil || a.PreviousAgentID != agent1 {
+		t.Fatalf("transfer = %+v, %v", a, err)
+	}
+	roles := map[string]string{}
+	rows, err := pool.Query(ctx, `select user_id::text, role from chat_thread_members where thread_id = $1`, threadID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var userID, role string
+		if err := rows.Scan(&userID, &role); err != nil {
+			t.Fatal(err)
+		}
+		roles[userID] = role
+	}
+	rows.Close()
+	if len(roles) != 2 || roles[customer] != roleCustomer || roles[agent2] != roleSupportAgent {
+		t.Errorf("members after transfer = %v", roles)
+	}
+
+	// agent2 is at max_active_threads (1) now.
+	other := createTestThread(t, pool, "support", newUUID(), roleCustomer)
+	if _, err := assignSupportAgent(ctx, pool, other, agent2, &none, actor); !errors.Is(err, errAgentAtCapacity) {
+		t.Errorf("assign over capacity: %v, want errAgentAtCapacity", err)
+	}
+
+	a, err = assignSupportAgent(ctx, pool, threadID, "", nil, actor)
+	if err != nil || !a.Changed || a.PreviousAgentID != agent2 {
+		t.Fatalf("return to queue = %+v, %v", a, err)
+	}
+	if change := supportMemberChange(a); len(change.Added) != 0 {
+		t.Errorf("return to queue adds %v", change.Added)
+	}
+	var assigned *string
+	var assignments int
+	err = pool.QueryRow(ctx, `
+		select assigned_agent_id::text,
+		       (select count(*) from chat_support_assignments where thread_id = $1)
+		from chat_threads where id = $1`,
+		threadID,
+	).Scan(&assigned, &assignments)
+	if err != nil || assigned != nil || assignments != 3 {
+		t.Errorf("after return to queue: assigned %v, assignments %d, err %v", assigned, assignments, err)
+	}
+}
+
+func TestAssignSupportAgentCapacityRaceDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	agentID := newUUID()
+	putSupportAgent(t, pool, agentID, `{"max_active_threads":2}`)
+	const threads = 6
+	ids := make([]string, threads)
+	for i := range ids {
+		ids[i] = createTestThread(t, pool, "support", newUUID(), roleCustomer)
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		assigned int
+	)
+	for _, id := range ids {
+		wg.Add(1)
+		go func(threadID string) {
+			defer wg.Done()
+			none := ""
+			_, err := assignSupportAgent(ctx, pool, threadID, agentID, &none, statusActor{Type: actorTypeSystem, ID: "auto_assign"})
+			if err != nil && !errors.Is(err, errAgentAtCapacity) {
+				t.Errorf("assign %s: %v", threadID, err)
+				return
+			}
+			if err == nil {
+				mu.Lock()
+				assigned++
+				mu.Unlock()
+			}
+		}(id)
+	}
+	wg.Wait()
+	if assigned != 2 {
+		t.Errorf("assigned %d threads, want max_active_threads 2", assigned)
+	}
+}
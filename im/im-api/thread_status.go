@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Thread lifecycle. Members may freeze or close an active thread (in a group,
+// only the owner and admins), and the member who froze a thread may reopen
+// it; every other transition goes through the service endpoints. Each change is
+// audited in chat_thread_status_events, recorded in the thread as a system
+// message and fanned out as a thread_status event.
+const (
+	threadStatusActive = "active"
+	threadStatusFrozen = "frozen"
+	threadStatusClosed = "closed"
+
+	actorTypeUser    = "user"
+	actorTypeService = "service"
+	actorTypeSystem  = "system"
+
+	threadStatusReasonMaxRunes = 200
+	closeSweepInterval         = time.Minute
+	closeSweepBatch            = 100
+)
+
+var (
+	errThreadNotFound    = errors.New("thread not found")
+	errInvalidTransition = errors.New("invalid status transition")
+	errNotThreadMember   = errors.New("not a member")
+	errStatusForbidden   = errors.New("not allowed to change thread status")
+)
+
+type statusActor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+type statusChange struct {
+	ThreadID  string
+	From      string
+	To        string
+	Reason    string
+	Actor     statusActor
+	ChangedAt time.Time
+	CloseAt   *time.Time
+	Changed   bool
+	Notice    *serviceMessage
+	Scheduled bool // close_at was set or cleared without a transition
+}
+
+// lockedThread is what a status change sees of the thread row it locked.
+// MemberRole is the acting user's role, "" when the actor isn't a member.
+type lockedThread struct {
+	Type       string
+	Status     string
+	ActorType  string
+	ActorID    string
+	MemberRole string
+}
+
+// threadStatusForAction maps an API action to the status it leads to.
+func threadStatusForAction(action string) (string, bool) {
+	switch action {
+	case "freeze":
+		return threadStatusFrozen, true
+	case "close":
+		return threadStatusClosed, true
+	case "reopen":
+		return threadStatusActive, true
+	default:
+		return "", false
+	}
+}
+
+// validTransition: a closed thread can only be reopened.
+func validTransition(from, to string) bool {
+	return from != to && !(from == threadStatusClosed && to == threadStatusFrozen)
+}
+
+func threadStatusNotice(to, reason string) string {
+	text := map[string]string{
+		threadStatusActive: "会话已重新开启",
+		threadStatusFrozen: "会话已冻结",
+		threadStatusClosed: "会话已关闭",
+	}[to]
+	if reason != "" {
+		text += "：" + reason
+	}
+	return text
+}
+
+// memberMayChangeStatus decides whether the acting member may move a thread to `to`
+// through the member endpoint.
+func memberMayChangeStatus(t lockedThread, userID, to string) error {
+	if t.MemberRole == "" {
+		return errNotThreadMember
+	}
+	if t.Type == "group" && t.MemberRole != roleOwner && t.MemberRole != roleAdmin {
+		return errStatusForbidden
+	}
+	// Reopening only undoes the member's own freeze; a close, or a freeze
+	// by a service or another member, stays until the service reopens it.
+	if to == threadStatusActive && (t.Status != threadStatusFrozen || t.ActorType != actorTypeUser || t.ActorID != userID) {
+		return errStatusForbidden
+	}
+	return nil
+}
+
+// changeThreadStatus moves a thread to status `to`. Moving to the current
+// status is a no-op (Changed false), except that reopening an active thread
+// cancels a pending scheduled close. Any real transition clears close_at.
+func changeThreadStatus(ctx context.Context, pool *pgxpool.Pool, threadID, to, reason string, actor statusActor) (*statusChange, error) {
+	return changeThreadStatusIf(ctx, pool, threadID, to, reason, actor, nil)
+}
+
+// changeMemberThreadStatus is changeThreadStatus for a member, checked with
+// memberMayChangeStatus while the thread row is locked.
+func changeMemberThreadStatus(ctx context.Context, pool *pgxpool.Pool, threadID, to, reason, userID string) (*statusChange, error) {
+	actor := statusActor{Type: actorTypeUser, ID: userID}
+	return changeThreadStatusIf(ctx, pool, threadID, to, reason, actor, func(t lockedThread) error {
+		return memberMayChangeStatus(t, userID, to)
+	})
+}
+
+func changeThreadStatusIf(ctx context.Context, pool *pgxpool.Pool, threadID, to, reason string, actor statusActor, allow func(lockedThread) error) (*statusChange, error) {
+	change := &statusChange{ThreadID: threadID, To: to, Reason: reason, Actor: actor}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var locked lockedThread
+	err = tx.QueryRow(ctx, `
+		select t.status, t.close_at, t.type,
+		       coalesce(t.status_actor_type, ''), coalesce(t.status_actor_id, ''), coalesce(m.role, '')
+		from chat_threads t
+		left join chat_thread_members m on m.thread_id = t.id and m.user_id::text = $2
+		where t.id = $1
+		for update of t`,
+		threadID, actor.ID,
+	).Scan(&change.From, &change.CloseAt, &locked.Type, &locked.ActorType, &locked.ActorID, &locked.MemberRole)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errThreadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	locked.Status = change.From
+	if allow != nil {
+		if err := allow(locked); err != nil {
+			return nil, err
+		}
+	}
+	if change.From == to {
+		if to == threadStatusActive && change.CloseAt != nil {
+			if _, err := tx.Exec(ctx, `update chat_threads set close_at = null, close_reason = null, updated_at = now() where id = $1`, threadID); err != nil {
+				return nil, err
+			}
+			change.CloseAt = nil
+			change.Scheduled = true
+		}
+		return change, tx.Commit(ctx)
+	}
+	if !validTransition(change.From, to) {
+		return nil, errInvalidTransition
+	}
+	if err := applyTransition(ctx, tx, change); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// applyTransition writes a transition for a thread row locked by tx (status,
+// audit row, system notice) and commits.
+func applyTransition(ctx context.Context, tx pgx.Tx, change *statusChange) error {
+	notice, err := json.Marshal(map[string]any{
+		"text":            threadStatusNotice(change.To, change.Reason),
+		"event":           "thread_status",
+		"status":          change.To,
+		"previous_status": change.From,
+		"reason":          change.Reason,
+	})
+	if err != nil {
+		return err
+	}
+	msg := &serviceMessage{ThreadID: change.ThreadID, Type: "system", Content: notice}
+	err = tx.QueryRow(ctx, `
+		update chat_threads
+		set status = $2,
+		    status_reason = nullif($3, ''),
+		    status_actor_type = $4,
+		    status_actor_id = $5,
+		    status_changed_at = now(),
+		    close_at = null,
+		    close_reason = null,
+		    last_seq = last_seq + 1,
+		    last_message_at = now(),
+		    updated_at = now()
+		where id = $1
+		returning last_seq, status_changed_at`,
+		change.ThreadID, change.To, change.Reason, change.Actor.Type, change.Actor.ID,
+	).Scan(&msg.Seq, &change.ChangedAt)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		insert into chat_thread_status_events (thread_id, from_status, to_status, reason, actor_type, actor_id)
+		values ($1, $2, $3, nullif($4, ''), $5, $6)`,
+		change.ThreadID, change.From, change.To, change.Reason, change.Actor.Type, change.Actor.ID,
+	)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(ctx, `
+		insert into chat_messages (thread_id, sender_id, client_msg_id, seq, type, content)
+		values ($1, $2, gen_random_uuid(), $3, 'system', $4)
+		returning id, client_msg_id::text, created_at`,
+		change.ThreadID, systemSenderID, msg.Seq, notice,
+	).Scan(&msg.MsgID, &msg.ClientMsgID, &msg.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	change.CloseAt = nil
+	change.Changed = true
+	change.Notice = msg
+	return nil
+}
+
+// scheduleThreadClose marks a thread to be closed at `at` by the close sweep.
+// An already closed thread is left alone (Changed false).
+func scheduleThreadClose(ctx context.Context, pool *pgxpool.Pool, threadID string, at time.Time, reason string) (*statusChange, error) {
+	change := &statusChange{ThreadID: threadID, To: threadStatusClosed, Reason: reason}
+	err := pool.QueryRow(ctx, `
+		select status from chat_threads where id = $1`,
+		threadID,
+	).Scan(&change.From)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, errThreadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if change.From == threadStatusClosed {
+		return change, nil
+	}
+	err = pool.QueryRow(ctx, `
+		update chat_threads
+		set close_at = $2, close_reason = nullif($3, ''), updated_at = now()
+		where id = $1 and status <> 'closed'
+		returning close_at`,
+		threadID, at, reason,
+	).Scan(&change.CloseAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return change, nil
+	}
+	change.Scheduled = err == nil
+	return change, err
+}
+
+// publishStatusChange fans out a thread_status event (and the system notice)
+// after a transition, or a close_at update after scheduling a close.
+func publishStatusChange(ctx context.Context, pool *pgxpool.Pool, redisClient *redis.Client, change *statusChange) {
+	if !change.Changed && !change.Scheduled {
+		return
+	}
+	payload := map[string]any{
+		"status":   change.From,
+		"close_at": change.CloseAt,
+	}
+	if change.Changed {
+		payload = map[string]any{
+			"status":          change.To,
+			"previous_status": change.From,
+			"reason":          change.Reason,
+			"actor":           change.Actor,
+			"changed_at":      change.ChangedAt,
+			"close_at":        nil,
+			"seq":             change.Notice.Seq,
+		}
+	}
+	publishThreadEvent(ctx, redisClient, change.ThreadID, "thread_status", payload)
+	if change.Notice != nil {
+		fanoutServiceMessage(ctx, pool, redisClient, change.Notice)
+	}
+}
+
+func statusChangeResponse(change *statusChange) map[string]any {
+	resp := map[string]any{
+		"thread_id": change.ThreadID,
+		"status":    change.From,
+		"changed":   change.Changed,
+		"close_at":  change.CloseAt,
+	}
+	if change.Changed {
+		resp["status"] = change.To
+		resp["previous_status"] = change.From
+		resp["changed_at"] = change.ChangedAt
+		resp["msg_id"] = change.Notice.MsgID
+		resp["seq"] = change.Notice.Seq
+	}
+	return resp
+}
+
+func writeStatusChangeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, errThreadNotFound):
+		writeError(w, r, http.StatusNotFound, "THREAD_NOT_FOUND", err.Error())
+	case errors.Is(err, errInvalidTransition):
+		writeError(w, r, http.StatusConflict, "INVALID_TRANSITION", err.Error())
+	case errors.Is(err, errNotThreadMember), errors.Is(err, errStatusForbidden):
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", err.Error())
+	default:
+		log.Error().Err(err).Str("trace_id", ctxValue(r, ctxTraceID)).Msg("thread status change failed")
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+	}
+}
+
+func normalizeStatusReason(reason string) string {
+	return truncateRunes(strings.TrimSpace(reason), threadStatusReasonMaxRunes)
+}
+
+// handleThreadStatus is the member endpoint: POST /v1/threads/{id}/status
+// with {"action": "freeze" | "close" | "reopen", "reason"}. Group threads
+// need an owner or admin; reopen is only for the member who froze the thread.
+func handleThreadStatus(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	userID := ctxValue(r, ctxUserID)
+	threadID := chi.URLParam(r, "id")
+	var payload struct {
+		Action string `json:"action"`
+		Reason string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	to, ok := threadStatusForAction(payload.Action)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "action must be freeze, close or reopen")
+		return
+	}
+	if !isUUID(threadID) {
+		writeError(w, r, http.StatusForbidden, "FORBIDDEN", "not a member")
+		return
+	}
+	change, err := changeMemberThreadStatus(r.Context(), pool, threadID, to, normalizeStatusReason(payload.Reason), userID)
+	if err != nil {
+		writeStatusChangeError(w, r, err)
+		return
+	}
+	publishStatusChange(r.Context(), pool, redisClient, change)
+	writeJSON(w, r, http.StatusOK, statusChangeResponse(change))
+}
+
+// handleServiceThreadStatus is POST /internal/v1/threads/status with
+// {"thread_id" | "order_id" | "match_session_id", "action", "reason",
+// "actor", "close_after_seconds"}. A close with close_after_seconds > 0 is
+// scheduled instead of applied.
+func handleServiceThreadStatus(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client) {
+	var payload struct {
+		ThreadID          string `json:"thread_id"`
+		OrderID           string `json:"order_id"`
+		MatchSessionID    string `json:"match_session_id"`
+		Action            string `json:"action"`
+		Reason            string `json:"reason"`
+		Actor             string `json:"actor"`
+		CloseAfterSeconds int64  `json:"close_after_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "invalid json")
+		return
+	}
+	to, ok := threadStatusForAction(payload.Action)
+	if !ok {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "action must be freeze, close or reopen")
+		return
+	}
+	if payload.CloseAfterSeconds < 0 || (payload.CloseAfterSeconds > 0 && to != threadStatusClosed) {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "close_after_seconds only applies to close")
+		return
+	}
+	threadID, ok := resolveServiceThread(w, r, pool, payload.ThreadID, payload.OrderID, payload.MatchSessionID)
+	if !ok {
+		return
+	}
+	actor := statusActor{Type: actorTypeService, ID: strings.TrimSpace(payload.Actor)}
+	if actor.ID == "" {
+		actor.ID = "service"
+	}
+	applyServiceStatus(w, r, pool, redisClient, threadID, to, normalizeStatusReason(payload.Reason), actor, time.Duration(payload.CloseAfterSeconds)*time.Second)
+}
+
+// handleOrderThreadStatus is POST /internal/v1/orders/{order_id}/status with
+// {"order_status", "reason"}: cancellation freezes the order thread and
+// completion closes it after IM_ORDER_CLOSE_GRACE_HOURS. Other order
+// statuses leave the thread alone.
+func handleOrderThreadStatus(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, cfg Config) {
+	var payload struct {
+		OrderStatus string `json:"order_status"`
+		Reason      string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || payload.OrderStatus == "" {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "order_status required")
+		return
+	}
+	threadID, ok := resolveServiceThread(w, r, pool, "", chi.URLParam(r, "order_id"), "")
+	if !ok {
+		return
+	}
+	to, delay := orderStatusTransition(payload.OrderStatus, cfg)
+	if to == "" {
+		writeJSON(w, r, http.StatusOK, map[string]any{"thread_id": threadID, "changed": false})
+		return
+	}
+	reason := normalizeStatusReason(payload.Reason)
+	if reason == "" {
+		reason = orderStatusReason(to)
+	}
+	actor := statusActor{Type: actorTypeService, ID: "order:" + strings.ToUpper(payload.OrderStatus)}
+	applyServiceStatus(w, r, pool, redisClient, threadID, to, reason, actor, delay)
+}
+
+// orderStatusTransition maps a main-database order status to the thread
+// status it implies and the delay before applying it.
+func orderStatusTransition(orderStatus string, cfg Config) (string, time.Duration) {
+	status := strings.ToUpper(strings.TrimSpace(orderStatus))
+	switch {
+	case strings.HasPrefix(status, "CANCELLED"):
+		return threadStatusFrozen, 0
+	case status == "COMPLETED":
+		return threadStatusClosed, time.Duration(cfg.OrderCloseGraceHours) * time.Hour
+	default:
+		return "", 0
+	}
+}
+
+func orderStatusReason(to string) string {
+	if to == threadStatusFrozen {
+		return "订单已取消"
+	}
+	return "订单已完成"
+}
+
+func applyServiceStatus(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, redisClient *redis.Client, threadID, to, reason string, actor statusActor, closeAfter time.Duration) {
+	var (
+		change *statusChange
+		err    error
+	)
+	if to == threadStatusClosed && closeAfter > 0 {
+		change, err = scheduleThreadClose(r.Context(), pool, threadID, time.Now().Add(closeAfter), reason)
+	} else {
+		change, err = changeThreadStatus(r.Context(), pool, threadID, to, reason, actor)
+	}
+	if err != nil {
+		writeStatusChangeError(w, r, err)
+		return
+	}
+	publishStatusChange(r.Context(), pool, redisClient, change)
+	log.Info().
+		Str("trace_id", ctxValue(r, ctxTraceID)).
+		Str("thread_id", threadID).
+		Str("to", to).
+		Str("actor", actor.ID).
+		Bool("changed", change.Changed).
+		Msg("thread status requested")
+	writeJSON(w, r, http.StatusOK, statusChangeResponse(change))
+}
+
+// resolveServiceThread finds the thread addressed by exactly one of
+// thread_id, order_id or match_session_id and writes the error otherwise.
+func resolveServiceThread(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool, threadID, orderID, matchSessionID string) (string, bool) {
+	column, value, targets := "", "", 0
+	for _, t := range [][2]string{{"id", threadID}, {"order_id", orderID}, {"match_session_id", matchSessionID}} {
+		if t[1] != "" {
+			column, value = t[0], t[1]
+			targets++
+		}
+	}
+	if targets != 1 {
+		writeError(w, r, http.StatusBadRequest, "INVALID_REQUEST", "exactly one of thread_id/order_id/match_session_id required")
+		return "", false
+	}
+	var id string
+	if isUUID(value) {
+		err := pool.QueryRow(r.Context(), `select id from chat_threads where `+column+` = $1`, value).Scan(&id)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+			return "", false
+		}
+	}
+	if id == "" {
+		writeError(w, r, http.StatusNotFound, "THREAD_NOT_FOUND", errThreadNotFound.Error())
+		return "", false
+	}
+	return id, true
+}
+
+// runThreadCloseSweep closes threads whose scheduled close_at has passed.
+// Rows are claimed with skip locked, so every im-api replica can run it.
+func runThreadCloseSweep(ctx context.Context, pool *pgxpool.Pool, redisClient *redis.Client) {
+	ticker := time.NewTicker(closeSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := closeDueThreads(ctx, pool, redisClient); err != nil {
+				log.Warn().Err(err).Msg("thread close sweep failed")
+			} else if n > 0 {
+				log.Info().Int("closed", n).Msg("scheduled thread closes applied")
+			}
+		}
+	}
+}
+
+func closeDueThreads(ctx context.Context, pool *pgxpool.Pool, redisClient *redis.Client) (int, error) {
+	rows, err := pool.Query(ctx, `
+		select id, coalesce(close_reason, '')
+		from chat_threads
+		where close_at is not null and close_at <= now() and status <> 'closed'
+		order by close_at
+		limit $1`,
+		closeSweepBatch,
+	)
+	if err != nil {
+		return 0, err
+	}
+	type due struct{ id, reason string }
+	var threads []due
+	for rows.Next() {
+		var d due
+		if err := rows.Scan(&d.id, &d.reason); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		threads = append(threads, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	closed := 0
+	for _, d := range threads {
+		change, err := closeIfDue(ctx, pool, d.id, d.reason)
+		if err != nil {
+			log.Warn().Err(err).Str("thread_id", d.id).Msg("scheduled thread close failed")
+			continue
+		}
+		if change != nil && change.Changed {
+			publishStatusChange(ctx, pool, redisClient, change)
+			closed++
+		}
+	}
+	return closed, nil
+}
+
+// closeIfDue re-checks close_at under a skip-locked claim (another replica or
+// a reopen may have got there first) and applies the close in the same
+// transaction.
+func closeIfDue(ctx context.Context, pool *pgxpool.Pool, threadID, reason string) (*statusChange, error) {
+	change := &statusChange{
+		ThreadID: threadID,
+		To:       threadStatusClosed,
+		Reason:   reason,
+		Actor:    statusActor{Type: actorTypeSystem, ID: "close_schedule"},
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	err = tx.QueryRow(ctx, `
+		select status from chat_threads
+		where id = $1 and close_at is not null and close_at <= now() and status <> 'closed'
+		for update skip locked`,
+		threadID,
+	).Scan(&change.From)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := applyTransition(ctx, tx, change); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestThreadStatusTransitions(t *testing.T) {
+	cases := []struct {
+		from, to string
+		want     bool
+	}{
+		{threadStatusActive, threadStatusFrozen, true},
+		{threadStatusActive, threadStatusClosed, true},
+		{threadStatusFrozen, threadStatusActive, true},
+		{threadStatusFrozen, threadStatusClosed, true},
+		{threadStatusClosed, threadStatusActive, true},
+		{threadStatusClosed, threadStatusFrozen, false},
+		{threadStatusActive, threadStatusActive, false},
+	}
+	for _, tc := range cases {
+		if got := validTransition(tc.from, tc.to); got != tc.want {
+			t.Errorf("validTransition(%s, %s) = %v, want %v", tc.from, tc.to, got, tc.want)
+		}
+	}
+	if _, ok := threadStatusForAction("archive"); ok {
+		t.Error("unknown action accepted")
+	}
+	if got := threadStatusNotice(threadStatusFrozen, "订单已取消"); got != "会话已冻结：订单已取消" {
+		t.Errorf("notice = %q", got)
+	}
+}
+
+func TestMemberMayChangeStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		t    lockedThread
+		to   string
+		want error
+	}{
+		{"non-member", lockedThread{Type: "order"}, threadStatusFrozen, errNotThreadMember},
+		{"order participant", lockedThread{Type: "order", MemberRole: "traveler"}, threadStatusClosed, nil},
+		{"group member", lockedThread{Type: "group", MemberRole: roleMember}, threadStatusFrozen, errStatusForbidden},
+		{"group admin", lockedThread{Type: "group", MemberRole: roleAdmin}, threadStatusFrozen, nil},
+		{"group owner", lockedThread{Type: "group", MemberRole: roleOwner}, threadStatusClosed, nil},
+		{"reopen own freeze", lockedThread{Type: "match", Status: threadStatusFrozen, ActorType: actorTypeUser, ActorID: "u1", MemberRole: "traveler"}, threadStatusActive, nil},
+		{"reopen other's freeze", lockedThread{Type: "match", Status: threadStatusFrozen, ActorType: actorTypeUser, ActorID: "u2", MemberRole: "traveler"}, threadStatusActive, errStatusForbidden},
+		{"reopen service freeze", lockedThread{Type: "order", Status: threadStatusFrozen, ActorType: actorTypeService, ActorID: "u1", MemberRole: "traveler"}, threadStatusActive, errStatusForbidden},
+		{"reopen own close", lockedThread{Type: "match", Status: threadStatusClosed, ActorType: actorTypeUser, ActorID: "u1", MemberRole: "traveler"}, threadStatusActive, errStatusForbidden},
+		{"reopen active", lockedThread{Type: "match", Status: threadStatusActive, MemberRole: "traveler"}, threadStatusActive, errStatusForbidden},
+	}
+	for _, tc := range cases {
+		if got := memberMayChangeStatus(tc.t, "u1", tc.to); !errors.Is(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOrderStatusTransition(t *testing.T) {
+	cfg := Config{OrderCloseGraceHours: 72}
+	cases := []struct {
+		status string
+		to     string
+		delay  time.Duration
+	}{
+		{"CANCELLED_BY_TRAVELER", threadStatusFrozen, 0},
+		{"cancelled_refunded", threadStatusFrozen, 0},
+		{"COMPLETED", threadStatusClosed, 72 * time.Hour},
+		{"PAID", "", 0},
+	}
+	for _, tc := range cases {
+		to, delay := orderStatusTransition(tc.status, cfg)
+		if to != tc.to || delay != tc.delay {
+			t.Errorf("%s: got (%q, %v), want (%q, %v)", tc.status, to, delay, tc.to, tc.delay)
+		}
+	}
+}
+
+func TestThreadStatusHandlersValidation(t *testing.T) {
+	member := func(w http.ResponseWriter, r *http.Request) { handleThreadStatus(w, r, nil, nil) }
+	service := func(w http.ResponseWriter, r *http.Request) { handleServiceThreadStatus(w, r, nil, nil) }
+	cases := []struct {
+		name    string
+		handler http.HandlerFunc
+		body    string
+		status  int
+		code    string
+	}{
+		{"member unknown action", member, `{"action":"archive"}`, http.StatusBadRequest, "INVALID_REQUEST"},
+		{"member bad thread id", member, `{"action":"reopen"}`, http.StatusForbidden, "FORBIDDEN"},
+		{"service delayed freeze", service, `{"thread_id":"t","action":"freeze","close_after_seconds":60}`, http.StatusBadRequest, "INVALID_REQUEST"},
+		{"service no target", service, `{"action":"close"}`, http.StatusBadRequest, "INVALID_REQUEST"},
+		{"service two targets", service, `{"thread_id":"t","order_id":"o","action":"close"}`, http.StatusBadRequest, "INVALID_REQUEST"},
+		{"service bad id", service, `{"order_id":"42","action":"freeze"}`, http.StatusNotFound, "THREAD_NOT_FOUND"},
+	}
+	for _, tc := range cases {
+		if status, code := callHandler(tc.handler, testRequest(http.MethodPost, "/", tc.body, "")); status != tc.status || code != tc.code {
+			t.Errorf("%s: got %d %s, want %d %s", tc.name, status, code, tc.status, tc.code)
+		}
+	}
+}
+
+func TestChangeThreadStatusDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	traveler, host := newUUID(), newUUID()
+	threadID := createTestThread(t, pool, "order", traveler, "traveler", host, "host")
+	actor := statusActor{Type: actorTypeUser, ID: traveler}
+
+	change, err := changeThreadStatus(ctx, pool, threadID, threadStatusFrozen, "dispute", actor)
+	if err != nil || !change.Changed || change.From != threadStatusActive || change.Notice == nil || change.Notice.Seq != 1 {
+		t.Fatalf("freeze = %+v, %v", change, err)
+	}
+	if change, err = changeThreadStatus(ctx, pool, threadID, threadStatusFrozen, "", actor); err != nil || change.Changed {
+		t.Fatalf("repeat freeze = %+v, %v", change, err)
+	}
+	if _, err = changeThreadStatus(ctx, pool, threadID, threadStatusClosed, "", actor); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err = changeThreadStatus(ctx, pool, threadID, threadStatusFrozen, "", actor); !errors.Is(err, errInvalidTransition) {
+		t.Fatalf("freeze closed thread: %v, want errInvalidTransition", err)
+	}
+	if change, err = changeThreadStatus(ctx, pool, threadID, threadStatusActive, "", actor); err != nil || !change.Changed {
+		t.Fatalf("reopen = %+v, %v", change, err)
+	}
+
+	var (
+		status   string
+		lastSeq  int64
+		events   int
+		notices  int
+		actorID  string
+		reasonDB *string
+	)
+	err = pool.QueryRow(ctx, `
+		select t.status, t.last_seq, t.status_actor_id, t.status_reason,
+		       (select count(*) from chat_thread_status_events e where e.thread_id = t.id),
+		       (select count(*) from chat_messages m where m.thread_id = t.id and m.type = 'system')
+		from chat_threads t where t.id = $1`,
+		threadID,
+	).Scan(&status, &lastSeq, &actorID, &reasonDB, &events, &notices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != threadStatusActive || lastSeq != 3 || events != 3 || notices != 3 || actorID != traveler || reasonDB != nil {
+		t.Errorf("after reopen: status %s, last_seq %d, events %d, notices %d, actor %s, reason %v", status, lastSeq, events, notices, actorID, reasonDB)
+	}
+	if _, err := changeThreadStatus(ctx, pool, newUUID(), threadStatusFrozen, "", actor); !errors.Is(err, errThreadNotFound) {
+		t.Errorf("missing thread: %v, want errThreadNotFound", err)
+	}
+}
+
+func TestGroupThreadStatusDB(t *testing.T) {
+	pool := testPool(t)
+	owner, member := newUUID(), newUUID()
+	threadID := createTestThread(t, pool, "group", owner, roleOwner, member, roleMember)
+	handler := func(w http.ResponseWriter, r *http.Request) { handleThreadStatus(w, r, pool, nil) }
+
+	if status, code := callHandler(handler, testRequest(http.MethodPost, "/", `{"action":"close"}`, member, "id", threadID)); status != http.StatusForbidden || code != "FORBIDDEN" {
+		t.Fatalf("plain member close: %d %s, want 403 FORBIDDEN", status, code)
+	}
+	if status, code := callHandler(handler, testRequest(http.MethodPost, "/", `{"action":"freeze"}`, newUUID(), "id", threadID)); status != http.StatusForbidden || code != "FORBIDDEN" {
+		t.Fatalf("non-member freeze: %d %s, want 403 FORBIDDEN", status, code)
+	}
+	var resp struct {
+		Status  string `json:"status"`
+		Changed bool   `json:"changed"`
+	}
+	serveJSON(t, handler, testRequest(http.MethodPost, "/", `{"action":"freeze"}`, owner, "id", threadID), &resp)
+	if !resp.Changed || resp.Status != threadStatusFrozen {
+		t.Errorf("owner freeze = %+v", resp)
+	}
+}
+
+func TestMemberReopenDB(t *testing.T) {
+	pool := testPool(t)
+	traveler, host := newUUID(), newUUID()
+	threadID := createTestThread(t, pool, "match", traveler, "traveler", host, "host")
+	handler := func(w http.ResponseWriter, r *http.Request) { handleThreadStatus(w, r, pool, nil) }
+	post := func(userID, action string) (int, string) {
+		return callHandler(handler, testRequest(http.MethodPost, "/", `{"action":"`+action+`"}`, userID, "id", threadID))
+	}
+
+	if status, _ := post(traveler, "freeze"); status != http.StatusOK {
+		t.Fatalf("freeze: %d", status)
+	}
+	if status, code := post(host, "reopen"); status != http.StatusForbidden || code != "FORBIDDEN" {
+		t.Errorf("other member reopen: %d %s, want 403 FORBIDDEN", status, code)
+	}
+	if status, _ := post(traveler, "reopen"); status != http.StatusOK {
+		t.Errorf("freezer reopen: %d", status)
+	}
+	if status, _ := post(host, "close"); status != http.StatusOK {
+		t.Fatalf("close: %d", status)
+	}
+	if status, code := post(host, "reopen"); status != http.StatusForbidden || code != "FORBIDDEN" {
+		t.Errorf("reopen after member close: %d %s, want 403 FORBIDDEN", status, code)
+	}
+}
+
+func TestScheduledCloseDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	traveler, host := newUUID(), newUUID()
+	threadID := createTestThread(t, pool, "order", traveler, "traveler", host, "host")
+
+	change, err := scheduleThreadClose(ctx, pool, threadID, time.Now().Add(time.Hour), "订单已完成")
+	if err != nil || !change.Scheduled || change.CloseAt == nil {
+		t.Fatalf("schedule = %+v, %v", change, err)
+	}
+	if change, err = closeIfDue(ctx, pool, threadID, "订单已完成"); err != nil || change != nil {
+		t.Fatalf("closeIfDue before close_at = %+v, %v", change, err)
+	}
+
+	// Reopening an active thread cancels the pending close.
+	reopen, err := changeThreadStatus(ctx, pool, threadID, threadStatusActive, "", statusActor{Type: actorTypeService, ID: "test"})
+	if err != nil || reopen.Changed || !reopen.Scheduled || reopen.CloseAt != nil {
+		t.Fatalf("reopen active = %+v, %v", reopen, err)
+	}
+
+	if _, err := pool.Exec(ctx, `update chat_threads set close_at = '2000-01-01', close_reason = '订单已完成' where id = $1`, threadID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := closeDueThreads(ctx, pool, nil); err != nil {
+		t.Fatalf("sweep: %v", err)
+	}
+	var (
+		status    string
+		closeAt   *time.Time
+		actorType string
+		actorID   string
+	)
+	err = pool.QueryRow(ctx, `
+		select status, close_at, status_actor_type, status_actor_id from chat_threads where id = $1`,
+		threadID,
+	).Scan(&status, &closeAt, &actorType, &actorID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != threadStatusClosed || closeAt != nil || actorType != actorTypeSystem || actorID != "close_schedule" {
+		t.Errorf("after sweep: status %s, close_at %v, actor %s/%s", status, closeAt, actorType, actorID)
+	}
+	if change, err = scheduleThreadClose(ctx, pool, threadID, time.Now().Add(time.Hour), ""); err != nil || change.Scheduled {
+		t.Errorf("schedule on closed thread = %+v, %v", change, err)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// The thread list is ordered by (pinned, activity_at, id) descending, where
+// activity_at is coalesce(last_message_at, updated_at). Pages continue
+// strictly after the last row of the previous page, so a thread that moves
+// up while the user is paging is not repeated; it reaches the client through
+// realtime frames or the next refresh instead.
+const threadListOrder = "(m.pinned_at is not null) desc, coalesce(t.last_message_at, t.updated_at) desc, t.id desc"
+
+var threadStatuses = []string{threadStatusActive, threadStatusFrozen, threadStatusClosed}
+
+type threadCursor struct {
+	Pinned     bool
+	ActivityAt time.Time
+	ThreadID   string
+}
+
+func encodeThreadCursor(c threadCursor) string {
+	pinned := "0"
+	if c.Pinned {
+		pinned = "1"
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(pinned + "|" + c.ActivityAt.UTC().Format(time.RFC3339Nano) + "|" + c.ThreadID))
+}
+
+func decodeThreadCursor(cursor string) (threadCursor, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return threadCursor{}, false
+	}
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 || (parts[0] != "0" && parts[0] != "1") || !isUUID(parts[2]) {
+		return threadCursor{}, false
+	}
+	at, err := time.Parse(time.RFC3339Nano, parts[1])
+	if err != nil {
+		return threadCursor{}, false
+	}
+	return threadCursor{Pinned: parts[0] == "1", ActivityAt: at, ThreadID: parts[2]}, true
+}
+
+// parseListValues splits a comma-separated filter and checks each value
+// against allowed.
+func parseListValues(raw string, allowed []string) ([]string, bool) {
+	var out []string
+	for _, v := range strings.Split(raw, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		ok := false
+		for _, a := range allowed {
+			if v == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return nil, false
+		}
+		out = append(out, v)
+	}
+	return out, true
+}
+
+// threadListConditions builds the where clause for GET /v1/threads over
+// members m joined to threads t, with $1 bound to the caller:
+// ?type=order,group, ?status=active, ?unread=true, ?archived= (see
+// archivedFilter) and ?cursor= from a previous next_cursor.
+func threadListConditions(q url.Values, userID string) ([]string, []any, error) {
+	conds := []string{"m.user_id = $1"}
+	args := []any{userID}
+	if raw := q.Get("type"); raw != "" {
+		types, ok := parseListValues(raw, threadTypes)
+		if !ok {
+			return nil, nil, errors.New("type must be one of " + strings.Join(threadTypes, ", "))
+		}
+		args = append(args, types)
+		conds = append(conds, fmt.Sprintf("t.type = any($%d)", len(args)))
+	}
+	if raw := q.Get("status"); raw != "" {
+		statuses, ok := parseListValues(raw, threadStatuses)
+		if !ok {
+			return nil, nil, errors.New("status must be one of " + strings.Join(threadStatuses, ", "))
+		}
+		args = append(args, statuses)
+		conds = append(conds, fmt.Sprintf("t.status = any($%d)", len(args)))
+	}
+	switch q.Get("unread") {
+	case "", "false":
+	case "true":
+		conds = append(conds, "t.last_seq > m.last_read_seq")
+	default:
+		return nil, nil, errors.New("unread must be true or false")
+	}
+	archivedCond, ok := archivedFilter(q.Get("archived"))
+	if !ok {
+		return nil, nil, errors.New("archived must be true, false or all")
+	}
+	if archivedCond != "" {
+		conds = append(conds, archivedCond)
+	}
+	if raw := q.Get("cursor"); raw != "" {
+		c, ok := decodeThreadCursor(raw)
+		if !ok {
+			return nil, nil, errors.New("invalid cursor")
+		}
+		pinned := 0
+		if c.Pinned {
+			pinned = 1
+		}
+		args = append(args, pinned, c.ActivityAt, c.ThreadID)
+		n := len(args)
+		conds = append(conds, fmt.Sprintf(
+			"((m.pinned_at is not null)::int, coalesce(t.last_message_at, t.updated_at), t.id) < ($%d::int, $%d::timestamptz, $%d::uuid)",
+			n-2, n-1, n))
+	}
+	return conds, args, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestThreadCursorRoundTrip(t *testing.T) {
+	want := threadCursor{
+		Pinned:     true,
+		ActivityAt: time.Date(2026, 10, 18, 9, 30, 0, 123456000, time.UTC),
+		ThreadID:   "11111111-1111-4111-8111-111111111111",
+	}
+	got, ok := decodeThreadCursor(encodeThreadCursor(want))
+	if !ok || got.Pinned != want.Pinned || !got.ActivityAt.Equal(want.ActivityAt) || got.ThreadID != want.ThreadID {
+		t.Fatalf("round trip = %+v, %v", got, ok)
+	}
+	for _, bad := range []string{"", "!!", encodeSearchCursor(want.ActivityAt, want.ThreadID), "MnwyMDI2LTEwLTE4VDA5OjMwOjAwWnx4"} {
+		if _, ok := decodeThreadCursor(bad); ok {
+			t.Errorf("decodeThreadCursor(%q) accepted", bad)
+		}
+	}
+}
+
+func TestThreadListConditions(t *testing.T) {
+	cursor := encodeThreadCursor(threadCursor{ActivityAt: time.Unix(0, 0), ThreadID: "11111111-1111-4111-8111-111111111111"})
+	q := url.Values{
+		"type":   {"order,group"},
+		"status": {"active"},
+		"unread": {"true"},
+		"cursor": {cursor},
+	}
+	conds, args, err := threadListConditions(q, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	where := strings.Join(conds, " and ")
+	for _, part := range []string{"m.user_id = $1", "t.type = any($2)", "t.status = any($3)", "t.last_seq > m.last_read_seq", "m.archived_at is null", "< ($4::int, $5::timestamptz, $6::uuid)"} {
+		if !strings.Contains(where, part) {
+			t.Errorf("where clause %q missing %q", where, part)
+		}
+	}
+	if len(args) != 6 {
+		t.Errorf("args = %v", args)
+	}
+	if conds, _, _ := threadListConditions(url.Values{"archived": {"all"}}, "u1"); len(conds) != 1 {
+		t.Errorf("archived=all conds = %v", conds)
+	}
+}
+
+func TestListThreadsRejectsBadFilters(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) { handleListThreads(w, r, nil, Config{}, nil) }
+	for _, query := range []string{"type=dm", "status=open", "unread=maybe", "archived=yes", "cursor=abc"} {
+		if status, _ := callHandler(handler, testRequest(http.MethodGet, "/v1/threads?"+query, "", "")); status != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", query, status)
+		}
+	}
+}
+
+func TestListThreadsKeysetPagingDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	userID := newUUID()
+	handler := func(w http.ResponseWriter, r *http.Request) { handleListThreads(w, r, pool, Config{}, nil) }
+	base := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+	// ids[4] is pinned and the oldest; ids[1] and ids[2] tie on activity.
+	offsets := []time.Duration{4 * time.Hour, 3 * time.Hour, 3 * time.Hour, time.Hour, 0}
+	ids := make([]string, len(offsets))
+	for i, d := range offsets {
+		ids[i] = createTestThread(t, pool, "group", userID, roleMember)
+		if _, err := pool.Exec(ctx, `update chat_threads set updated_at = $2 where id = $1`, ids[i], base.Add(d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := pool.Exec(ctx, `
+		update chat_thread_members set pinned_at = now() where thread_id = $1 and user_id = $2`,
+		ids[4], userID,
+	); err != nil {
+		t.Fatal(err)
+	}
+	tied := []string{ids[1], ids[2]}
+	if tied[0] < tied[1] {
+		tied[0], tied[1] = tied[1], tied[0]
+	}
+	want := []string{ids[4], ids[0], tied[0], tied[1], ids[3]}
+
+	var got []string
+	cursor := ""
+	for page := 0; ; page++ {
+		if page > len(want) {
+			t.Fatalf("paging did not stop: %v", got)
+		}
+		var resp struct {
+			Threads []struct {
+				ID string `json:"id"`
+			} `json:"threads"`
+			NextCursor string `json:"next_cursor"`
+		}
+		serveJSON(t, handler, testRequest(http.MethodGet, "/v1/threads?limit=2&cursor="+url.QueryEscape(cursor), "", userID), &resp)
+		for _, th := range resp.Threads {
+			got = append(got, th.ID)
+		}
+		if page == 0 {
+			// A thread already seen moving up must not come back on later pages.
+			if _, err := pool.Exec(ctx, `update chat_threads set updated_at = $2 where id = $1`, ids[0], base.Add(10*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if resp.NextCursor == "" {
+			break
+		}
+		cursor = resp.NextCursor
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("paged threads = %v, want %v", got, want)
+	}
+}
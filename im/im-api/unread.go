@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// threadTypes lists every chat_threads.type so the badge summary always
+// reports each one, even at zero.
+var threadTypes = []string{"match", "order", "support", "group"}
+
+type unreadSummary struct {
+	Total  int64            `json:"total"`
+	ByType map[string]int64 `json:"by_type"`
+}
+
+// loadUnreadSummary reads the trigger-maintained chat_unread_counters rows
+// for userID (migration 0054); it is a primary-key lookup, not a scan of
+// the user's threads.
+func loadUnreadSummary(ctx context.Context, pool *pgxpool.Pool, userID string) (*unreadSummary, error) {
+	summary := &unreadSummary{ByType: map[string]int64{}}
+	for _, t := range threadTypes {
+		summary.ByType[t] = 0
+	}
+	rows, err := pool.Query(ctx, `
+		select thread_type, unread_count
+		from chat_unread_counters
+		where user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			ttype string
+			count int64
+		)
+		if err := rows.Scan(&ttype, &count); err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			count = 0
+		}
+		summary.ByType[ttype] = count
+		summary.Total += count
+	}
+	return summary, rows.Err()
+}
+
+// handleUnreadSummary is GET /v1/unread: the caller's total unread count
+// (the app badge) and the split by thread type.
+func handleUnreadSummary(w http.ResponseWriter, r *http.Request, pool *pgxpool.Pool) {
+	summary, err := loadUnreadSummary(r.Context(), pool, ctxValue(r, ctxUserID))
+	if err != nil {
+		writeError(w, r, http.StatusInternalServerError, "SERVER_ERROR", "db error")
+		return
+	}
+	writeJSON(w, r, http.StatusOK, summary)
+}
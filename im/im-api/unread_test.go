@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// The badge summary reports every thread type; keep the list in step with
+// the latest chat_threads_type_check in the migrations.
+func TestThreadTypesMatchSchema(t *testing.T) {
+	files, err := filepath.Glob("../../db/migrations/*.sql")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no migrations found: %v", err)
+	}
+	sort.Strings(files)
+	check := regexp.MustCompile(`chat_threads_type_check check \(type in \(([^)]*)\)\)`)
+	var latest string
+	for _, f := range files {
+		raw, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := check.FindSubmatch(raw); m != nil {
+			latest = string(m[1])
+		}
+	}
+	if latest == "" {
+		t.Fatal("chat_threads_type_check not found")
+	}
+	var schema []string
+	for _, v := range strings.Split(latest, ",") {
+		schema = append(schema, strings.Trim(strings.TrimSpace(v), "'"))
+	}
+	got := append([]string(nil), threadTypes...)
+	sort.Strings(schema)
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(schema, ",") {
+		t.Errorf("threadTypes = %v, schema allows %v", got, schema)
+	}
+}
+
+// unreadByType recomputes users' unread per thread type from the
+// memberships, the way the 0054 backfill does, for comparison with the
+// trigger-maintained counters.
+func unreadByType(t *testing.T, pool *pgxpool.Pool, userIDs ...string) map[string]int64 {
+	t.Helper()
+	out := map[string]int64{}
+	rows, err := pool.Query(context.Background(), `
+		select m.user_id::text, t.type, sum(greatest(t.last_seq - m.last_read_seq, 0))::bigint
+		from chat_thread_members m
+		join chat_threads t on t.id = m.thread_id
+		where m.user_id = any($1::uuid[])
+		group by m.user_id, t.type`, userIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			userID, ttype string
+			count         int64
+		)
+		if err := rows.Scan(&userID, &ttype, &count); err != nil {
+			t.Fatal(err)
+		}
+		if count != 0 {
+			out[userID+"/"+ttype] = count
+		}
+	}
+	return out
+}
+
+func sameCounts(x, y map[string]int64) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for k, n := range x {
+		if y[k] != n {
+			return false
+		}
+	}
+	return true
+}
+
+func TestUnreadCountersDB(t *testing.T) {
+	pool := testPool(t)
+	ctx := context.Background()
+	a, b, c := newUUID(), newUUID(), newUUID()
+	order := createTestThread(t, pool, "order", a, "traveler", b, "host")
+	group := createTestThread(t, pool, "group", a, roleOwner)
+	cleanupTestThread(t, pool, order, c)
+
+	exec := func(query string, args ...any) {
+		t.Helper()
+		if _, err := pool.Exec(ctx, query, args...); err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+	}
+	counters := func() map[string]int64 {
+		t.Helper()
+		out := map[string]int64{}
+		for _, userID := range []string{a, b, c} {
+			summary, err := loadUnreadSummary(ctx, pool, userID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ttype, n := range summary.ByType {
+				if n != 0 {
+					out[userID+"/"+ttype] = n
+				}
+			}
+		}
+		return out
+	}
+	check := func(step string, want map[string]int64) {
+		t.Helper()
+		got := counters()
+		if !sameCounts(got, want) {
+			t.Errorf("%s: counters = %v, want %v", step, got, want)
+		}
+		// The incremental triggers must agree with a from-scratch recompute.
+		if recomputed := unreadByType(t, pool, a, b, c); !sameCounts(got, recomputed) {
+			t.Errorf("%s: counters = %v, recomputed %v", step, got, recomputed)
+		}
+	}
+
+	exec(`update chat_threads set last_seq = 3 where id = $1`, order)
+	check("seq bump", map[string]int64{a + "/order": 3, b + "/order": 3})
+
+	exec(`update chat_thread_members set last_read_seq = 3 where thread_id = $1 and user_id = $2`, order, a)
+	check("read", map[string]int64{b + "/order": 3})
+
+	// Joiners start at seq-1, so only the join notice is unread.
+	exec(`update chat_threads set last_seq = 4 where id = $1`, order)
+	exec(`insert into chat_thread_members (thread_id, user_id, role, last_read_seq) values ($1, $2, 'traveler', 3)`, order, c)
+	check("join", map[string]int64{a + "/order": 1, b + "/order": 4, c + "/order": 1})
+
+	exec(`delete from chat_thread_members where thread_id = $1 and user_id = $2`, order, b)
+	check("leave", map[string]int64{a + "/order": 1, c + "/order": 1})
+
+	exec(`update chat_threads set last_seq = 2 where id = $1`, group)
+	check("second type", map[string]int64{a + "/order": 1, a + "/group": 2, c + "/order": 1})
+
+	exec(`delete from chat_threads where id = $1`, order)
+	check("thread delete", map[string]int64{a + "/group": 2})
+}
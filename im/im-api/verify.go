@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"terravoy/im/im-api/internal/redisx"
+	"terravoy/im/imkit/storage"
+)
+
+const (
+	mediaVerifyCacheTTL = 10 * time.Minute
+	magicPrefixBytes    = 16
+	// imUploadMaxExpires caps how long an IM upload URL stays valid. It is
+	// below mediaVerifyCacheTTL so an object is only overwritable for a
+	// short while after it is issued.
+	imUploadMaxExpires = 5 * time.Minute
+)
+
+// imUploadExpires is the lifetime of IM upload URLs: OSS_IM_UPLOAD_EXPIRES_SECONDS
+// (falling back to OSS_UPLOAD_EXPIRES_SECONDS), capped at imUploadMaxExpires.
+func imUploadExpires(cfg Config) time.Duration {
+	secs := cfg.OSSIMUploadExpiresSecs
+	if secs <= 0 {
+		secs = cfg.OSSUploadExpiresSecs
+	}
+	expires := time.Duration(secs) * time.Second
+	if expires <= 0 || expires > imUploadMaxExpires {
+		expires = imUploadMaxExpires
+	}
+	return expires
+}
+
+// uploadWindowClosed reports whether every upload URL that could have
+// written the object has expired. The object was written after its URL was
+// issued, so modified+expires is a safe upper bound.
+func uploadWindowClosed(modified time.Time, expires time.Duration, now time.Time) bool {
+	return !modified.IsZero() && now.After(modified.Add(expires))
+}
+
+// mediaVerifyError is a mismatch between the message content and the stored
+// object; it is the client's fault, unlike storage errors.
+type mediaVerifyError struct {
+	reason string
+}
+
+func (e *mediaVerifyError) Error() string { return e.reason }
+
+// verifiedObject is what the storage reported for an object. The client can
+// overwrite an object until its upload URL expires, so it is only cached by
+// object key once that has happened (see uploadWindowClosed); younger objects
+// are checked against storage on every send.
+type verifiedObject struct {
+	Size    int64  `json:"size"`
+	Mime    string `json:"mime"`
+	MagicOK *bool  `json:"magic_ok,omitempty"`
+}
+
+// verifyMediaObject checks normalized media content against the stored
+// object: it must exist, and its size, content-type and (optionally) leading
+// bytes must match the claims.
+func verifyMediaObject(ctx context.Context, redisClient *redis.Client, cfg Config, store storage.Storage, raw json.RawMessage) error {
+	if store == nil {
+		return errors.New("storage not configured")
+	}
+	var content mediaContent
+	if err := json.Unmarshal(raw, &content); err != nil {
+		return &mediaVerifyError{reason: "invalid media content"}
+	}
+	obj, cached := loadVerifiedObject(ctx, redisClient, content.ObjectKey)
+	cacheable := cached
+	if !cached {
+		info, err := store.Head(ctx, content.ObjectKey)
+		if errors.Is(err, storage.ErrNotFound) {
+			return &mediaVerifyError{reason: "object not found"}
+		}
+		if err != nil {
+			return err
+		}
+		obj = verifiedObject{Size: info.Size, Mime: info.ContentType}
+		cacheable = uploadWindowClosed(info.LastModified, imUploadExpires(cfg), time.Now())
+	}
+	if obj.Size != content.Size {
+		return &mediaVerifyError{reason: fmt.Sprintf("size mismatch: stored %d", obj.Size)}
+	}
+	if baseMime(obj.Mime) != baseMime(content.Mime) {
+		return &mediaVerifyError{reason: "content-type mismatch"}
+	}
+	if cfg.MediaVerifyMagic && obj.MagicOK == nil {
+		head, err := store.ReadPrefix(ctx, content.ObjectKey, magicPrefixBytes)
+		if err != nil {
+			return err
+		}
+		ok := matchesMagic(objectExt(content.ObjectKey), head)
+		obj.MagicOK = &ok
+		cached = false
+	}
+	if !cached && cacheable {
+		storeVerifiedObject(ctx, redisClient, content.ObjectKey, obj)
+	}
+	if obj.MagicOK != nil && !*obj.MagicOK {
+		return &mediaVerifyError{reason: "content does not match extension"}
+	}
+	return nil
+}
+
+func loadVerifiedObject(ctx context.Context, redisClient *redis.Client, objectKey string) (verifiedObject, bool) {
+	var obj verifiedObject
+	if redisClient == nil {
+		return obj, false
+	}
+	raw, err := redisClient.Get(ctx, redisx.KeyMediaVerified(objectKey)).Bytes()
+	if err != nil || json.Unmarshal(raw, &obj) != nil {
+		return verifiedObject{}, false
+	}
+	return obj, true
+}
+
+func storeVerifiedObject(ctx context.Context, redisClient *redis.Client, objectKey string, obj verifiedObject) {
+	if redisClient == nil {
+		return
+	}
+	raw, _ := json.Marshal(obj)
+	_ = redisClient.Set(ctx, redisx.KeyMediaVerified(objectKey), raw, mediaVerifyCacheTTL).Err()
+}
+
+func baseMime(mime string) string {
+	if idx := strings.Index(mime, ";"); idx != -1 {
+		mime = mime[:idx]
+	}
+	return strings.ToLower(strings.TrimSpace(mime))
+}
+
+func objectExt(objectKey string) string {
+	if idx := strings.LastIndex(objectKey, "."); idx != -1 {
+		return strings.ToLower(objectKey[idx+1:])
+	}
+	return ""
+}
+
+// matchesMagic reports whether head starts like a file of type ext.
+// Extensions without a reliable signature (txt) always match.
+func matchesMagic(ext string, head []byte) bool {
+	at := func(offset int, sig string) bool {
+		return len(head) >= offset+len(sig) && bytes.Equal(head[offset:offset+len(sig)], []byte(sig))
+	}
+	switch ext {
+	case "jpg", "jpeg":
+		return at(0, "\xff\xd8\xff")
+	case "png":
+		return at(0, "\x89PNG\r\n\x1a\n")
+	case "gif":
+		return at(0, "GIF87a") || at(0, "GIF89a")
+	case "webp":
+		return at(0, "RIFF") && at(8, "WEBP")
+	case "m4a", "mp4", "mov":
+		return at(4, "ftyp")
+	case "aac":
+		return at(0, "ID3") || (len(head) >= 2 && head[0] == 0xff && head[1]&0xf6 == 0xf0)
+	case "opus":
+		return at(0, "OggS")
+	case "pdf":
+		return at(0, "%PDF-")
+	case "zip", "docx", "xlsx", "pptx":
+		return at(0, "PK\x03\x04")
+	case "doc", "xls", "ppt":
+		return at(0, "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1")
+	default:
+		return true
+	}
+}
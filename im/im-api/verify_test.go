@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"terravoy/im/imkit/ratelimit"
+)
+
+func TestMatchesMagic(t *testing.T) {
+	cases := []struct {
+		ext  string
+		head string
+		want bool
+	}{
+		{"jpg", "\xff\xd8\xff\xe0\x00\x10JFIF", true},
+		{"png", "\xff\xd8\xff\xe0", false},
+		{"webp", "RIFF\x24\x00\x00\x00WEBPVP8 ", true},
+		{"m4a", "\x00\x00\x00\x20ftypM4A ", true},
+		{"aac", "\xff\xf1\x50\x80", true},
+		{"pdf", "PK\x03\x04", false},
+		{"docx", "PK\x03\x04\x14\x00", true},
+		{"txt", "anything", true},
+		{"gif", "GIF8", false},
+	}
+	for _, tc := range cases {
+		if got := matchesMagic(tc.ext, []byte(tc.head)); got != tc.want {
+			t.Errorf("matchesMagic(%q, %q) = %v, want %v", tc.ext, tc.head, got, tc.want)
+		}
+	}
+}
+
+func TestImUploadExpires(t *testing.T) {
+	cases := []struct {
+		im, general int
+		want        time.Duration
+	}{
+		{0, 0, imUploadMaxExpires},
+		{120, 900, 2 * time.Minute},
+		{0, 60, time.Minute},
+		{900, 900, imUploadMaxExpires},
+	}
+	for _, tc := range cases {
+		cfg := Config{OSSIMUploadExpiresSecs: tc.im, OSSUploadExpiresSecs: tc.general}
+		if got := imUploadExpires(cfg); got != tc.want {
+			t.Errorf("imUploadExpires(%d, %d) = %v, want %v", tc.im, tc.general, got, tc.want)
+		}
+	}
+	if imUploadMaxExpires >= mediaVerifyCacheTTL {
+		t.Error("upload URLs must expire before verified objects leave the cache")
+	}
+}
+
+func TestUploadWindowClosed(t *testing.T) {
+	now := time.Now()
+	if uploadWindowClosed(time.Time{}, time.Minute, now) {
+		t.Error("unknown modification time treated as closed")
+	}
+	if uploadWindowClosed(now.Add(-30*time.Second), time.Minute, now) {
+		t.Error("object inside its upload window treated as closed")
+	}
+	if !uploadWindowClosed(now.Add(-2*time.Minute), time.Minute, now) {
+		t.Error("object past its upload window treated as open")
+	}
+}
+
+func TestCreateMessageChecksMembershipBeforeMediaVerifyDB(t *testing.T) {
+	pool := testPool(t)
+	member, outsider := newUUID(), newUUID()
+	threadID := createTestThread(t, pool, "order", member, "traveler")
+	cfg := testMediaConfig()
+	cfg.MediaVerify = true
+	// No store: any verify that runs answers 503 STORAGE_ERROR.
+	send := func(w http.ResponseWriter, r *http.Request) {
+		handleCreateMessage(w, r, pool, nil, nil, ratelimit.New(nil, ratelimit.FailOpen), cfg, nil)
+	}
+	body := func() string {
+		return `{"thread_id":"` + threadID + `","client_msg_id":"` + newUUID() + `","type":"image",` +
+			`"content":{"object_key":"im/dev/2026/01/0b5f3c1e-4a6d-4f0e-9a57-3a2c1d9e8b7f.jpg","mime":"image/jpeg","size":10,"width":1,"height":1}}`
+	}
+	if status, code := callHandler(send, testRequest(http.MethodPost, "/", body(), outsider)); status != http.StatusForbidden || code != "FORBIDDEN" {
+		t.Errorf("outsider: got %d %s, want 403 FORBIDDEN", status, code)
+	}
+	if status, code := callHandler(send, testRequest(http.MethodPost, "/", body(), member)); status != http.StatusServiceUnavailable || code != "STORAGE_ERROR" {
+		t.Errorf("member: got %d %s, want 503 STORAGE_ERROR", status, code)
+	}
+}
@@ -26,12 +26,47 @@ type Config struct {
 	PushBackoffMs      int
 	FCMServiceJSON     string
 	FCMServicePath     string
+	// 媒体存储（与 im-api 相同的 IM_STORAGE_BACKEND / OSS_* / IM_S3_* / IM_STORAGE_LOCAL_* 配置）
+	StorageBackend      string
+	OSSEndpoint         string
+	OSSBucketIM         string
+	OSSAccessKeyID      string
+	OSSAccessKeySecret  string
+	S3Endpoint          string
+	S3Region            string
+	S3Bucket            string
+	S3AccessKeyID       string
+	S3SecretAccessKey   string
+	S3UseSSL            bool
+	S3PathStyle         bool
+	LocalStorageDir     string
+	LocalStorageBaseURL string
+	LocalStorageSecret  string
+	MediaImageMaxBytes  int   // 原图超过此大小不生成缩略图
+	MediaMaxPixels      int64 // 解码像素上限，防止解压炸弹
+	MediaURLExpiresSecs int   // media_ready 事件中签名链接有效期（秒）
 }
 
 const (
 	streamKey = "im:push:stream"
 	dlqKey    = "im:push:dlq"
 	groupName = "im-push-workers"
+
+	mediaStreamKey = "im:media:stream"
+	mediaDLQKey    = "im:media:dlq"
+	mediaGroupName = "im-media-workers"
+)
+
+// workQueue is a Redis stream consumed by a group, with its dead-letter stream.
+type workQueue struct {
+	stream string
+	dlq    string
+	group  string
+}
+
+var (
+	pushQueue  = workQueue{stream: streamKey, dlq: dlqKey, group: groupName}
+	mediaQueue = workQueue{stream: mediaStreamKey, dlq: mediaDLQKey, group: mediaGroupName}
 )
 
 func main() {
@@ -47,9 +82,22 @@ func main() {
 
 	pushClient := initFCM(ctx, cfg)
 
+	// 与 im-api 相同：local 后端必须单独配置 IM_STORAGE_LOCAL_SECRET
+	if cfg.StorageBackend == "local" && cfg.LocalStorageSecret == "" {
+		log.Fatal().Msg("IM_STORAGE_LOCAL_SECRET is required with IM_STORAGE_BACKEND=local")
+	}
+	store, err := newStorage(cfg)
+	if err != nil {
+		log.Warn().Err(err).Str("backend", cfg.StorageBackend).Msg("media storage disabled: thumbnails will not be generated")
+	}
+
 	if redisClient != nil {
-		ensureStreamGroup(ctx, redisClient)
+		ensureStreamGroup(ctx, redisClient, streamKey, groupName)
 		go consumePush(ctx, redisClient, pool, pushClient, cfg)
+		if store != nil {
+			ensureStreamGroup(ctx, redisClient, mediaStreamKey, mediaGroupName)
+			go consumeMedia(ctx, redisClient, pool, store, cfg)
+		}
 	}
 	go retentionLoop(ctx, pool, cfg)
 
@@ -67,14 +115,32 @@ func setupLogger() {
 
 func loadConfig() Config {
 	return Config{
-		DBDsn:              env("IM_DB_DSN", ""),
-		RedisURL:           env("IM_REDIS_URL", ""),
-		RetentionMatchDays: envInt("IM_RETENTION_MATCH_DAYS", 14),
-		RetentionOrderDays: envInt("IM_RETENTION_ORDER_DAYS", 180),
-		PushMaxRetries:     envInt("PUSH_MAX_RETRIES", 5),
-		PushBackoffMs:      envInt("PUSH_RETRY_BACKOFF_MS", 1000),
-		FCMServiceJSON:     env("FCM_SERVICE_ACCOUNT_JSON", ""),
-		FCMServicePath:     env("FCM_SERVICE_ACCOUNT_PATH", ""),
+		DBDsn:               env("IM_DB_DSN", ""),
+		RedisURL:            env("IM_REDIS_URL", ""),
+		RetentionMatchDays:  envInt("IM_RETENTION_MATCH_DAYS", 14),
+		RetentionOrderDays:  envInt("IM_RETENTION_ORDER_DAYS", 180),
+		PushMaxRetries:      envInt("PUSH_MAX_RETRIES", 5),
+		PushBackoffMs:       envInt("PUSH_RETRY_BACKOFF_MS", 1000),
+		FCMServiceJSON:      env("FCM_SERVICE_ACCOUNT_JSON", ""),
+		FCMServicePath:      env("FCM_SERVICE_ACCOUNT_PATH", ""),
+		StorageBackend:      strings.ToLower(env("IM_STORAGE_BACKEND", "oss")),
+		OSSEndpoint:         env("OSS_ENDPOINT", ""),
+		OSSBucketIM:         env("OSS_BUCKET_IM", ""),
+		OSSAccessKeyID:      env("OSS_ACCESS_KEY_ID", ""),
+		OSSAccessKeySecret:  env("OSS_ACCESS_KEY_SECRET", ""),
+		S3Endpoint:          env("IM_S3_ENDPOINT", ""),
+		S3Region:            env("IM_S3_REGION", ""),
+		S3Bucket:            env("IM_S3_BUCKET", ""),
+		S3AccessKeyID:       env("IM_S3_ACCESS_KEY_ID", ""),
+		S3SecretAccessKey:   env("IM_S3_SECRET_ACCESS_KEY", ""),
+		S3UseSSL:            envBool("IM_S3_USE_SSL", true),
+		S3PathStyle:         envBool("IM_S3_PATH_STYLE", false),
+		LocalStorageDir:     env("IM_STORAGE_LOCAL_DIR", "./data/im-media"),
+		LocalStorageBaseURL: env("IM_STORAGE_LOCAL_BASE_URL", "http://localhost:8090/v1/media/local"),
+		LocalStorageSecret:  env("IM_STORAGE_LOCAL_SECRET", ""),
+		MediaImageMaxBytes:  envInt("IM_MEDIA_IMAGE_MAX_BYTES", 20<<20),
+		MediaMaxPixels:      int64(envInt("IM_MEDIA_THUMB_MAX_PIXELS", 50_000_000)),
+		MediaURLExpiresSecs: envInt("IM_MEDIA_URL_EXPIRES_SECONDS", 600),
 	}
 }
 
@@ -94,6 +160,15 @@ func envInt(key string, fallback int) int {
 	return fallback
 }
 
+func envBool(key string, fallback bool) bool {
+	if v := os.Getenv(key); v != "" {
+		if parsed, err := strconv.ParseBool(v); err == nil {
+			return parsed
+		}
+	}
+	return fallback
+}
+
 func newRedisClient(url string) *redis.Client {
 	if url == "" {
 		return nil
@@ -129,10 +204,10 @@ func initFCM(ctx context.Context, cfg Config) *messaging.Client {
 	return client
 }
 
-func ensureStreamGroup(ctx context.Context, client *redis.Client) {
-	_, err := client.XGroupCreateMkStream(ctx, streamKey, groupName, "0").Result()
+func ensureStreamGroup(ctx context.Context, client *redis.Client, stream, group string) {
+	_, err := client.XGroupCreateMkStream(ctx, stream, group, "0").Result()
 	if err != nil && !strings.Contains(err.Error(), "BUSYGROUP") {
-		log.Error().Err(err).Msg("stream group init failed")
+		log.Error().Err(err).Str("stream", stream).Msg("stream group init failed")
 	}
 }
 
@@ -191,7 +266,11 @@ func handlePushMessage(ctx context.Context, rdb *redis.Client, pool *pgxpool.Poo
 	}
 	if fcm == nil {
 		log.Warn().Str("user_id", toUserID).Msg("FCM not configured")
-		return retryOrDLQ(ctx, rdb, msg, payload, attempt, cfg.PushMaxRetries, cfg.PushBackoffMs, "fcm_not_configured")
+		return retryOrDLQ(ctx, rdb, pushQueue, msg, payload, attempt, cfg.PushMaxRetries, cfg.PushBackoffMs, "fcm_not_configured")
+	}
+	badge, err := fetchUnreadBadge(ctx, pool, toUserID)
+	if err != nil {
+		log.Warn().Err(err).Str("user_id", toUserID).Msg("badge lookup failed")
 	}
 	resp, err := fcm.SendMulticast(ctx, &messaging.MulticastMessage{
 		Tokens: tokens,
@@ -199,6 +278,7 @@ func handlePushMessage(ctx context.Context, rdb *redis.Client, pool *pgxpool.Poo
 			"thread_id": threadID,
 			"seq":       seq,
 			"msg_id":    msgID,
+			"badge":     strconv.FormatInt(badge, 10),
 		},
 	})
 	if err == nil && resp.FailureCount == 0 {
@@ -206,7 +286,7 @@ func handlePushMessage(ctx context.Context, rdb *redis.Client, pool *pgxpool.Poo
 		_ = rdb.XAck(ctx, streamKey, groupName, msg.ID).Err()
 		return nil
 	}
-	return retryOrDLQ(ctx, rdb, msg, payload, attempt, cfg.PushMaxRetries, cfg.PushBackoffMs, "push_failed")
+	return retryOrDLQ(ctx, rdb, pushQueue, msg, payload, attempt, cfg.PushMaxRetries, cfg.PushBackoffMs, "push_failed")
 }
 
 func fetchDeviceTokens(ctx context.Context, pool *pgxpool.Pool, userID string) ([]string, error) {
@@ -229,18 +309,30 @@ func fetchDeviceTokens(ctx context.Context, pool *pgxpool.Pool, userID string) (
 	return tokens, nil
 }
 
-func retryOrDLQ(ctx context.Context, rdb *redis.Client, msg redis.XMessage, payload map[string]string, attempt int, maxRetries int, backoffBase int, errCode string) error {
+// fetchUnreadBadge returns the user's total unread count from the counters
+// im-api's schema keeps up to date (chat_unread_counters, migration 0054),
+// read at send time so retried pushes carry the current value.
+func fetchUnreadBadge(ctx context.Context, pool *pgxpool.Pool, userID string) (int64, error) {
+	var badge int64
+	err := pool.QueryRow(ctx, `
+		select coalesce(sum(greatest(unread_count, 0)), 0)::bigint
+		from chat_unread_counters
+		where user_id = $1`, userID).Scan(&badge)
+	return badge, err
+}
+
+func retryOrDLQ(ctx context.Context, rdb *redis.Client, q workQueue, msg redis.XMessage, payload map[string]string, attempt int, maxRetries int, backoffBase int, errCode string) error {
 	if attempt+1 >= maxRetries {
 		payload["error"] = errCode
 		payload["failed_at_ms"] = fmt.Sprintf("%d", time.Now().UnixMilli())
-		_, _ = rdb.XAdd(ctx, &redis.XAddArgs{Stream: dlqKey, Values: payload}).Result()
-		_ = rdb.XAck(ctx, streamKey, groupName, msg.ID).Err()
+		_, _ = rdb.XAdd(ctx, &redis.XAddArgs{Stream: q.dlq, Values: payload}).Result()
+		_ = rdb.XAck(ctx, q.stream, q.group, msg.ID).Err()
 		return nil
 	}
-	_ = rdb.XAck(ctx, streamKey, groupName, msg.ID).Err()
+	_ = rdb.XAck(ctx, q.stream, q.group, msg.ID).Err()
 	payload["attempt"] = strconv.Itoa(attempt + 1)
 	payload["available_at_ms"] = fmt.Sprintf("%d", time.Now().UnixMilli()+backoffMs(backoffBase, attempt+1))
-	_, _ = rdb.XAdd(ctx, &redis.XAddArgs{Stream: streamKey, Values: payload}).Result()
+	_, _ = rdb.XAdd(ctx, &redis.XAddArgs{Stream: q.stream, Values: payload}).Result()
 	return nil
 }
 
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"terravoy/im/imkit/storage"
+)
+
+const mediaMaxRetries = 5
+
+// newStorage 根据 IM_STORAGE_BACKEND 创建媒体存储，与 im-api 保持一致
+func newStorage(cfg Config) (storage.Storage, error) {
+	switch cfg.StorageBackend {
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Endpoint:        cfg.S3Endpoint,
+			Region:          cfg.S3Region,
+			Bucket:          cfg.S3Bucket,
+			AccessKeyID:     cfg.S3AccessKeyID,
+			SecretAccessKey: cfg.S3SecretAccessKey,
+			UseSSL:          cfg.S3UseSSL,
+			PathStyle:       cfg.S3PathStyle,
+		})
+	case "local":
+		return storage.NewLocal(storage.LocalConfig{
+			Root:    cfg.LocalStorageDir,
+			BaseURL: cfg.LocalStorageBaseURL,
+			Secret:  cfg.LocalStorageSecret,
+		})
+	default:
+		return storage.NewOSS(storage.OSSConfig{
+			Endpoint:        cfg.OSSEndpoint,
+			Bucket:          cfg.OSSBucketIM,
+			AccessKeyID:     cfg.OSSAccessKeyID,
+			AccessKeySecret: cfg.OSSAccessKeySecret,
+		})
+	}
+}
+
+func consumeMedia(ctx context.Context, rdb *redis.Client, pool *pgxpool.Pool, store storage.Storage, cfg Config) {
+	consumer := fmt.Sprintf("media-%d", time.Now().UnixNano())
+	for {
+		streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    mediaGroupName,
+			Consumer: consumer,
+			Streams:  []string{mediaStreamKey, ">"},
+			Count:    4,
+			Block:    5 * time.Second,
+		}).Result()
+		if err != nil && !errorsIsRedisNil(err) {
+			log.Error().Err(err).Msg("media stream read failed")
+			continue
+		}
+		for _, stream := range streams {
+			for _, msg := range stream.Messages {
+				if err := handleMediaJob(ctx, rdb, pool, store, cfg, msg); err != nil {
+					log.Error().Err(err).Msg("media job failed")
+				}
+			}
+		}
+	}
+}
+
+// handleMediaJob generates the variants and blurhash of an image message,
+// merges them into its content and emits media_ready. Jobs that cannot
+// succeed (message gone or recalled, object missing, undecodable image) are
+// dropped; storage and database errors are retried.
+func handleMediaJob(ctx context.Context, rdb *redis.Client, pool *pgxpool.Pool, store storage.Storage, cfg Config, msg redis.XMessage) error {
+	payload := map[string]string{}
+	for k, v := range msg.Values {
+		payload[k] = fmt.Sprintf("%v", v)
+	}
+	availableAt, _ := strconv.ParseInt(payload["available_at_ms"], 10, 64)
+	if availableAt > 0 && time.Now().UnixMilli() < availableAt {
+		_ = rdb.XAck(ctx, mediaStreamKey, mediaGroupName, msg.ID).Err()
+		_, _ = rdb.XAdd(ctx, &redis.XAddArgs{Stream: mediaStreamKey, Values: payload}).Result()
+		return nil
+	}
+	msgID := payload["msg_id"]
+	threadID := payload["thread_id"]
+	objectKey := payload["object_key"]
+	attempt, _ := strconv.Atoi(payload["attempt"])
+	done := func() error {
+		return rdb.XAck(ctx, mediaStreamKey, mediaGroupName, msg.ID).Err()
+	}
+	logger := log.With().Str("msg_id", msgID).Str("object_key", objectKey).Logger()
+
+	var (
+		msgType    string
+		content    []byte
+		recalledAt *time.Time
+	)
+	err := pool.QueryRow(ctx, `
+		select type::text, content, recalled_at
+		from chat_messages
+		where id = $1 and thread_id = $2`,
+		msgID, threadID,
+	).Scan(&msgType, &content, &recalledAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return done()
+	}
+	if err != nil {
+		return retryOrDLQ(ctx, rdb, mediaQueue, msg, payload, attempt, mediaMaxRetries, cfg.PushBackoffMs, "db_error")
+	}
+	if msgType != "image" || recalledAt != nil || hasMediaVariants(content) {
+		return done()
+	}
+
+	data, err := store.ReadPrefix(ctx, objectKey, int64(cfg.MediaImageMaxBytes)+1)
+	if errors.Is(err, storage.ErrNotFound) {
+		logger.Warn().Msg("media job dropped: object not found")
+		return done()
+	}
+	if err != nil {
+		return retryOrDLQ(ctx, rdb, mediaQueue, msg, payload, attempt, mediaMaxRetries, cfg.PushBackoffMs, "storage_error")
+	}
+	if len(data) > cfg.MediaImageMaxBytes {
+		logger.Warn().Int("max_bytes", cfg.MediaImageMaxBytes).Msg("media job dropped: object too large")
+		return done()
+	}
+	rendered, err := renderImage(data, cfg.MediaMaxPixels)
+	if err != nil {
+		logger.Warn().Err(err).Msg("media job dropped: image not decodable")
+		return done()
+	}
+
+	patch, keys, err := uploadVariants(ctx, store, objectKey, rendered)
+	if err != nil {
+		return retryOrDLQ(ctx, rdb, mediaQueue, msg, payload, attempt, mediaMaxRetries, cfg.PushBackoffMs, "storage_error")
+	}
+	seq, changeSeq, merged, err := applyMediaPatch(ctx, pool, threadID, msgID, patch)
+	if errors.Is(err, pgx.ErrNoRows) {
+		// recalled while we were rendering
+		for _, key := range keys {
+			_ = store.Delete(ctx, key)
+		}
+		return done()
+	}
+	if err != nil {
+		return retryOrDLQ(ctx, rdb, mediaQueue, msg, payload, attempt, mediaMaxRetries, cfg.PushBackoffMs, "db_error")
+	}
+	publishThreadEvent(ctx, rdb, threadID, "media_ready", map[string]any{
+		"msg_id":     msgID,
+		"seq":        seq,
+		"change_seq": changeSeq,
+		"content":    signMediaContent(ctx, store, cfg, merged),
+	})
+	logger.Info().Int("variants", len(keys)).Int64("change_seq", changeSeq).Msg("media ready")
+	return done()
+}
+
+// hasMediaVariants reports whether content was already processed, which
+// makes redelivered jobs no-ops.
+func hasMediaVariants(content []byte) bool {
+	var media struct {
+		Variants json.RawMessage `json:"variants"`
+	}
+	return json.Unmarshal(content, &media) == nil && len(media.Variants) > 0
+}
+
+type mediaVariant struct {
+	ObjectKey string `json:"object_key"`
+	Mime      string `json:"mime"`
+	Size      int64  `json:"size"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+}
+
+// uploadVariants stores rendered variants next to the original
+// ("{key}_{variant}.jpg", same prefix and so same lifecycle rule) and returns
+// the content patch and the keys written.
+func uploadVariants(ctx context.Context, store storage.Storage, objectKey string, rendered renderedImage) (json.RawMessage, []string, error) {
+	base := strings.TrimSuffix(objectKey, path.Ext(objectKey))
+	variants := map[string]mediaVariant{}
+	keys := make([]string, 0, len(rendered.Variants))
+	for _, v := range rendered.Variants {
+		key := base + "_" + v.Name + ".jpg"
+		if err := store.Put(ctx, key, "image/jpeg", bytes.NewReader(v.Data), int64(len(v.Data))); err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, key)
+		variants[v.Name] = mediaVariant{
+			ObjectKey: key,
+			Mime:      "image/jpeg",
+			Size:      int64(len(v.Data)),
+			Width:     v.Width,
+			Height:    v.Height,
+		}
+	}
+	patch, err := json.Marshal(map[string]any{
+		"variants": variants,
+		"blurhash": rendered.Blurhash,
+	})
+	return patch, keys, err
+}
+
+// applyMediaPatch merges patch into the message content under a new
+// change_seq, so clients syncing by change_seq pick up the variants. It
+// returns pgx.ErrNoRows if the message was recalled meanwhile.
+func applyMediaPatch(ctx context.Context, pool *pgxpool.Pool, threadID, msgID string, patch json.RawMessage) (int64, int64, []byte, error) {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	defer tx.Rollback(ctx)
+	var seq int64
+	err = tx.QueryRow(ctx, `
+		select seq
+		from chat_messages
+		where id = $1 and recalled_at is null
+		for update`,
+		msgID,
+	).Scan(&seq)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var changeSeq int64
+	err = tx.QueryRow(ctx, `
+		update chat_threads
+		set last_change_seq = last_change_seq + 1,
+		    updated_at = now()
+		where id = $1
+		returning last_change_seq`,
+		threadID,
+	).Scan(&changeSeq)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	var merged []byte
+	err = tx.QueryRow(ctx, `
+		update chat_messages
+		set content = content || $2::jsonb,
+		    change_seq = $3
+		where id = $1
+		returning content`,
+		msgID, patch, changeSeq,
+	).Scan(&merged)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return seq, changeSeq, merged, tx.Commit(ctx)
+}
+
+// signMediaContent mirrors im-api: stored content carries object keys only,
+// so the event gets short-lived signed URLs for the original and variants.
+func signMediaContent(ctx context.Context, store storage.Storage, cfg Config, content []byte) json.RawMessage {
+	var fields map[string]any
+	if err := json.Unmarshal(content, &fields); err != nil {
+		return content
+	}
+	expiry := time.Duration(cfg.MediaURLExpiresSecs) * time.Second
+	if expiry <= 0 {
+		expiry = 10 * time.Minute
+	}
+	if key, _ := fields["object_key"].(string); key != "" {
+		if url, err := store.SignGet(ctx, key, expiry); err == nil {
+			fields["url"] = url
+			fields["url_expires_at"] = time.Now().Add(expiry).UTC().Format(time.RFC3339)
+		}
+	}
+	if variants, ok := fields["variants"].(map[string]any); ok {
+		for _, v := range variants {
+			if variant, ok := v.(map[string]any); ok {
+				if key, _ := variant["object_key"].(string); key != "" {
+					if url, err := store.SignGet(ctx, key, expiry); err == nil {
+						variant["url"] = url
+					}
+				}
+			}
+		}
+	}
+	signed, err := json.Marshal(fields)
+	if err != nil {
+		return content
+	}
+	return signed
+}
+
+// publishThreadEvent mirrors im-api: a {"type", "payload"} frame on the
+// thread's fanout channel, forwarded as-is by the gateways.
+func publishThreadEvent(ctx context.Context, rdb *redis.Client, threadID, eventType string, payload map[string]any) {
+	payload["thread_id"] = threadID
+	data, err := json.Marshal(map[string]any{
+		"type":    eventType,
+		"payload": payload,
+	})
+	if err != nil {
+		return
+	}
+	if err := rdb.Publish(ctx, "im:fanout:"+threadID, data).Err(); err != nil {
+		log.Warn().Err(err).Str("thread_id", threadID).Str("event", eventType).Msg("thread event publish failed")
+	}
+}
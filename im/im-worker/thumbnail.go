@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+
+	"github.com/buckket/go-blurhash"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// imageVariants are the resized copies generated for image messages; a
+// variant is skipped when the original already fits within it.
+var imageVariants = []struct {
+	Name    string
+	MaxSide int
+}{
+	{Name: "thumb", MaxSide: 320},
+	{Name: "preview", MaxSide: 1280},
+}
+
+const (
+	variantJPEGQuality = 80
+	blurhashSide       = 32
+	blurhashXComp      = 4
+	blurhashYComp      = 3
+)
+
+var errImageTooLarge = errors.New("image exceeds pixel limit")
+
+type renderedVariant struct {
+	Name   string
+	Width  int
+	Height int
+	Data   []byte
+}
+
+type renderedImage struct {
+	Variants []renderedVariant
+	Blurhash string
+}
+
+// renderImage decodes an uploaded image and renders its JPEG variants and
+// blurhash, upright according to the JPEG EXIF orientation. Transparent
+// areas are flattened onto white.
+func renderImage(data []byte, maxPixels int64) (renderedImage, error) {
+	var out renderedImage
+	conf, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return out, err
+	}
+	if int64(conf.Width)*int64(conf.Height) > maxPixels {
+		return out, errImageTooLarge
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return out, err
+	}
+	orientation := jpegOrientation(data)
+	for _, v := range imageVariants {
+		w, h, ok := fitWithin(src.Bounds().Dx(), src.Bounds().Dy(), v.MaxSide)
+		if !ok {
+			continue
+		}
+		img := orient(scale(src, w, h, draw.CatmullRom), orientation)
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: variantJPEGQuality}); err != nil {
+			return out, err
+		}
+		out.Variants = append(out.Variants, renderedVariant{
+			Name:   v.Name,
+			Width:  img.Bounds().Dx(),
+			Height: img.Bounds().Dy(),
+			Data:   buf.Bytes(),
+		})
+	}
+	w, h, ok := fitWithin(src.Bounds().Dx(), src.Bounds().Dy(), blurhashSide)
+	if !ok {
+		w, h = src.Bounds().Dx(), src.Bounds().Dy()
+	}
+	out.Blurhash, err = blurhash.Encode(blurhashXComp, blurhashYComp, orient(scale(src, w, h, draw.ApproxBiLinear), orientation))
+	return out, err
+}
+
+// fitWithin scales w×h down to fit maxSide×maxSide, keeping the aspect
+// ratio; ok is false if it already fits.
+func fitWithin(w, h, maxSide int) (int, int, bool) {
+	if w <= maxSide && h <= maxSide {
+		return w, h, false
+	}
+	if w >= h {
+		return maxSide, max(1, (h*maxSide+w/2)/w), true
+	}
+	return max(1, (w*maxSide+h/2)/h), maxSide, true
+}
+
+func scale(src image.Image, w, h int, interp draw.Interpolator) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	interp.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+	return dst
+}
+
+// orient applies an EXIF orientation (1-8) to img.
+func orient(img *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs 90° counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.SetRGBA(x, y, img.RGBAAt(sx, sy))
+		}
+	}
+	return dst
+}
+
+// jpegOrientation returns the EXIF orientation of a JPEG, or 1 if absent.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			return 1
+		}
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 { // start of scan / end of image
+			return 1
+		}
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+		if size < 2 || i+2+size > len(data) {
+			return 1
+		}
+		segment := data[i+4 : i+2+size]
+		if marker == 0xe1 && len(segment) >= 6 && string(segment[:6]) == "Exif\x00\x00" {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + size
+	}
+	return 1
+}
+
+// exifOrientation reads tag 0x0112 from IFD0 of a TIFF-structured EXIF block.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int64(order.Uint32(tiff[4:]))
+	if ifd+2 > int64(len(tiff)) {
+		return 1
+	}
+	entries := int64(order.Uint16(tiff[ifd:]))
+	for k := int64(0); k < entries; k++ {
+		entry := ifd + 2 + 12*k
+		if entry+12 > int64(len(tiff)) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			if v := int(order.Uint16(tiff[entry+8:])); v >= 1 && v <= 8 {
+				return v
+			}
+			return 1
+		}
+	}
+	return 1
+}
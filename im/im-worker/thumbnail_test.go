@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRenderImageVariants(t *testing.T) {
+	out, err := renderImage(encodePNG(t, 2000, 1000), 50_000_000)
+	if err != nil {
+		t.Fatalf("renderImage: %v", err)
+	}
+	if len(out.Variants) != 2 || out.Blurhash == "" {
+		t.Fatalf("got %d variants, blurhash %q", len(out.Variants), out.Blurhash)
+	}
+	want := map[string][2]int{"thumb": {320, 160}, "preview": {1280, 640}}
+	for _, v := range out.Variants {
+		if dims := want[v.Name]; v.Width != dims[0] || v.Height != dims[1] {
+			t.Errorf("%s: %dx%d, want %v", v.Name, v.Width, v.Height, dims)
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(v.Data)); err != nil {
+			t.Errorf("%s: not a JPEG: %v", v.Name, err)
+		}
+	}
+
+	small, err := renderImage(encodePNG(t, 200, 100), 50_000_000)
+	if err != nil || len(small.Variants) != 0 || small.Blurhash == "" {
+		t.Fatalf("small image: %+v, %v", small, err)
+	}
+	if _, err := renderImage(encodePNG(t, 200, 100), 1000); err != errImageTooLarge {
+		t.Fatalf("pixel limit: %v", err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// 2x1: red, blue
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	red, blue := color.RGBA{R: 255, A: 255}, color.RGBA{B: 255, A: 255}
+	img.SetRGBA(0, 0, red)
+	img.SetRGBA(1, 0, blue)
+
+	cw := orient(img, 6)
+	if cw.Bounds().Dx() != 1 || cw.Bounds().Dy() != 2 || cw.RGBAAt(0, 0) != red || cw.RGBAAt(0, 1) != blue {
+		t.Fatalf("orientation 6: %v %v", cw.RGBAAt(0, 0), cw.RGBAAt(0, 1))
+	}
+	ccw := orient(img, 8)
+	if ccw.RGBAAt(0, 0) != blue || ccw.RGBAAt(0, 1) != red {
+		t.Fatalf("orientation 8: %v %v", ccw.RGBAAt(0, 0), ccw.RGBAAt(0, 1))
+	}
+	if flipped := orient(img, 2); flipped.RGBAAt(0, 0) != blue {
+		t.Fatalf("orientation 2: %v", flipped.RGBAAt(0, 0))
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		tiff := make([]byte, 8+2+12)
+		if order == binary.LittleEndian {
+			copy(tiff, "II")
+		} else {
+			copy(tiff, "MM")
+		}
+		order.PutUint16(tiff[2:], 42)
+		order.PutUint32(tiff[4:], 8)
+		order.PutUint16(tiff[8:], 1)
+		order.PutUint16(tiff[10:], 0x0112)
+		order.PutUint16(tiff[12:], 3) // SHORT
+		order.PutUint32(tiff[14:], 1)
+		order.PutUint16(tiff[18:], 6)
+		app1 := append([]byte("Exif\x00\x00"), tiff...)
+		data := []byte{0xff, 0xd8, 0xff, 0xe1, 0, 0}
+		binary.BigEndian.PutUint16(data[4:], uint16(len(app1)+2))
+		data = append(data, app1...)
+		data = append(data, 0xff, 0xda, 0, 2)
+		if got := jpegOrientation(data); got != 6 {
+			t.Errorf("%v: orientation %d, want 6", order, got)
+		}
+	}
+	if got := jpegOrientation(encodePNG(t, 1, 1)); got != 1 {
+		t.Errorf("png: orientation %d", got)
+	}
+	if got := jpegOrientation([]byte{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff}); got != 1 {
+		t.Errorf("truncated: orientation %d", got)
+	}
+}
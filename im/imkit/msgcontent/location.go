@@ -0,0 +1,76 @@
+// Package msgcontent validates message content that both im-gateway and
+// im-api check.
+package msgcontent
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	TypeLocation = "location"
+
+	maxPlaceNameRunes = 100
+	maxAddressRunes   = 200
+)
+
+// Location is the content of a location message.
+type Location struct {
+	Lat     float64 `json:"lat"`
+	Lng     float64 `json:"lng"`
+	Name    string  `json:"name,omitempty"`
+	Address string  `json:"address,omitempty"`
+}
+
+// NormalizeLocation validates location content and returns it re-encoded
+// with only the known fields.
+func NormalizeLocation(raw json.RawMessage) (json.RawMessage, error) {
+	loc, err := ParseLocation(raw)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(loc)
+}
+
+// ParseLocation validates location content: lat/lng are required and in
+// range, name and address are optional and trimmed.
+func ParseLocation(raw json.RawMessage) (Location, error) {
+	var content struct {
+		Lat     *float64 `json:"lat"`
+		Lng     *float64 `json:"lng"`
+		Name    string   `json:"name"`
+		Address string   `json:"address"`
+	}
+	if len(raw) == 0 || string(raw) == "null" {
+		return Location{}, errors.New("location content required")
+	}
+	if err := json.Unmarshal(raw, &content); err != nil {
+		return Location{}, errors.New("invalid location content")
+	}
+	if content.Lat == nil || content.Lng == nil {
+		return Location{}, errors.New("lat/lng required")
+	}
+	lat, lng := *content.Lat, *content.Lng
+	if math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return Location{}, errors.New("lat out of range")
+	}
+	if math.IsNaN(lng) || lng < -180 || lng > 180 {
+		return Location{}, errors.New("lng out of range")
+	}
+	loc := Location{
+		Lat:     lat,
+		Lng:     lng,
+		Name:    strings.TrimSpace(content.Name),
+		Address: strings.TrimSpace(content.Address),
+	}
+	if utf8.RuneCountInString(loc.Name) > maxPlaceNameRunes {
+		return Location{}, errors.New("name too long")
+	}
+	if utf8.RuneCountInString(loc.Address) > maxAddressRunes {
+		return Location{}, errors.New("address too long")
+	}
+	return loc, nil
+}
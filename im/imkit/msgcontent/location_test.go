@@ -0,0 +1,27 @@
+package msgcontent
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeLocation(t *testing.T) {
+	got, err := NormalizeLocation(json.RawMessage(`{"lat":31.2,"lng":121.5,"name":" 外滩 ","extra":1}`))
+	if err != nil || string(got) != `{"lat":31.2,"lng":121.5,"name":"外滩"}` {
+		t.Fatalf("NormalizeLocation = %s, %v", got, err)
+	}
+	for _, bad := range []string{
+		``,
+		`null`,
+		`[]`,
+		`{"lat":31.2}`,
+		`{"lat":91,"lng":0}`,
+		`{"lat":0,"lng":-181}`,
+		`{"lat":0,"lng":0,"name":"` + strings.Repeat("地", maxPlaceNameRunes+1) + `"}`,
+	} {
+		if _, err := NormalizeLocation(json.RawMessage(bad)); err == nil {
+			t.Errorf("NormalizeLocation(%q) accepted", bad)
+		}
+	}
+}
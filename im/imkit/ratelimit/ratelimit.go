@@ -0,0 +1,211 @@
+// Package ratelimit is the Redis sliding-window rate limiter shared by
+// im-gateway and im-api, with an explicit policy for when Redis is down.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// Rate limit fail modes, applied while Redis is unavailable.
+const (
+	FailOpen   = "open"
+	FailClosed = "closed"
+	FailLocal  = "local"
+)
+
+// ErrUnavailable is returned by Limiter.Allow in fail-closed mode
+// when the Redis limiter cannot be reached.
+var ErrUnavailable = errors.New("rate limiter unavailable")
+
+var (
+	rateLimitDegraded = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rate_limit_degraded",
+		Help: "1 while the Redis rate limiter is unavailable and the fail mode is in effect",
+	})
+	rateLimitDegradedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rate_limit_degraded_decisions_total",
+		Help: "Rate limit decisions made without Redis, by fail mode and outcome",
+	}, []string{"mode", "outcome"})
+)
+
+// Collectors returns the metrics owned by Limiter for registration.
+func Collectors() []prometheus.Collector {
+	return []prometheus.Collector{rateLimitDegraded, rateLimitDegradedTotal}
+}
+
+var rateScript = redis.NewScript(`
+local key = KEYS[1]
+local window_ms = tonumber(ARGV[1])
+local max_hits = tonumber(ARGV[2])
+local now = redis.call('TIME')
+local now_ms = (now[1] * 1000) + math.floor(now[2] / 1000)
+local window_start = now_ms - window_ms
+redis.call('ZREMRANGEBYSCORE', key, 0, window_start)
+local count = redis.call('ZCARD', key)
+if count >= max_hits then
+  local earliest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+  local oldest = tonumber(earliest[2]) or now_ms
+  local retry_after_ms = oldest + window_ms - now_ms
+  if retry_after_ms < 0 then retry_after_ms = 0 end
+  return {0, retry_after_ms}
+end
+redis.call('ZADD', key, now_ms, tostring(now_ms))
+redis.call('PEXPIRE', key, window_ms + 1000)
+return {1, 0}
+`)
+
+// Allow records a hit on key in a sliding window of windowMs and reports
+// whether it fits under max, with the retry delay in ms when it doesn't.
+// Without a client every hit is allowed.
+func Allow(ctx context.Context, client *redis.Client, key string, windowMs int, max int) (bool, int64, error) {
+	if client == nil {
+		return true, 0, nil
+	}
+	res, err := rateScript.Run(ctx, client, []string{key}, windowMs, max).Result()
+	if err != nil {
+		return false, 0, err
+	}
+	values, ok := res.([]interface{})
+	if !ok || len(values) < 2 {
+		return false, 0, errors.New("rate limiter invalid response")
+	}
+	allowed, _ := values[0].(int64)
+	retry, _ := values[1].(int64)
+	return allowed == 1, retry, nil
+}
+
+// NormalizeFailMode maps a config value onto a known fail mode, defaulting to local.
+func NormalizeFailMode(mode string) string {
+	switch strings.ToLower(strings.TrimSpace(mode)) {
+	case FailOpen:
+		return FailOpen
+	case FailClosed:
+		return FailClosed
+	default:
+		return FailLocal
+	}
+}
+
+// Limiter wraps Allow with an explicit policy for Redis errors.
+type Limiter struct {
+	client   *redis.Client
+	mode     string
+	local    *localLimiter
+	degraded atomic.Bool
+}
+
+func New(client *redis.Client, mode string) *Limiter {
+	return &Limiter{
+		client: client,
+		mode:   NormalizeFailMode(mode),
+		local:  newLocalLimiter(),
+	}
+}
+
+// Allow reports whether a hit on key fits in the sliding window, applying
+// the fail mode when Redis returns an error.
+func (l *Limiter) Allow(ctx context.Context, key string, windowMs int, max int) (bool, int64, error) {
+	allowed, retry, err := Allow(ctx, l.client, key, windowMs, max)
+	if err == nil {
+		l.markHealthy()
+		return allowed, retry, nil
+	}
+	l.markDegraded(err)
+	switch l.mode {
+	case FailOpen:
+		rateLimitDegradedTotal.WithLabelValues(l.mode, "allowed").Inc()
+		return true, 0, nil
+	case FailClosed:
+		rateLimitDegradedTotal.WithLabelValues(l.mode, "unavailable").Inc()
+		return false, 0, ErrUnavailable
+	default:
+		allowed, retry := l.local.allow(key, windowMs, max)
+		outcome := "allowed"
+		if !allowed {
+			outcome = "limited"
+		}
+		rateLimitDegradedTotal.WithLabelValues(l.mode, outcome).Inc()
+		return allowed, retry, nil
+	}
+}
+
+func (l *Limiter) markDegraded(err error) {
+	if l.degraded.CompareAndSwap(false, true) {
+		rateLimitDegraded.Set(1)
+		log.Warn().Err(err).Str("fail_mode", l.mode).Msg("rate limiter degraded: redis unavailable")
+	}
+}
+
+func (l *Limiter) markHealthy() {
+	if l.degraded.CompareAndSwap(true, false) {
+		rateLimitDegraded.Set(0)
+		log.Info().Str("fail_mode", l.mode).Msg("rate limiter recovered: redis available")
+	}
+}
+
+// localLimiter is an in-process sliding window used in FailLocal mode. Limits
+// are per instance, so the effective global limit scales with replica count.
+type localLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]*localWindow
+	lastSweep int64
+}
+
+type localWindow struct {
+	hits     []int64
+	windowMs int64
+}
+
+func newLocalLimiter() *localLimiter {
+	return &localLimiter{windows: map[string]*localWindow{}}
+}
+
+func (l *localLimiter) allow(key string, windowMs int, max int) (bool, int64) {
+	now := time.Now().UnixMilli()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	w, ok := l.windows[key]
+	if !ok {
+		w = &localWindow{}
+		l.windows[key] = w
+	}
+	w.windowMs = int64(windowMs)
+	windowStart := now - w.windowMs
+	i := 0
+	for i < len(w.hits) && w.hits[i] <= windowStart {
+		i++
+	}
+	w.hits = w.hits[i:]
+	if len(w.hits) >= max {
+		retry := w.hits[0] + w.windowMs - now
+		if retry < 0 {
+			retry = 0
+		}
+		return false, retry
+	}
+	w.hits = append(w.hits, now)
+	return true, 0
+}
+
+// sweep drops keys with no hits in their window, at most once a minute.
+func (l *localLimiter) sweep(now int64) {
+	if now-l.lastSweep < 60000 {
+		return
+	}
+	l.lastSweep = now
+	for key, w := range l.windows {
+		if len(w.hits) == 0 || w.hits[len(w.hits)-1] <= now-w.windowMs {
+			delete(l.windows, key)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAllowSlidingWindow(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	ctx := context.Background()
+	// Hits are keyed by millisecond, so step the clock between them.
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		mr.SetTime(now.Add(time.Duration(i) * time.Millisecond))
+		if ok, _, err := Allow(ctx, client, "k", 60000, 2); err != nil || !ok {
+			t.Fatalf("hit %d: allowed %v, err %v", i, ok, err)
+		}
+	}
+	mr.SetTime(now.Add(2 * time.Millisecond))
+	if ok, retry, err := Allow(ctx, client, "k", 60000, 2); err != nil || ok || retry <= 0 {
+		t.Fatalf("third hit: allowed %v, retry %d, err %v", ok, retry, err)
+	}
+	if ok, _, _ := Allow(ctx, nil, "k", 60000, 0); !ok {
+		t.Fatal("nil client should allow")
+	}
+}
+
+func TestLimiterFailModes(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { _ = client.Close() })
+	mr.Close()
+	ctx := context.Background()
+
+	if ok, _, err := New(client, FailOpen).Allow(ctx, "k", 60000, 0); err != nil || !ok {
+		t.Errorf("fail open: allowed %v, err %v", ok, err)
+	}
+	if _, _, err := New(client, FailClosed).Allow(ctx, "k", 60000, 1); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("fail closed: err %v, want ErrUnavailable", err)
+	}
+	local := New(client, "bogus")
+	if ok, _, err := local.Allow(ctx, "k", 60000, 1); err != nil || !ok {
+		t.Fatalf("fail local first hit: allowed %v, err %v", ok, err)
+	}
+	if ok, retry, _ := local.Allow(ctx, "k", 60000, 1); ok || retry <= 0 {
+		t.Errorf("fail local second hit: allowed %v, retry %d", ok, retry)
+	}
+}
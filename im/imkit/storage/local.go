@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LocalConfig configures the local-disk backend, meant for development and
+// tests. im-api serves its signed URLs itself (see Handler).
+type LocalConfig struct {
+	Root       string // directory objects are stored under
+	BaseURL    string // public URL Handler is mounted at, e.g. http://localhost:8090/v1/media/local
+	Secret     string // HMAC key for signed URLs
+	PublicRead bool   // allow unsigned GET, like a public-read bucket
+	MaxBytes   int64  // upload size cap (0 = 100 MiB)
+}
+
+// LocalStorage stores objects as files; Content-Type is kept in a sidecar
+// "<key>.meta" file.
+type LocalStorage struct {
+	cfg LocalConfig
+}
+
+const localMetaSuffix = ".meta"
+
+type localMeta struct {
+	ContentType string `json:"content_type"`
+}
+
+// NewLocal returns a local-disk Storage rooted at cfg.Root.
+func NewLocal(cfg LocalConfig) (*LocalStorage, error) {
+	if cfg.Root == "" || cfg.BaseURL == "" || cfg.Secret == "" {
+		return nil, errors.New("local storage not configured")
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 100 << 20
+	}
+	cfg.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	if err := os.MkdirAll(cfg.Root, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalStorage{cfg: cfg}, nil
+}
+
+func (s *LocalStorage) Name() string { return "local" }
+
+func (s *LocalStorage) SignPut(_ context.Context, key, contentType string, expires time.Duration) (string, error) {
+	return s.sign(http.MethodPut, key, contentType, expires)
+}
+
+func (s *LocalStorage) SignGet(_ context.Context, key string, expires time.Duration) (string, error) {
+	return s.sign(http.MethodGet, key, "", expires)
+}
+
+func (s *LocalStorage) Head(_ context.Context, key string) (ObjectInfo, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	stat, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ObjectInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Size: stat.Size(), ContentType: readLocalMeta(path).ContentType, LastModified: stat.ModTime()}, nil
+}
+
+func (s *LocalStorage) ReadPrefix(_ context.Context, key string, n int64) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, n))
+}
+
+func (s *LocalStorage) Put(_ context.Context, key, contentType string, body io.Reader, _ int64) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	return s.write(path, contentType, body)
+}
+
+func (s *LocalStorage) Delete(_ context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	_ = os.Remove(path + localMetaSuffix)
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// SetLifecycle has no background expiry on disk; it sweeps expired objects
+// once, which is enough for a dev box that restarts often.
+func (s *LocalStorage) SetLifecycle(_ context.Context, rules []LifecycleRule) error {
+	now := time.Now()
+	return filepath.WalkDir(s.cfg.Root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasSuffix(path, localMetaSuffix) {
+			return err
+		}
+		rel, err := filepath.Rel(s.cfg.Root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		for _, rule := range rules {
+			if strings.HasPrefix(key, rule.Prefix) && now.Sub(info.ModTime()) > time.Duration(rule.Days)*24*time.Hour {
+				_ = os.Remove(path + localMetaSuffix)
+				return os.Remove(path)
+			}
+		}
+		return nil
+	})
+}
+
+// Handler serves signed PUT and GET requests for object keys relative to
+// BaseURL. Mount it with the BaseURL path stripped.
+func (s *LocalStorage) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		path, err := s.path(key)
+		if err != nil {
+			http.Error(w, "invalid key", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			contentType := r.Header.Get("Content-Type")
+			if !s.verify(r, http.MethodPut, key, contentType) {
+				http.Error(w, "signature invalid or expired", http.StatusForbidden)
+				return
+			}
+			if err := s.write(path, contentType, http.MaxBytesReader(w, r.Body, s.cfg.MaxBytes)); err != nil {
+				http.Error(w, "write failed", http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet, http.MethodHead:
+			if !s.cfg.PublicRead && !s.verify(r, http.MethodGet, key, "") {
+				http.Error(w, "signature invalid or expired", http.StatusForbidden)
+				return
+			}
+			f, err := os.Open(path)
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			defer f.Close()
+			stat, err := f.Stat()
+			if err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			if ct := readLocalMeta(path).ContentType; ct != "" {
+				w.Header().Set("Content-Type", ct)
+			}
+			http.ServeContent(w, r, "", stat.ModTime(), f)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func (s *LocalStorage) write(path, contentType string, body io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	meta, _ := json.Marshal(localMeta{ContentType: contentType})
+	if err := os.WriteFile(path+localMetaSuffix, meta, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// path maps a key to a file under Root, rejecting keys that could escape it.
+func (s *LocalStorage) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") || strings.HasSuffix(key, localMetaSuffix) {
+		return "", errors.New("invalid key")
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", errors.New("invalid key")
+		}
+	}
+	return filepath.Join(s.cfg.Root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalStorage) sign(method, key, contentType string, expires time.Duration) (string, error) {
+	if _, err := s.path(key); err != nil {
+		return "", err
+	}
+	exp := strconv.FormatInt(time.Now().Add(expires).Unix(), 10)
+	q := url.Values{}
+	q.Set("expires", exp)
+	q.Set("signature", s.mac(method, key, exp, contentType))
+	return s.cfg.BaseURL + "/" + key + "?" + q.Encode(), nil
+}
+
+func (s *LocalStorage) verify(r *http.Request, method, key, contentType string) bool {
+	exp := r.URL.Query().Get("expires")
+	unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() > unix {
+		return false
+	}
+	want := s.mac(method, key, exp, contentType)
+	return hmac.Equal([]byte(want), []byte(r.URL.Query().Get("signature")))
+}
+
+func (s *LocalStorage) mac(method, key, expires, contentType string) string {
+	h := hmac.New(sha256.New, []byte(s.cfg.Secret))
+	h.Write([]byte(method + "\n" + key + "\n" + expires + "\n" + contentType))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func readLocalMeta(path string) localMeta {
+	var meta localMeta
+	if raw, err := os.ReadFile(path + localMetaSuffix); err == nil {
+		_ = json.Unmarshal(raw, &meta)
+	}
+	return meta
+}
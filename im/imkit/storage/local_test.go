@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestLocal(t *testing.T, publicRead bool) (*LocalStorage, *httptest.Server) {
+	t.Helper()
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	store, err := NewLocal(LocalConfig{
+		Root:       t.TempDir(),
+		BaseURL:    srv.URL + "/media",
+		Secret:     "test",
+		PublicRead: publicRead,
+		MaxBytes:   1 << 10,
+	})
+	if err != nil {
+		t.Fatalf("NewLocal: %v", err)
+	}
+	mux.Handle("/media/", http.StripPrefix("/media", store.Handler()))
+	return store, srv
+}
+
+func do(t *testing.T, method, url, contentType, body string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestLocalRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestLocal(t, false)
+	key := "im/dev/2026/01/obj.png"
+
+	putURL, err := store.SignPut(ctx, key, "image/png", time.Minute)
+	if err != nil {
+		t.Fatalf("SignPut: %v", err)
+	}
+	if resp := do(t, http.MethodPut, putURL, "image/jpeg", "x"); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("PUT with other content-type: %d", resp.StatusCode)
+	}
+	if resp := do(t, http.MethodPut, putURL, "image/png", "\x89PNG\r\n\x1a\nrest"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("PUT: %d", resp.StatusCode)
+	}
+
+	info, err := store.Head(ctx, key)
+	if err != nil || info.Size != 12 || info.ContentType != "image/png" {
+		t.Fatalf("Head = %+v, %v", info, err)
+	}
+	head, err := store.ReadPrefix(ctx, key, 4)
+	if err != nil || string(head) != "\x89PNG" {
+		t.Fatalf("ReadPrefix = %q, %v", head, err)
+	}
+
+	getURL, _ := store.SignGet(ctx, key, time.Minute)
+	resp := do(t, http.MethodGet, getURL, "", "")
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" || len(body) != 12 {
+		t.Fatalf("GET: %d %q %d bytes", resp.StatusCode, resp.Header.Get("Content-Type"), len(body))
+	}
+	if resp := do(t, http.MethodGet, strings.Replace(getURL, "signature=", "signature=0", 1), "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("GET with bad signature: %d", resp.StatusCode)
+	}
+	expired, _ := store.SignGet(ctx, key, -time.Second)
+	if resp := do(t, http.MethodGet, expired, "", ""); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("GET with expired signature: %d", resp.StatusCode)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Head(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Head after delete: %v", err)
+	}
+}
+
+func TestLocalRejectsBadKeysAndLargeUploads(t *testing.T) {
+	ctx := context.Background()
+	store, srv := newTestLocal(t, true)
+	for _, key := range []string{"../etc/passwd", "/abs", "a//b", "a/./b", "x.png.meta"} {
+		if _, err := store.SignPut(ctx, key, "", time.Minute); err == nil {
+			t.Errorf("SignPut(%q) accepted", key)
+		}
+	}
+	if resp := do(t, http.MethodGet, srv.URL+"/media/im/../../secret", "", ""); resp.StatusCode == http.StatusOK {
+		t.Fatalf("traversal GET: %d", resp.StatusCode)
+	}
+	putURL, _ := store.SignPut(ctx, "im/big.bin", "", time.Minute)
+	if resp := do(t, http.MethodPut, putURL, "", strings.Repeat("x", 2<<10)); resp.StatusCode == http.StatusOK {
+		t.Fatal("oversized upload accepted")
+	}
+	if _, err := store.Head(ctx, "im/big.bin"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("partial upload left behind: %v", err)
+	}
+}
+
+func TestLocalPut(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestLocal(t, true)
+	if err := store.Put(ctx, "im/a_thumb.jpg", "image/jpeg", strings.NewReader("thumb"), 5); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	info, err := store.Head(ctx, "im/a_thumb.jpg")
+	if err != nil || info.Size != 5 || info.ContentType != "image/jpeg" {
+		t.Fatalf("Head = %+v, %v", info, err)
+	}
+	if err := store.Put(ctx, "../escape", "", strings.NewReader("x"), 1); err == nil {
+		t.Fatal("Put outside root accepted")
+	}
+}
+
+func TestLocalLifecycleSweep(t *testing.T) {
+	ctx := context.Background()
+	store, _ := newTestLocal(t, true)
+	putURL, _ := store.SignPut(ctx, "im-voice/a.m4a", "audio/mp4", time.Minute)
+	do(t, http.MethodPut, putURL, "audio/mp4", "data")
+	if err := store.SetLifecycle(ctx, []LifecycleRule{{Prefix: "im-voice/", Days: 0}}); err != nil {
+		t.Fatalf("SetLifecycle: %v", err)
+	}
+	if _, err := store.Head(ctx, "im-voice/a.m4a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expired object kept: %v", err)
+	}
+}
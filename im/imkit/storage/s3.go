@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+// S3Config configures an S3-compatible backend (AWS S3, MinIO, R2, COS...).
+type S3Config struct {
+	Endpoint        string // host[:port], no scheme
+	Region          string
+	Bucket          string
+	AccessKeyID     string
+	SecretAccessKey string
+	UseSSL          bool
+	PathStyle       bool
+}
+
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 returns an S3-compatible Storage.
+func NewS3(cfg S3Config) (Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" || cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, errors.New("s3 not configured")
+	}
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure:       cfg.UseSSL,
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3Storage{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (s *s3Storage) Name() string { return "s3" }
+
+func (s *s3Storage) SignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error) {
+	header := http.Header{}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	u, err := s.client.PresignHeader(ctx, http.MethodPut, s.bucket, key, expires, nil, header)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *s3Storage) SignGet(ctx context.Context, key string, expires time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, expires, url.Values{})
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (ObjectInfo, error) {
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return ObjectInfo{}, s3Error(err)
+	}
+	return ObjectInfo{Size: info.Size, ContentType: info.ContentType, LastModified: info.LastModified}, nil
+}
+
+func (s *s3Storage) ReadPrefix(ctx context.Context, key string, n int64) ([]byte, error) {
+	opts := minio.GetObjectOptions{}
+	if err := opts.SetRange(0, n-1); err != nil {
+		return nil, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, key, opts)
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(io.LimitReader(obj, n))
+	if err != nil {
+		return nil, s3Error(err)
+	}
+	return data, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, key, body, size, minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *s3Storage) SetLifecycle(ctx context.Context, rules []LifecycleRule) error {
+	cfg := lifecycle.NewConfiguration()
+	for _, rule := range rules {
+		cfg.Rules = append(cfg.Rules, lifecycle.Rule{
+			ID:         rule.ID,
+			Status:     "Enabled",
+			RuleFilter: lifecycle.Filter{Prefix: rule.Prefix},
+			Expiration: lifecycle.Expiration{Days: lifecycle.ExpirationDays(rule.Days)},
+		})
+	}
+	return s.client.SetBucketLifecycle(ctx, s.bucket, cfg)
+}
+
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+// Package storage abstracts the object store used for IM media, so im-api
+// and im-worker can run against Aliyun OSS, any S3-compatible store, or the
+// local disk.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by Head and ReadPrefix for missing objects.
+var ErrNotFound = errors.New("object not found")
+
+// ObjectInfo is what the store reports for an existing object.
+type ObjectInfo struct {
+	Size         int64
+	ContentType  string
+	LastModified time.Time
+}
+
+// LifecycleRule expires objects under Prefix after Days.
+type LifecycleRule struct {
+	ID     string
+	Prefix string
+	Days   int
+}
+
+// Storage is an object store for IM media.
+type Storage interface {
+	// Name identifies the backend in logs ("oss", "s3", "local").
+	Name() string
+	// SignPut returns a URL the client can PUT the object to, with the given
+	// Content-Type header.
+	SignPut(ctx context.Context, key, contentType string, expires time.Duration) (string, error)
+	// SignGet returns a time-limited download URL.
+	SignGet(ctx context.Context, key string, expires time.Duration) (string, error)
+	Head(ctx context.Context, key string) (ObjectInfo, error)
+	// ReadPrefix returns up to n leading bytes of the object.
+	ReadPrefix(ctx context.Context, key string, n int64) ([]byte, error)
+	// Put writes an object server-side (derived media such as thumbnails).
+	Put(ctx context.Context, key, contentType string, body io.Reader, size int64) error
+	Delete(ctx context.Context, key string) error
+	// SetLifecycle replaces the store's expiration rules.
+	SetLifecycle(ctx context.Context, rules []LifecycleRule) error
+}
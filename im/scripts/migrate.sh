@@ -25,4 +25,64 @@ docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
   -U "${POSTGRES_USER:-terravoy}" \
   -d "${POSTGRES_DB:-terravoy}" \
   -f /migrations/0027_im_device_tokens_pr5.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0040_im_message_recall.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0041_im_message_edits.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0042_im_message_reply.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0043_im_message_reactions.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0044_im_message_search.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0045_im_message_location.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0046_im_message_voice.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0047_im_message_video_file.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0048_im_media_object_keys.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0049_im_message_cards.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0050_im_thread_status.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0051_im_support_threads.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0052_im_group_threads.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0053_im_member_settings.sql
+docker compose -f "${COMPOSE_FILE}" exec -T "${DB_SERVICE}" psql \
+  -U "${POSTGRES_USER:-terravoy}" \
+  -d "${POSTGRES_DB:-terravoy}" \
+  -f /migrations/0054_im_unread_counters.sql
 echo "IM migrations done."
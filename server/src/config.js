@@ -19,6 +19,7 @@ const config = {
   },
   im: {
     apiBaseUrl: process.env.IM_API_BASE_URL || 'http://localhost:8090',
+    serviceToken: process.env.IM_SERVICE_TOKEN || '',
   },
   terra: {
     jwtSecret: process.env.TERRA_JWT_SECRET || 'dev_terra_secret_change_me',
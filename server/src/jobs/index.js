@@ -2,6 +2,7 @@ import { pool } from '../db/pool.js';
 import pino from 'pino';
 import { startMatchWorker } from '../workers/match_worker.js';
 import { config } from '../config.js';
+import { syncOrderThreadStatus } from '../services/imApi.js';
 import {
   replayFailedWebhooks,
   reconcileSucceededPayments,
@@ -40,6 +41,7 @@ async function autoCloseUnconfirmed() {
          values ($1,$2,$3,$4,$5)`,
         [order.id, order.status, 'CANCELLED_BY_TRAVELER', 'SYSTEM', 'PAYMENT_TIMEOUT']
       );
+      await syncOrderThreadStatus(logger, { orderId: order.id, orderStatus: 'CANCELLED_BY_TRAVELER' });
     }
     const { rows } = await client.query(
       `select * from orders where status = 'PENDING_HOST_CONFIRM' and created_at < $1`,
@@ -57,6 +59,7 @@ async function autoCloseUnconfirmed() {
          values ($1,$2,$3,$4,$5)`,
         [order.id, order.status, 'CANCELLED_REFUNDED', 'SYSTEM', 'AUTO_TIMEOUT']
       );
+      await syncOrderThreadStatus(logger, { orderId: order.id, orderStatus: 'CANCELLED_REFUNDED' });
     }
     if (rows.length > 0) {
       logger.info(`Auto-closed ${rows.length} stale orders`);
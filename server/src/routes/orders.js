@@ -3,6 +3,7 @@ import { requireApprovedHost } from '../middlewares/requireApprovedHost.js';
 import { authorize } from '../services/authorize.js';
 import { ok, error } from '../utils/responses.js';
 import { toOrderReadModel } from '../readModels/orderReadModel.js';
+import { syncOrderThreadStatus } from '../services/imApi.js';
 
 const ORDER_STATUS = {
   PENDING_PAYMENT: 'PENDING_PAYMENT',
@@ -320,6 +321,7 @@ async function handleReject(pool, req, reply, actor, orderId) {
     'insert into order_status_logs(order_id, from_status, to_status, actor_id, actor_role, reason) values ($1,$2,$3,$4,$5,$6)',
     [orderId, order.status, ORDER_STATUS.CANCELLED_REFUNDED, profileId, 'HOST', reason]
   );
+  await syncOrderThreadStatus(req.log, { orderId, orderStatus: ORDER_STATUS.CANCELLED_REFUNDED, reason });
   const enriched = await fetchOrder(pool, rows[0].id);
   return ok(reply, enriched ?? rows[0]);
 }
@@ -343,6 +345,7 @@ async function handleCancel(pool, req, reply, actor, orderId) {
     'insert into order_status_logs(order_id, from_status, to_status, actor_id, actor_role, reason) values ($1,$2,$3,$4,$5,$6)',
     [orderId, order.status, ORDER_STATUS.CANCELLED_BY_TRAVELER, profileId, 'TRAVELER', reason]
   );
+  await syncOrderThreadStatus(req.log, { orderId, orderStatus: ORDER_STATUS.CANCELLED_BY_TRAVELER, reason });
   const enriched = await fetchOrder(pool, rows[0].id);
   return ok(reply, enriched ?? rows[0]);
 }
@@ -395,6 +398,7 @@ async function handleEnd(pool, req, reply, actor, orderId) {
     'insert into order_status_logs(order_id, from_status, to_status, actor_id, actor_role) values ($1,$2,$3,$4,$5)',
     [orderId, order.status, ORDER_STATUS.COMPLETED, profileId, actorRole]
   );
+  await syncOrderThreadStatus(req.log, { orderId, orderStatus: ORDER_STATUS.COMPLETED });
   await pool.query(
     'insert into service_logs(order_id, event_type, actor_id, actor_role) values ($1,$2,$3,$4)',
     [orderId, 'END', profileId, actorRole]
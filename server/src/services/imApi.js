@@ -81,3 +81,63 @@ export async function ensureMatchThread({
   const data = await requestJson(url, { method: 'POST', body: payload, token });
   return data?.thread_id || data?.data?.thread_id || null;
 }
+
+// Posts a system / order_event message as the system (not a member).
+// eventKey makes retries idempotent, e.g. `order:${orderId}:paid`.
+export async function postServiceMessage({
+  threadId,
+  orderId,
+  matchSessionId,
+  eventKey,
+  type = 'system',
+  content,
+}) {
+  if (!config.im.serviceToken) {
+    throw new Error('imApi requires IM_SERVICE_TOKEN');
+  }
+  const base = config.im.apiBaseUrl.replace(/\/+$/, '');
+  const url = `${base}/internal/v1/messages`;
+  const payload = {
+    thread_id: threadId || undefined,
+    order_id: orderId || undefined,
+    match_session_id: matchSessionId || undefined,
+    event_key: eventKey,
+    type,
+    content,
+  };
+  const data = await requestJson(url, { method: 'POST', body: payload, token: config.im.serviceToken });
+  return data?.data || data;
+}
+
+// Tells im-api an order changed status: cancellation freezes the order
+// thread, completion closes it after the configured grace period.
+export async function updateOrderThreadStatus({ orderId, orderStatus, reason }) {
+  if (!config.im.serviceToken) {
+    throw new Error('imApi requires IM_SERVICE_TOKEN');
+  }
+  const base = config.im.apiBaseUrl.replace(/\/+$/, '');
+  const url = `${base}/internal/v1/orders/${encodeURIComponent(orderId)}/status`;
+  const data = await requestJson(url, {
+    method: 'POST',
+    body: { order_status: orderStatus, reason: reason || undefined },
+    token: config.im.serviceToken,
+  });
+  return data?.data || data;
+}
+
+// Best-effort updateOrderThreadStatus for order write paths. The order row is
+// already updated, so failures are logged and never thrown; orders without an
+// IM thread (THREAD_NOT_FOUND) are skipped quietly.
+export async function syncOrderThreadStatus(logger, { orderId, orderStatus, reason }) {
+  if (!config.im.serviceToken) {
+    return;
+  }
+  try {
+    await updateOrderThreadStatus({ orderId, orderStatus, reason });
+  } catch (err) {
+    if (err.detail?.code === 'THREAD_NOT_FOUND') {
+      return;
+    }
+    logger.warn({ err, orderId, orderStatus }, 'im order thread status update failed');
+  }
+}